@@ -0,0 +1,220 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// See RFC 8555. Accounts are stored in the pki so that clients keep them
+// across restarts of the server; orders, authorizations and challenges only
+// live in memory: clients whose order is lost have to create a new one.
+
+type ACMEAccount struct {
+	ID           string          `json:"id"`
+	Status       string          `json:"status"`
+	Contact      []string        `json:"contact,omitempty"`
+	Key          json.RawMessage `json:"key"`
+	CreationDate time.Time       `json:"creationDate"`
+
+	// The names of the certificates issued for the account
+	Certificates []string `json:"certificates,omitempty"`
+
+	publicKey  crypto.PublicKey
+	thumbprint string
+}
+
+func (a *ACMEAccount) loadKey() error {
+	key, err := ParseJWK(a.Key)
+	if err != nil {
+		return err
+	}
+
+	thumbprint, err := JWKThumbprint(key)
+	if err != nil {
+		return err
+	}
+
+	a.publicKey = key
+	a.thumbprint = thumbprint
+
+	return nil
+}
+
+func (a *ACMEAccount) HasCertificate(name string) bool {
+	for _, certName := range a.Certificates {
+		if certName == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pki *PKI) LoadACMEAccounts() ([]*ACMEAccount, error) {
+	names, err := pki.Storage.ListObjects(ObjectTypeACMEAccount)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list acme accounts: %w", err)
+	}
+
+	accounts := make([]*ACMEAccount, 0, len(names))
+
+	for _, name := range names {
+		data, err := pki.Storage.ReadObject(ObjectTypeACMEAccount, name)
+		if err != nil {
+			return nil, err
+		}
+
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+
+		var account ACMEAccount
+		if err := d.Decode(&account); err != nil {
+			return nil, fmt.Errorf("cannot decode acme account %q: %w",
+				name, err)
+		}
+
+		if err := account.loadKey(); err != nil {
+			return nil, fmt.Errorf("invalid key for acme account %q: %w",
+				name, err)
+		}
+
+		accounts = append(accounts, &account)
+	}
+
+	return accounts, nil
+}
+
+func (pki *PKI) WriteACMEAccount(account *ACMEAccount) error {
+	data, err := encodeJSON(account)
+	if err != nil {
+		return fmt.Errorf("cannot encode acme account: %w", err)
+	}
+
+	return pki.createOrReplaceObject(ObjectTypeACMEAccount, account.ID,
+		data)
+}
+
+type ACMEIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Validate a dns identifier, returning its normalized value. Wildcard
+// identifiers ("*.example.com") are accepted.
+func normalizeACMEIdentifier(id ACMEIdentifier) (string, error) {
+	if id.Type != "dns" {
+		return "", fmt.Errorf("unsupported identifier type %q", id.Type)
+	}
+
+	value := strings.ToLower(id.Value)
+	name := strings.TrimPrefix(value, "*.")
+
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("invalid dns name %q: ip addresses are "+
+			"not dns names", id.Value)
+	}
+
+	if err := validateDNSName(name); err != nil {
+		return "", fmt.Errorf("invalid dns name %q: %w", id.Value, err)
+	}
+
+	return value, nil
+}
+
+func validateDNSName(name string) error {
+	if len(name) == 0 || len(name) > 253 {
+		return errors.New("invalid length")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.New("invalid label length")
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("labels cannot start or end with '-'")
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') &&
+				c != '-' {
+				return fmt.Errorf("invalid character %q", c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Tokens are used in challenges and must contain at least 128 bits of
+// entropy (RFC 8555 8.1).
+func generateACMEToken() string {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		panic(fmt.Sprintf("cannot generate random data: %v", err))
+	}
+
+	return base64URL.EncodeToString(data)
+}
+
+// Errors are returned to clients as problem documents (RFC 7807).
+
+const acmeErrorNamespace = "urn:ietf:params:acme:error:"
+
+type ACMEProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func NewACMEProblem(status int, errType string, format string, args ...interface{}) *ACMEProblem {
+	problem := ACMEProblem{
+		Type:   acmeErrorNamespace + errType,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+
+	return &problem
+}
+
+func (p *ACMEProblem) Error() string {
+	return fmt.Sprintf("%s: %s", strings.TrimPrefix(p.Type,
+		acmeErrorNamespace), p.Detail)
+}
+
+func acmeMalformed(format string, args ...interface{}) *ACMEProblem {
+	return NewACMEProblem(http.StatusBadRequest, "malformed", format,
+		args...)
+}
+
+func acmeUnauthorized(format string, args ...interface{}) *ACMEProblem {
+	return NewACMEProblem(http.StatusForbidden, "unauthorized", format,
+		args...)
+}
+
+func acmeServerInternal(format string, args ...interface{}) *ACMEProblem {
+	return NewACMEProblem(http.StatusInternalServerError, "serverInternal",
+		format, args...)
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The timeout applied to each challenge validation
+const acmeChallengeTimeout = 30 * time.Second
+
+// The maximum size of a response to a http-01 challenge
+const maxACMEHTTP01ResponseSize = 4096
+
+// RFC 8737 3: the extension containing the key authorization digest
+var oidExtACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const acmeTLSALPNProtocol = "acme-tls/1"
+
+// RFC 8555 8.3.
+func (s *ACMEServer) validateHTTP01Challenge(domain, token, keyAuthorization string) *ACMEProblem {
+	uri := "http://" + net.JoinHostPort(domain,
+		strconv.Itoa(s.Cfg.HTTP01Port)) + "/.well-known/acme-challenge/" +
+		token
+
+	client := http.Client{
+		Timeout: acmeChallengeTimeout,
+	}
+
+	res, err := client.Get(uri)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "connection",
+			"cannot fetch %s: %v", uri, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return NewACMEProblem(http.StatusForbidden, "incorrectResponse",
+			"request to %s failed with status %d", uri, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body,
+		maxACMEHTTP01ResponseSize))
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "connection",
+			"cannot read response from %s: %v", uri, err)
+	}
+
+	// Clients may add trailing whitespace (RFC 8555 8.3).
+	body = bytes.TrimRight(body, " \t\r\n")
+
+	if subtle.ConstantTimeCompare(body, []byte(keyAuthorization)) != 1 {
+		return NewACMEProblem(http.StatusForbidden, "incorrectResponse",
+			"invalid key authorization returned by %s", uri)
+	}
+
+	return nil
+}
+
+// RFC 8555 8.4.
+func (s *ACMEServer) validateDNS01Challenge(domain, keyAuthorization string) *ACMEProblem {
+	recordName := "_acme-challenge." + domain
+
+	resolver := net.DefaultResolver
+
+	if address := s.Cfg.DNSResolver; address != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		acmeChallengeTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, recordName)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "dns",
+			"cannot lookup txt records for %q: %v", recordName, err)
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	expectedValue := base64URL.EncodeToString(digest[:])
+
+	for _, record := range records {
+		if record == expectedValue {
+			return nil
+		}
+	}
+
+	return NewACMEProblem(http.StatusForbidden, "incorrectResponse",
+		"no valid txt record found for %q", recordName)
+}
+
+// RFC 8737 3.
+func (s *ACMEServer) validateTLSALPN01Challenge(domain, keyAuthorization string) *ACMEProblem {
+	address := net.JoinHostPort(domain, strconv.Itoa(s.Cfg.TLSALPN01Port))
+
+	dialer := net.Dialer{
+		Timeout: acmeChallengeTimeout,
+	}
+
+	// The certificate is self-signed: it is validated below instead of
+	// being verified against a trusted ca.
+	tlsCfg := tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acmeTLSALPNProtocol},
+		InsecureSkipVerify: true,
+	}
+
+	conn, err := tls.DialWithDialer(&dialer, "tcp", address, &tlsCfg)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "tls",
+			"cannot connect to %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+
+	if state.NegotiatedProtocol != acmeTLSALPNProtocol {
+		return NewACMEProblem(http.StatusForbidden, "tls",
+			"server at %s did not negotiate the %s protocol", address,
+			acmeTLSALPNProtocol)
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return NewACMEProblem(http.StatusForbidden, "tls",
+			"server at %s did not return a certificate", address)
+	}
+
+	if err := checkACMETLSALPNCertificate(state.PeerCertificates[0], domain,
+		keyAuthorization); err != nil {
+		return NewACMEProblem(http.StatusForbidden, "incorrectResponse",
+			"invalid certificate returned by %s: %v", address, err)
+	}
+
+	return nil
+}
+
+func checkACMETLSALPNCertificate(cert *x509.Certificate, domain, keyAuthorization string) error {
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], domain) {
+		return fmt.Errorf("certificate must contain a single dns name "+
+			"equal to %q", domain)
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtACMEIdentifier) {
+			continue
+		}
+
+		if !ext.Critical {
+			return errors.New("acme identifier extension is not critical")
+		}
+
+		var value []byte
+		rest, err := asn1.Unmarshal(ext.Value, &value)
+		if err != nil {
+			return fmt.Errorf("invalid acme identifier extension: %w", err)
+		} else if len(rest) > 0 {
+			return errors.New("invalid acme identifier extension: " +
+				"trailing data")
+		}
+
+		if subtle.ConstantTimeCompare(value, digest[:]) != 1 {
+			return errors.New("invalid key authorization digest")
+		}
+
+		return nil
+	}
+
+	return errors.New("missing acme identifier extension")
+}
@@ -0,0 +1,1396 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum size of a request body
+const maxACMERequestSize = 1024 * 1024
+
+// The time during which orders and authorizations can be completed
+const acmeOrderLifetime = 7 * 24 * time.Hour
+
+// The time during which a nonce can be used
+const acmeNonceLifetime = time.Hour
+
+const maxACMENonces = 10000
+
+type ACMEServerCfg struct {
+	// The external url of the server, e.g. "https://acme.example.com"
+	URL string
+
+	IssuerName string
+	Profile    string
+
+	ChallengeTypes []string
+
+	// Ports used to validate challenges; tests use non-standard ports
+	HTTP01Port    int
+	TLSALPN01Port int
+
+	// The address of the dns server used for dns-01 challenges
+	// (default: the system resolver)
+	DNSResolver string
+}
+
+type ACMEServer struct {
+	PKI *PKI
+	Cfg ACMEServerCfg
+
+	issuerCert *x509.Certificate
+	issuerKey  crypto.PrivateKey
+
+	mutex          sync.Mutex
+	nonces         map[string]time.Time
+	accounts       map[string]*ACMEAccount
+	orders         map[string]*acmeOrder
+	authorizations map[string]*acmeAuthorization
+	challenges     map[string]*acmeChallenge
+}
+
+type acmeOrder struct {
+	ID               string
+	AccountID        string
+	Status           string
+	Expires          time.Time
+	Identifiers      []string
+	AuthorizationIDs []string
+	CertificateName  string
+	Error            *ACMEProblem
+}
+
+type acmeAuthorization struct {
+	ID         string
+	AccountID  string
+	Identifier string // without the wildcard prefix
+	Wildcard   bool
+	Status     string
+	Expires    time.Time
+	Challenges []*acmeChallenge
+}
+
+type acmeChallenge struct {
+	ID              string
+	AuthorizationID string
+	Type            string
+	Token           string
+	Status          string
+	Validated       time.Time
+	Error           *ACMEProblem
+}
+
+type acmeRequest struct {
+	URL     string
+	Header  *JWSHeader
+	Payload []byte
+
+	// Set if the request was signed by an account (kid header)
+	Account *ACMEAccount
+
+	// Set if the request was signed by the key in the jwk header
+	Key crypto.PublicKey
+}
+
+func (r *acmeRequest) IsPostAsGet() bool {
+	return len(r.Payload) == 0
+}
+
+// The caller must hold the pki lock: accounts are loaded from the pki.
+func NewACMEServer(pki *PKI, cfg ACMEServerCfg) (*ACMEServer, error) {
+	if err := CheckEnrollmentProfile(cfg.Profile); err != nil {
+		return nil, err
+	}
+
+	s := ACMEServer{
+		PKI: pki,
+		Cfg: cfg,
+
+		nonces:         make(map[string]time.Time),
+		accounts:       make(map[string]*ACMEAccount),
+		orders:         make(map[string]*acmeOrder),
+		authorizations: make(map[string]*acmeAuthorization),
+		challenges:     make(map[string]*acmeChallenge),
+	}
+
+	s.Cfg.URL = strings.TrimSuffix(s.Cfg.URL, "/")
+
+	accounts, err := pki.LoadACMEAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		s.accounts[account.ID] = account
+	}
+
+	return &s, nil
+}
+
+// Set the certificate and private key of the ca used to issue certificates.
+func (s *ACMEServer) SetIssuer(cert *x509.Certificate, key crypto.PrivateKey) {
+	s.issuerCert = cert
+	s.issuerKey = key
+}
+
+func (s *ACMEServer) url(parts ...string) string {
+	return s.Cfg.URL + "/" + strings.Join(parts, "/")
+}
+
+func (s *ACMEServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+
+	header := w.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("Link", `<`+s.url("directory")+`>;rel="index"`)
+
+	if path != "/directory" {
+		header.Set("Replay-Nonce", s.newNonce())
+	}
+
+	var problem *ACMEProblem
+
+	switch {
+	case path == "/directory":
+		problem = s.hGetDirectory(w, req)
+
+	case path == "/new-nonce":
+		problem = s.hNewNonce(w, req)
+
+	case req.Method != http.MethodPost:
+		header.Set("Allow", "POST")
+		problem = NewACMEProblem(http.StatusMethodNotAllowed, "malformed",
+			"method not allowed")
+
+	default:
+		problem = s.handlePOST(w, req, path)
+	}
+
+	if problem != nil {
+		if problem.Status == http.StatusInternalServerError {
+			p.Error("acme: %s %s: %v", req.Method, path, problem)
+		}
+
+		s.writeProblem(w, problem)
+	}
+}
+
+func (s *ACMEServer) handlePOST(w http.ResponseWriter, req *http.Request, path string) *ACMEProblem {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	// Only new accounts and revocations can be signed with a key which
+	// is not the one of an account (RFC 8555 6.2).
+	allowJWK := path == "/new-account" || path == "/revoke-cert"
+
+	r, problem := s.readRequest(req, allowJWK)
+	if problem != nil {
+		return problem
+	}
+
+	switch {
+	case path == "/new-account":
+		return s.hNewAccount(w, r)
+
+	case path == "/new-order":
+		return s.hNewOrder(w, r)
+
+	case path == "/revoke-cert":
+		return s.hRevokeCert(w, r)
+
+	case len(segments) == 2 && segments[0] == "account":
+		return s.hAccount(w, r, segments[1])
+
+	case len(segments) == 3 && segments[0] == "account" &&
+		segments[2] == "orders":
+		return s.hAccountOrders(w, r, segments[1])
+
+	case len(segments) == 2 && segments[0] == "order":
+		return s.hOrder(w, r, segments[1])
+
+	case len(segments) == 3 && segments[0] == "order" &&
+		segments[2] == "finalize":
+		return s.hFinalizeOrder(w, r, segments[1])
+
+	case len(segments) == 2 && segments[0] == "authz":
+		return s.hAuthorization(w, r, segments[1])
+
+	case len(segments) == 2 && segments[0] == "challenge":
+		return s.hChallenge(w, r, segments[1])
+
+	case len(segments) == 2 && segments[0] == "certificate":
+		return s.hCertificate(w, r, segments[1])
+
+	default:
+		return NewACMEProblem(http.StatusNotFound, "malformed",
+			"resource not found")
+	}
+}
+
+func (s *ACMEServer) readRequest(req *http.Request, allowJWK bool) (*acmeRequest, *ACMEProblem) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "application/jose+json" {
+		return nil, NewACMEProblem(http.StatusUnsupportedMediaType,
+			"malformed", "invalid content type %q", contentType)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body,
+		maxACMERequestSize+1))
+	if err != nil {
+		return nil, acmeMalformed("cannot read body: %v", err)
+	} else if len(body) > maxACMERequestSize {
+		return nil, acmeMalformed("request too large")
+	}
+
+	jws, header, payload, err := ParseJWS(body)
+	if err != nil {
+		return nil, acmeMalformed("%v", err)
+	}
+
+	if !s.useNonce(header.Nonce) {
+		return nil, NewACMEProblem(http.StatusBadRequest, "badNonce",
+			"invalid nonce")
+	}
+
+	r := acmeRequest{
+		URL:     s.Cfg.URL + req.URL.Path,
+		Header:  header,
+		Payload: payload,
+	}
+
+	if header.URL != r.URL {
+		return nil, acmeUnauthorized("url %q does not match the url "+
+			"of the request", header.URL)
+	}
+
+	switch {
+	case len(header.JWK) > 0 && header.KeyID != "":
+		return nil, acmeMalformed("jwk and kid headers are mutually " +
+			"exclusive")
+
+	case len(header.JWK) > 0:
+		if !allowJWK {
+			return nil, acmeMalformed("requests must be signed by " +
+				"an account")
+		}
+
+		key, err := ParseJWK(header.JWK)
+		if err != nil {
+			return nil, NewACMEProblem(http.StatusBadRequest,
+				"badPublicKey", "%v", err)
+		}
+
+		r.Key = key
+
+	case header.KeyID != "":
+		prefix := s.url("account") + "/"
+		if !strings.HasPrefix(header.KeyID, prefix) {
+			return nil, NewACMEProblem(http.StatusBadRequest,
+				"accountDoesNotExist", "unknown account %q",
+				header.KeyID)
+		}
+
+		s.mutex.Lock()
+		account := s.accounts[strings.TrimPrefix(header.KeyID, prefix)]
+		s.mutex.Unlock()
+
+		if account == nil {
+			return nil, NewACMEProblem(http.StatusBadRequest,
+				"accountDoesNotExist", "unknown account %q",
+				header.KeyID)
+		}
+
+		if account.Status != "valid" {
+			return nil, acmeUnauthorized("account is %s",
+				account.Status)
+		}
+
+		r.Account = account
+		r.Key = account.publicKey
+
+	default:
+		return nil, acmeMalformed("missing jwk or kid header")
+	}
+
+	if err := jws.Verify(header.Algorithm, r.Key); err != nil {
+		if strings.HasPrefix(err.Error(), "unsupported algorithm") {
+			return nil, NewACMEProblem(http.StatusBadRequest,
+				"badSignatureAlgorithm", "%v", err)
+		}
+
+		return nil, acmeMalformed("invalid signature: %v", err)
+	}
+
+	return &r, nil
+}
+
+func (r *acmeRequest) decodePayload(value interface{}) *ACMEProblem {
+	if err := json.Unmarshal(r.Payload, value); err != nil {
+		return acmeMalformed("invalid payload: %v", err)
+	}
+
+	return nil
+}
+
+func (s *ACMEServer) newNonce() string {
+	nonce := base64URL.EncodeToString([]byte(generateRandomID()))
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.nonces) >= maxACMENonces {
+		for n, expiration := range s.nonces {
+			if now.After(expiration) || len(s.nonces) >= maxACMENonces {
+				delete(s.nonces, n)
+			}
+		}
+	}
+
+	s.nonces[nonce] = now.Add(acmeNonceLifetime)
+
+	return nonce
+}
+
+func (s *ACMEServer) useNonce(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expiration, found := s.nonces[nonce]
+	if !found {
+		return false
+	}
+
+	delete(s.nonces, nonce)
+
+	return time.Now().Before(expiration)
+}
+
+func (s *ACMEServer) writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		p.Error("acme: cannot encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *ACMEServer) writeProblem(w http.ResponseWriter, problem *ACMEProblem) {
+	data, err := json.Marshal(problem)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	w.Write(data)
+}
+
+func (s *ACMEServer) hGetDirectory(w http.ResponseWriter, req *http.Request) *ACMEProblem {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return NewACMEProblem(http.StatusMethodNotAllowed, "malformed",
+			"method not allowed")
+	}
+
+	directory := map[string]interface{}{
+		"newNonce":   s.url("new-nonce"),
+		"newAccount": s.url("new-account"),
+		"newOrder":   s.url("new-order"),
+		"revokeCert": s.url("revoke-cert"),
+		"meta": map[string]interface{}{
+			"externalAccountRequired": false,
+		},
+	}
+
+	s.writeJSON(w, http.StatusOK, directory)
+	return nil
+}
+
+func (s *ACMEServer) hNewNonce(w http.ResponseWriter, req *http.Request) *ACMEProblem {
+	switch req.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		return NewACMEProblem(http.StatusMethodNotAllowed, "malformed",
+			"method not allowed")
+	}
+
+	return nil
+}
+
+// Accounts
+
+func (s *ACMEServer) accountObject(account *ACMEAccount) interface{} {
+	return map[string]interface{}{
+		"status":  account.Status,
+		"contact": account.Contact,
+		"orders":  s.url("account", account.ID, "orders"),
+	}
+}
+
+func (s *ACMEServer) hNewAccount(w http.ResponseWriter, r *acmeRequest) *ACMEProblem {
+	var payload struct {
+		Contact              []string        `json:"contact"`
+		TermsOfServiceAgreed bool            `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool            `json:"onlyReturnExisting"`
+		ExternalAccount      json.RawMessage `json:"externalAccountBinding"`
+	}
+
+	if problem := r.decodePayload(&payload); problem != nil {
+		return problem
+	}
+
+	thumbprint, err := JWKThumbprint(r.Key)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "badPublicKey",
+			"%v", err)
+	}
+
+	s.mutex.Lock()
+	var account *ACMEAccount
+	for _, a := range s.accounts {
+		if a.thumbprint == thumbprint {
+			account = a
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	if account != nil {
+		w.Header().Set("Location", s.url("account", account.ID))
+		s.writeJSON(w, http.StatusOK, s.accountObject(account))
+		return nil
+	}
+
+	if payload.OnlyReturnExisting {
+		return NewACMEProblem(http.StatusBadRequest,
+			"accountDoesNotExist", "no account found for this key")
+	}
+
+	if problem := validateACMEContacts(payload.Contact); problem != nil {
+		return problem
+	}
+
+	account = &ACMEAccount{
+		ID:           generateRandomID(),
+		Status:       "valid",
+		Contact:      payload.Contact,
+		Key:          r.Header.JWK,
+		CreationDate: time.Now().UTC(),
+
+		publicKey:  r.Key,
+		thumbprint: thumbprint,
+	}
+
+	if err := s.writeAccount(account); err != nil {
+		return acmeServerInternal("cannot create account: %v", err)
+	}
+
+	p.Info("acme: created account %s", account.ID)
+
+	s.mutex.Lock()
+	s.accounts[account.ID] = account
+	s.mutex.Unlock()
+
+	w.Header().Set("Location", s.url("account", account.ID))
+	s.writeJSON(w, http.StatusCreated, s.accountObject(account))
+	return nil
+}
+
+func validateACMEContacts(contacts []string) *ACMEProblem {
+	for _, contact := range contacts {
+		if !strings.HasPrefix(contact, "mailto:") {
+			return NewACMEProblem(http.StatusBadRequest,
+				"unsupportedContact", "unsupported contact %q", contact)
+		}
+
+		if strings.ContainsAny(contact, ",?") {
+			return NewACMEProblem(http.StatusBadRequest,
+				"invalidContact", "invalid contact %q", contact)
+		}
+	}
+
+	return nil
+}
+
+func (s *ACMEServer) writeAccount(account *ACMEAccount) error {
+	return s.PKI.WithLock(LockModeExclusive, func() error {
+		return s.PKI.WithTransaction(func() error {
+			return s.PKI.WriteACMEAccount(account)
+		})
+	})
+}
+
+func (s *ACMEServer) hAccount(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	if r.Account.ID != id {
+		return acmeUnauthorized("account mismatch")
+	}
+
+	if !r.IsPostAsGet() {
+		var payload struct {
+			Status  string   `json:"status"`
+			Contact []string `json:"contact"`
+		}
+
+		if problem := r.decodePayload(&payload); problem != nil {
+			return problem
+		}
+
+		if payload.Status != "" && payload.Status != "deactivated" {
+			return acmeMalformed("invalid status %q", payload.Status)
+		}
+
+		if problem := validateACMEContacts(payload.Contact); problem != nil {
+			return problem
+		}
+
+		s.mutex.Lock()
+		account := *r.Account
+		s.mutex.Unlock()
+
+		if payload.Contact != nil {
+			account.Contact = payload.Contact
+		}
+
+		if payload.Status != "" {
+			account.Status = payload.Status
+		}
+
+		if err := s.writeAccount(&account); err != nil {
+			return acmeServerInternal("cannot update account: %v", err)
+		}
+
+		s.mutex.Lock()
+		s.accounts[account.ID] = &account
+		s.mutex.Unlock()
+
+		r.Account = &account
+	}
+
+	s.writeJSON(w, http.StatusOK, s.accountObject(r.Account))
+	return nil
+}
+
+func (s *ACMEServer) hAccountOrders(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	if r.Account.ID != id {
+		return acmeUnauthorized("account mismatch")
+	}
+
+	s.mutex.Lock()
+	orderURLs := []string{}
+	for _, order := range s.orders {
+		if order.AccountID == id {
+			orderURLs = append(orderURLs, s.url("order", order.ID))
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(orderURLs)
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"orders": orderURLs,
+	})
+	return nil
+}
+
+// Orders
+
+// The caller must hold the mutex.
+func (s *ACMEServer) orderObject(order *acmeOrder) interface{} {
+	identifiers := make([]ACMEIdentifier, len(order.Identifiers))
+	for i, value := range order.Identifiers {
+		identifiers[i] = ACMEIdentifier{Type: "dns", Value: value}
+	}
+
+	authorizationURLs := make([]string, len(order.AuthorizationIDs))
+	for i, id := range order.AuthorizationIDs {
+		authorizationURLs[i] = s.url("authz", id)
+	}
+
+	object := map[string]interface{}{
+		"status":         order.Status,
+		"expires":        order.Expires,
+		"identifiers":    identifiers,
+		"authorizations": authorizationURLs,
+		"finalize":       s.url("order", order.ID, "finalize"),
+	}
+
+	if order.CertificateName != "" {
+		object["certificate"] = s.url("certificate",
+			order.CertificateName)
+	}
+
+	if order.Error != nil {
+		object["error"] = order.Error
+	}
+
+	return object
+}
+
+func (s *ACMEServer) hNewOrder(w http.ResponseWriter, r *acmeRequest) *ACMEProblem {
+	var payload struct {
+		Identifiers []ACMEIdentifier `json:"identifiers"`
+		NotBefore   string           `json:"notBefore"`
+		NotAfter    string           `json:"notAfter"`
+	}
+
+	if problem := r.decodePayload(&payload); problem != nil {
+		return problem
+	}
+
+	if payload.NotBefore != "" || payload.NotAfter != "" {
+		return acmeMalformed("notBefore and notAfter are not supported")
+	}
+
+	if len(payload.Identifiers) == 0 {
+		return acmeMalformed("missing identifiers")
+	}
+
+	identifierSet := make(map[string]bool)
+	for _, id := range payload.Identifiers {
+		value, err := normalizeACMEIdentifier(id)
+		if err != nil {
+			errType := "rejectedIdentifier"
+			if id.Type != "dns" {
+				errType = "unsupportedIdentifier"
+			}
+
+			return NewACMEProblem(http.StatusBadRequest, errType, "%v",
+				err)
+		}
+
+		identifierSet[value] = true
+	}
+
+	identifiers := make([]string, 0, len(identifierSet))
+	for value := range identifierSet {
+		identifiers = append(identifiers, value)
+	}
+	sort.Strings(identifiers)
+
+	now := time.Now().UTC()
+
+	order := acmeOrder{
+		ID:          generateRandomID(),
+		AccountID:   r.Account.ID,
+		Status:      "pending",
+		Expires:     now.Add(acmeOrderLifetime).Truncate(time.Second),
+		Identifiers: identifiers,
+	}
+
+	var authorizations []*acmeAuthorization
+
+	for _, value := range identifiers {
+		authz := acmeAuthorization{
+			ID:         generateRandomID(),
+			AccountID:  r.Account.ID,
+			Identifier: strings.TrimPrefix(value, "*."),
+			Wildcard:   strings.HasPrefix(value, "*."),
+			Status:     "pending",
+			Expires:    order.Expires,
+		}
+
+		for _, challengeType := range s.Cfg.ChallengeTypes {
+			// Wildcard names can only be validated with dns records
+			// (RFC 8555 7.1.3).
+			if authz.Wildcard && challengeType != "dns-01" {
+				continue
+			}
+
+			authz.Challenges = append(authz.Challenges, &acmeChallenge{
+				ID:              generateRandomID(),
+				AuthorizationID: authz.ID,
+				Type:            challengeType,
+				Token:           generateACMEToken(),
+				Status:          "pending",
+			})
+		}
+
+		if len(authz.Challenges) == 0 {
+			return NewACMEProblem(http.StatusBadRequest,
+				"rejectedIdentifier", "no challenge available for "+
+					"identifier %q", value)
+		}
+
+		authorizations = append(authorizations, &authz)
+		order.AuthorizationIDs = append(order.AuthorizationIDs, authz.ID)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.deleteExpiredOrders(now)
+
+	s.orders[order.ID] = &order
+
+	for _, authz := range authorizations {
+		s.authorizations[authz.ID] = authz
+
+		for _, challenge := range authz.Challenges {
+			s.challenges[challenge.ID] = challenge
+		}
+	}
+
+	w.Header().Set("Location", s.url("order", order.ID))
+	s.writeJSON(w, http.StatusCreated, s.orderObject(&order))
+	return nil
+}
+
+// The caller must hold the mutex.
+func (s *ACMEServer) deleteExpiredOrders(now time.Time) {
+	for id, order := range s.orders {
+		if now.Before(order.Expires) {
+			continue
+		}
+
+		for _, authzID := range order.AuthorizationIDs {
+			if authz := s.authorizations[authzID]; authz != nil {
+				for _, challenge := range authz.Challenges {
+					delete(s.challenges, challenge.ID)
+				}
+			}
+
+			delete(s.authorizations, authzID)
+		}
+
+		delete(s.orders, id)
+	}
+}
+
+// Update the status of an order from the status of its authorizations. The
+// caller must hold the mutex.
+func (s *ACMEServer) updateOrderStatus(order *acmeOrder) {
+	now := time.Now()
+
+	if order.Status != "pending" && order.Status != "ready" {
+		return
+	}
+
+	if now.After(order.Expires) {
+		order.Status = "invalid"
+		order.Error = acmeUnauthorized("order expired")
+		return
+	}
+
+	allValid := true
+
+	for _, id := range order.AuthorizationIDs {
+		authz := s.authorizations[id]
+		if authz == nil {
+			allValid = false
+			continue
+		}
+
+		switch authz.Status {
+		case "valid":
+
+		case "pending":
+			allValid = false
+
+		default:
+			order.Status = "invalid"
+			order.Error = acmeUnauthorized("authorization for %q is %s",
+				authz.Identifier, authz.Status)
+			return
+		}
+	}
+
+	if allValid {
+		order.Status = "ready"
+	}
+}
+
+func (s *ACMEServer) findOrder(r *acmeRequest, id string) (*acmeOrder, *ACMEProblem) {
+	order := s.orders[id]
+	if order == nil {
+		return nil, NewACMEProblem(http.StatusNotFound, "malformed",
+			"order not found")
+	}
+
+	if order.AccountID != r.Account.ID {
+		return nil, acmeUnauthorized("order belongs to another account")
+	}
+
+	return order, nil
+}
+
+func (s *ACMEServer) hOrder(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	order, problem := s.findOrder(r, id)
+	if problem != nil {
+		return problem
+	}
+
+	s.updateOrderStatus(order)
+
+	if order.Status == "processing" {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	s.writeJSON(w, http.StatusOK, s.orderObject(order))
+	return nil
+}
+
+func (s *ACMEServer) hFinalizeOrder(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+
+	if problem := r.decodePayload(&payload); problem != nil {
+		return problem
+	}
+
+	csrData, err := base64URL.DecodeString(payload.CSR)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "badCSR",
+			"invalid csr encoding: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrData)
+	if err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "badCSR",
+			"invalid csr: %v", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return NewACMEProblem(http.StatusBadRequest, "badCSR",
+			"invalid csr signature: %v", err)
+	}
+
+	s.mutex.Lock()
+
+	order, problem := s.findOrder(r, id)
+	if problem != nil {
+		s.mutex.Unlock()
+		return problem
+	}
+
+	s.updateOrderStatus(order)
+
+	if order.Status != "ready" {
+		s.mutex.Unlock()
+		return NewACMEProblem(http.StatusForbidden, "orderNotReady",
+			"order is %s", order.Status)
+	}
+
+	if problem := checkACMECSR(csr, order.Identifiers); problem != nil {
+		s.mutex.Unlock()
+		return problem
+	}
+
+	order.Status = "processing"
+	identifiers := order.Identifiers
+	s.mutex.Unlock()
+
+	certName := "acme-" + order.ID
+
+	err = s.issueCertificate(r.Account, certName, csr, identifiers)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil {
+		order.Status = "invalid"
+		order.Error = acmeServerInternal("cannot issue certificate")
+		return acmeServerInternal("cannot issue certificate: %v", err)
+	}
+
+	p.Info("acme: issued certificate %q for %s", certName,
+		strings.Join(identifiers, ", "))
+
+	order.Status = "valid"
+	order.CertificateName = certName
+
+	w.Header().Set("Location", s.url("order", order.ID))
+	s.writeJSON(w, http.StatusOK, s.orderObject(order))
+	return nil
+}
+
+// The names requested in the csr must be exactly the identifiers of the
+// order (RFC 8555 7.4).
+func checkACMECSR(csr *x509.CertificateRequest, identifiers []string) *ACMEProblem {
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 ||
+		len(csr.URIs) > 0 {
+		return NewACMEProblem(http.StatusBadRequest, "badCSR",
+			"csr can only contain dns names")
+	}
+
+	names := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		names[strings.ToLower(name)] = true
+	}
+
+	if cn := csr.Subject.CommonName; cn != "" {
+		names[strings.ToLower(cn)] = true
+	}
+
+	if len(names) != len(identifiers) {
+		return NewACMEProblem(http.StatusBadRequest, "badCSR",
+			"csr names do not match the identifiers of the order")
+	}
+
+	for _, value := range identifiers {
+		if !names[value] {
+			return NewACMEProblem(http.StatusBadRequest, "badCSR",
+				"identifier %q missing from csr", value)
+		}
+	}
+
+	return nil
+}
+
+func (s *ACMEServer) issueCertificate(account *ACMEAccount, name string, csr *x509.CertificateRequest, identifiers []string) error {
+	return s.PKI.WithLock(LockModeExclusive, func() error {
+		issuerName := s.Cfg.IssuerName
+
+		certData := CertificateData{
+			Validity: s.PKI.CertificateDefaults(issuerName).Validity,
+			SAN: SAN{
+				DNSNames: identifiers,
+			},
+		}
+
+		// The subject is optional when there is a subject alternative
+		// name extension; common names are limited to 64 characters.
+		if len(identifiers[0]) <= 64 {
+			certData.Subject.CommonName = identifiers[0]
+		}
+
+		if err := certData.ApplyProfile(s.Cfg.Profile); err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		updatedAccount := *account
+		updatedAccount.Certificates = append(
+			append([]string(nil), account.Certificates...), name)
+		s.mutex.Unlock()
+
+		err := s.PKI.WithTransaction(func() error {
+			_, err := s.PKI.SignCertificateRequest(name, csr, &certData,
+				issuerName, s.issuerCert, s.issuerKey)
+			if err != nil {
+				return err
+			}
+
+			return s.PKI.WriteACMEAccount(&updatedAccount)
+		})
+		if err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		account.Certificates = updatedAccount.Certificates
+		s.mutex.Unlock()
+
+		return nil
+	})
+}
+
+// Authorizations and challenges
+
+// The caller must hold the mutex.
+func (s *ACMEServer) authorizationObject(authz *acmeAuthorization) interface{} {
+	challenges := make([]interface{}, len(authz.Challenges))
+	for i, challenge := range authz.Challenges {
+		challenges[i] = s.challengeObject(challenge)
+	}
+
+	object := map[string]interface{}{
+		"identifier": ACMEIdentifier{Type: "dns", Value: authz.Identifier},
+		"status":     authz.Status,
+		"expires":    authz.Expires,
+		"challenges": challenges,
+	}
+
+	if authz.Wildcard {
+		object["wildcard"] = true
+	}
+
+	return object
+}
+
+// The caller must hold the mutex.
+func (s *ACMEServer) challengeObject(challenge *acmeChallenge) interface{} {
+	object := map[string]interface{}{
+		"type":   challenge.Type,
+		"url":    s.url("challenge", challenge.ID),
+		"status": challenge.Status,
+		"token":  challenge.Token,
+	}
+
+	if !challenge.Validated.IsZero() {
+		object["validated"] = challenge.Validated
+	}
+
+	if challenge.Error != nil {
+		object["error"] = challenge.Error
+	}
+
+	return object
+}
+
+func (s *ACMEServer) findAuthorization(r *acmeRequest, id string) (*acmeAuthorization, *ACMEProblem) {
+	authz := s.authorizations[id]
+	if authz == nil {
+		return nil, NewACMEProblem(http.StatusNotFound, "malformed",
+			"authorization not found")
+	}
+
+	if authz.AccountID != r.Account.ID {
+		return nil, acmeUnauthorized("authorization belongs to another " +
+			"account")
+	}
+
+	if authz.Status == "pending" && time.Now().After(authz.Expires) {
+		authz.Status = "expired"
+	}
+
+	return authz, nil
+}
+
+func (s *ACMEServer) hAuthorization(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	authz, problem := s.findAuthorization(r, id)
+	if problem != nil {
+		return problem
+	}
+
+	if !r.IsPostAsGet() {
+		var payload struct {
+			Status string `json:"status"`
+		}
+
+		if problem := r.decodePayload(&payload); problem != nil {
+			return problem
+		}
+
+		if payload.Status != "deactivated" {
+			return acmeMalformed("invalid status %q", payload.Status)
+		}
+
+		if authz.Status != "pending" && authz.Status != "valid" {
+			return acmeUnauthorized("authorization is %s", authz.Status)
+		}
+
+		authz.Status = "deactivated"
+	}
+
+	s.writeJSON(w, http.StatusOK, s.authorizationObject(authz))
+	return nil
+}
+
+func (s *ACMEServer) hChallenge(w http.ResponseWriter, r *acmeRequest, id string) *ACMEProblem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	challenge := s.challenges[id]
+	if challenge == nil {
+		return NewACMEProblem(http.StatusNotFound, "malformed",
+			"challenge not found")
+	}
+
+	authz, problem := s.findAuthorization(r, challenge.AuthorizationID)
+	if problem != nil {
+		return problem
+	}
+
+	// An empty object asks the server to validate the challenge, an
+	// empty payload is a simple read.
+	if !r.IsPostAsGet() && challenge.Status == "pending" {
+		if authz.Status != "pending" {
+			return acmeUnauthorized("authorization is %s", authz.Status)
+		}
+
+		challenge.Status = "processing"
+
+		keyAuthorization := challenge.Token + "." + r.Account.thumbprint
+
+		go s.validateChallenge(challenge, authz.Identifier,
+			keyAuthorization)
+	}
+
+	w.Header().Add("Link", `<`+s.url("authz", authz.ID)+`>;rel="up"`)
+	s.writeJSON(w, http.StatusOK, s.challengeObject(challenge))
+	return nil
+}
+
+func (s *ACMEServer) validateChallenge(challenge *acmeChallenge, domain, keyAuthorization string) {
+	var problem *ACMEProblem
+
+	switch challenge.Type {
+	case "http-01":
+		problem = s.validateHTTP01Challenge(domain, challenge.Token,
+			keyAuthorization)
+	case "dns-01":
+		problem = s.validateDNS01Challenge(domain, keyAuthorization)
+	case "tls-alpn-01":
+		problem = s.validateTLSALPN01Challenge(domain, keyAuthorization)
+	default:
+		problem = acmeServerInternal("unsupported challenge type %q",
+			challenge.Type)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	authz := s.authorizations[challenge.AuthorizationID]
+
+	if problem != nil {
+		p.Info("acme: %s challenge failed for %q: %v", challenge.Type,
+			domain, problem)
+
+		challenge.Status = "invalid"
+		challenge.Error = problem
+
+		if authz != nil && authz.Status == "pending" {
+			authz.Status = "invalid"
+		}
+
+		return
+	}
+
+	challenge.Status = "valid"
+	challenge.Validated = time.Now().UTC().Truncate(time.Second)
+
+	if authz != nil && authz.Status == "pending" {
+		authz.Status = "valid"
+	}
+}
+
+// Certificates
+
+func (s *ACMEServer) hCertificate(w http.ResponseWriter, r *acmeRequest, name string) *ACMEProblem {
+	s.mutex.Lock()
+	owned := r.Account.HasCertificate(name)
+	s.mutex.Unlock()
+
+	if !owned {
+		return NewACMEProblem(http.StatusNotFound, "malformed",
+			"certificate not found")
+	}
+
+	var data []byte
+
+	err := s.PKI.WithLock(LockModeShared, func() error {
+		cert, err := s.PKI.LoadCertificate(name)
+		if err != nil {
+			return err
+		}
+
+		chain, err := s.PKI.CertificateChain(name)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range append([]*x509.Certificate{cert}, chain...) {
+			block := pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}
+			data = append(data, pem.EncodeToMemory(&block)...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return acmeServerInternal("cannot load certificate: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+func (s *ACMEServer) hRevokeCert(w http.ResponseWriter, r *acmeRequest) *ACMEProblem {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      *int   `json:"reason"`
+	}
+
+	if problem := r.decodePayload(&payload); problem != nil {
+		return problem
+	}
+
+	certData, err := base64URL.DecodeString(payload.Certificate)
+	if err != nil {
+		return acmeMalformed("invalid certificate encoding: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return acmeMalformed("invalid certificate: %v", err)
+	}
+
+	reason := RevocationReasonUnspecified
+	if payload.Reason != nil {
+		reason, err = RevocationReasonFromCode(*payload.Reason)
+		if err != nil {
+			return NewACMEProblem(http.StatusBadRequest,
+				"badRevocationReason", "%v", err)
+		}
+	}
+
+	var problem *ACMEProblem
+
+	err = s.PKI.WithLock(LockModeExclusive, func() error {
+		problem = s.revokeCertificate(r, cert, reason)
+		return nil
+	})
+	if err != nil {
+		return acmeServerInternal("%v", err)
+	} else if problem != nil {
+		return problem
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// The caller must hold the pki lock.
+func (s *ACMEServer) revokeCertificate(r *acmeRequest, cert *x509.Certificate, reason RevocationReason) *ACMEProblem {
+	issuerName := s.Cfg.IssuerName
+
+	if err := checkIssuer(cert, s.issuerCert); err != nil {
+		return acmeUnauthorized("certificate was not issued by this " +
+			"server")
+	}
+
+	index, err := s.PKI.LoadIndex()
+	if err != nil {
+		return acmeServerInternal("%v", err)
+	}
+
+	entry := index.EntryBySerialNumber(issuerName, cert.SerialNumber)
+	if entry == nil {
+		return acmeUnauthorized("unknown certificate")
+	}
+
+	if problem := s.authorizeRevocation(r, entry.Name, cert); problem != nil {
+		return problem
+	}
+
+	if rc, err := s.PKI.FindRevokedCertificate(issuerName,
+		cert.SerialNumber); err != nil {
+		return acmeServerInternal("%v", err)
+	} else if rc != nil && (rc.Reason != RevocationReasonCertificateHold ||
+		reason == RevocationReasonCertificateHold) {
+		return NewACMEProblem(http.StatusBadRequest, "alreadyRevoked",
+			"certificate is already revoked")
+	}
+
+	if err := s.PKI.CheckRevocation(entry, cert.SerialNumber,
+		reason); err != nil {
+		return acmeUnauthorized("%v", err)
+	}
+
+	rc := CRLRevokedCert{
+		SerialNumber:   *new(big.Int).Set(cert.SerialNumber),
+		RevocationDate: time.Now().UTC(),
+		Reason:         reason,
+	}
+
+	err = s.PKI.WithTransaction(func() error {
+		return s.PKI.AddRevokedCertificates(issuerName, s.issuerCert,
+			s.issuerKey, []CRLRevokedCert{rc})
+	})
+	if err != nil {
+		return acmeServerInternal("cannot revoke certificate: %v", err)
+	}
+
+	p.Info("acme: revoked certificate %q (reason: %v)", entry.Name, reason)
+
+	return nil
+}
+
+// Certificates can be revoked by the account which ordered them, by an
+// account holding valid authorizations for all their names, or with their
+// own key (RFC 8555 7.6).
+func (s *ACMEServer) authorizeRevocation(r *acmeRequest, name string, cert *x509.Certificate) *ACMEProblem {
+	if r.Account == nil {
+		key, ok := cert.PublicKey.(interface {
+			Equal(crypto.PublicKey) bool
+		})
+		if !ok || !key.Equal(r.Key) {
+			return acmeUnauthorized("request not signed by the key of " +
+				"the certificate")
+		}
+
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Account.HasCertificate(name) {
+		return nil
+	}
+
+	now := time.Now()
+
+	names := append([]string(nil), cert.DNSNames...)
+	if len(names) == 0 || len(cert.IPAddresses) > 0 ||
+		len(cert.EmailAddresses) > 0 || len(cert.URIs) > 0 {
+		return acmeUnauthorized("account not authorized to revoke " +
+			"this certificate")
+	}
+
+	for _, name := range names {
+		authorized := false
+
+		for _, authz := range s.authorizations {
+			value := authz.Identifier
+			if authz.Wildcard {
+				value = "*." + value
+			}
+
+			if authz.AccountID == r.Account.ID &&
+				authz.Status == "valid" && now.Before(authz.Expires) &&
+				strings.EqualFold(value, name) {
+				authorized = true
+				break
+			}
+		}
+
+		if !authorized {
+			return acmeUnauthorized("account not authorized for %q",
+				name)
+		}
+	}
+
+	return nil
+}
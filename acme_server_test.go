@@ -0,0 +1,495 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// A minimal dns server answering txt queries from a fixed set of records. It
+// stands in for the authoritative servers of the domains validated with
+// dns-01 challenges.
+type testDNSServer struct {
+	conn net.PacketConn
+
+	mutex   sync.Mutex
+	records map[string][]string
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen for dns queries: %v", err)
+	}
+
+	s := testDNSServer{
+		conn:    conn,
+		records: make(map[string][]string),
+	}
+
+	go s.serve()
+
+	t.Cleanup(func() { conn.Close() })
+
+	return &s
+}
+
+func (s *testDNSServer) Address() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) AddTXTRecord(name, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.records[name] = append(s.records[name], value)
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 4096)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if res := s.answer(buf[:n]); res != nil {
+			s.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+// Build the response to a query containing a single question (RFC 1035
+// 4.1). Additional records such as EDNS0 options are ignored.
+func (s *testDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil
+	}
+
+	var labels []string
+
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return nil
+		}
+
+		n := int(query[offset])
+		offset++
+
+		if n == 0 {
+			break
+		} else if n&0xc0 != 0 || offset+n > len(query) {
+			return nil
+		}
+
+		labels = append(labels, string(query[offset:offset+n]))
+		offset += n
+	}
+
+	if offset+4 > len(query) {
+		return nil
+	}
+
+	qtype := binary.BigEndian.Uint16(query[offset : offset+2])
+	question := query[12 : offset+4]
+
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	s.mutex.Lock()
+	values, found := s.records[name]
+	s.mutex.Unlock()
+
+	if qtype != 16 {
+		values = nil
+	}
+
+	// Set QR and AA, copy RD, and answer NXDOMAIN for unknown names
+	flags := uint16(0x8400) | binary.BigEndian.Uint16(query[2:4])&0x0100
+	if !found {
+		flags |= 3
+	}
+
+	res := make([]byte, 12, 512)
+	copy(res[0:2], query[0:2])
+	binary.BigEndian.PutUint16(res[2:4], flags)
+	binary.BigEndian.PutUint16(res[4:6], 1)
+	binary.BigEndian.PutUint16(res[6:8], uint16(len(values)))
+
+	res = append(res, question...)
+
+	for _, value := range values {
+		// Name pointer to the question, type TXT, class IN, ttl 60s
+		res = append(res, 0xc0, 0x0c, 0, 16, 0, 1, 0, 0, 0, 60)
+		res = binary.BigEndian.AppendUint16(res, uint16(1+len(value)))
+		res = append(res, byte(len(value)))
+		res = append(res, value...)
+	}
+
+	return res
+}
+
+// A http server answering http-01 challenges, listening on the port the acme
+// server connects to.
+type testHTTP01Server struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	responses map[string]string
+}
+
+func newTestHTTP01Server(t *testing.T) *testHTTP01Server {
+	t.Helper()
+
+	s := testHTTP01Server{
+		responses: make(map[string]string),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return &s
+}
+
+func (s *testHTTP01Server) Port(t *testing.T) int {
+	t.Helper()
+
+	uri, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("cannot parse url %q: %v", s.URL, err)
+	}
+
+	port, err := strconv.Atoi(uri.Port())
+	if err != nil {
+		t.Fatalf("invalid port in url %q: %v", s.URL, err)
+	}
+
+	return port
+}
+
+func (s *testHTTP01Server) AddResponse(path, response string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.responses[path] = response
+}
+
+func (s *testHTTP01Server) handle(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	response, found := s.responses[req.URL.Path]
+	s.mutex.Unlock()
+
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Write([]byte(response))
+}
+
+type testACMEServer struct {
+	*httptest.Server
+
+	dnsServer    *testDNSServer
+	http01Server *testHTTP01Server
+
+	subCert *x509.Certificate
+}
+
+func newTestACMEServer(t *testing.T) *testACMEServer {
+	t.Helper()
+
+	newTestPKI(t)
+
+	subCert, subKey := loadTestCertificate(t, "sub-ca")
+
+	dnsServer := newTestDNSServer(t)
+	http01Server := newTestHTTP01Server(t)
+
+	// The server must know its own url before it starts listening
+	httpServer := httptest.NewUnstartedServer(nil)
+
+	cfg := ACMEServerCfg{
+		URL:            "http://" + httpServer.Listener.Addr().String(),
+		IssuerName:     "sub-ca",
+		Profile:        "server",
+		ChallengeTypes: []string{"http-01", "dns-01"},
+		HTTP01Port:     http01Server.Port(t),
+		DNSResolver:    dnsServer.Address(),
+	}
+
+	server, err := NewACMEServer(pki, cfg)
+	if err != nil {
+		t.Fatalf("cannot create acme server: %v", err)
+	}
+
+	server.SetIssuer(subCert, subKey)
+
+	httpServer.Config.Handler = server
+	httpServer.Start()
+	t.Cleanup(httpServer.Close)
+
+	s := testACMEServer{
+		Server: httpServer,
+
+		dnsServer:    dnsServer,
+		http01Server: http01Server,
+
+		subCert: subCert,
+	}
+
+	return &s
+}
+
+func (s *testACMEServer) NewClient(ctx context.Context, t *testing.T) *acme.Client {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate private key: %v", err)
+	}
+
+	client := acme.Client{
+		Key:          key,
+		DirectoryURL: s.URL + "/directory",
+	}
+
+	if _, err := client.Register(ctx, &acme.Account{},
+		acme.AcceptTOS); err != nil {
+		t.Fatalf("cannot register account: %v", err)
+	}
+
+	return &client
+}
+
+// Solve the challenges of all the authorizations of an order, using http-01
+// for localhost and dns-01 for all other identifiers.
+func (s *testACMEServer) Authorize(ctx context.Context, t *testing.T, client *acme.Client, order *acme.Order) {
+	t.Helper()
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			t.Fatalf("cannot fetch authorization: %v", err)
+		}
+
+		challengeType := "dns-01"
+		if authz.Identifier.Value == "localhost" {
+			challengeType = "http-01"
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+
+		if challenge == nil {
+			t.Fatalf("no %s challenge offered for %q", challengeType,
+				authz.Identifier.Value)
+		}
+
+		switch challengeType {
+		case "http-01":
+			response, err := client.HTTP01ChallengeResponse(challenge.Token)
+			if err != nil {
+				t.Fatalf("cannot compute http-01 response: %v", err)
+			}
+
+			path := client.HTTP01ChallengePath(challenge.Token)
+			s.http01Server.AddResponse(path, response)
+
+		case "dns-01":
+			record, err := client.DNS01ChallengeRecord(challenge.Token)
+			if err != nil {
+				t.Fatalf("cannot compute dns-01 record: %v", err)
+			}
+
+			name := "_acme-challenge." + authz.Identifier.Value
+			s.dnsServer.AddTXTRecord(name, record)
+		}
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			t.Fatalf("cannot accept %s challenge: %v", challengeType, err)
+		}
+
+		if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+			t.Fatalf("authorization of %q failed: %v",
+				authz.Identifier.Value, err)
+		}
+	}
+}
+
+func TestACMEIssuanceAndRevocation(t *testing.T) {
+	s := newTestACMEServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := s.NewClient(ctx, t)
+
+	// Issuance
+	domains := []string{"example.test", "localhost", "www.example.test"}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		t.Fatalf("cannot create order: %v", err)
+	}
+
+	s.Authorize(ctx, t, client, order)
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatalf("order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate private key: %v", err)
+	}
+
+	csrTemplate := x509.CertificateRequest{DNSNames: domains}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, key)
+	if err != nil {
+		t.Fatalf("cannot create csr: %v", err)
+	}
+
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("cannot finalize order: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(ders[0])
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+
+	if err := cert.CheckSignatureFrom(s.subCert); err != nil {
+		t.Errorf("certificate not signed by the issuer: %v", err)
+	}
+
+	dnsNames := append([]string(nil), cert.DNSNames...)
+	sort.Strings(dnsNames)
+
+	if !reflect.DeepEqual(dnsNames, domains) {
+		t.Errorf("certificate has dns names %v; expected %v",
+			dnsNames, domains)
+	}
+
+	// Revocation by an account which does not own the certificate
+	otherClient := s.NewClient(ctx, t)
+
+	if err := otherClient.RevokeCert(ctx, nil, ders[0],
+		acme.CRLReasonKeyCompromise); err == nil {
+		t.Errorf("revocation by another account succeeded")
+	}
+
+	if rc, err := pki.FindRevokedCertificate("sub-ca",
+		cert.SerialNumber); err != nil {
+		t.Fatalf("cannot look up revoked certificate: %v", err)
+	} else if rc != nil {
+		t.Fatalf("certificate revoked by another account")
+	}
+
+	// Revocation by the owner
+	if err := client.RevokeCert(ctx, nil, ders[0],
+		acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("cannot revoke certificate: %v", err)
+	}
+
+	crlDER, err := pki.LoadCRL("sub-ca")
+	if err != nil {
+		t.Fatalf("cannot load crl: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatalf("cannot parse crl: %v", err)
+	}
+
+	if err := crl.CheckSignatureFrom(s.subCert); err != nil {
+		t.Errorf("crl not signed by the issuer: %v", err)
+	}
+
+	var revoked bool
+	for _, rc := range crl.RevokedCertificates {
+		if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			revoked = true
+			break
+		}
+	}
+
+	if !revoked {
+		t.Errorf("revoked certificate missing from the crl")
+	}
+
+	rc, err := pki.FindRevokedCertificate("sub-ca", cert.SerialNumber)
+	if err != nil {
+		t.Fatalf("cannot look up revoked certificate: %v", err)
+	} else if rc == nil {
+		t.Fatalf("certificate not found in revoked certificates")
+	}
+
+	if rc.Reason != RevocationReasonKeyCompromise {
+		t.Errorf("certificate revoked with reason %v; expected %v",
+			rc.Reason, RevocationReasonKeyCompromise)
+	}
+}
+
+func TestACMEServerProfiles(t *testing.T) {
+	newTestPKI(t)
+
+	for _, profile := range []string{"server", "client"} {
+		cfg := ACMEServerCfg{IssuerName: "sub-ca", Profile: profile}
+		if _, err := NewACMEServer(pki, cfg); err != nil {
+			t.Errorf("cannot create acme server with profile %q: %v",
+				profile, err)
+		}
+	}
+
+	// Any client passing a challenge would obtain a certificate able to
+	// sign ocsp responses for the ca.
+	for _, profile := range []string{"ocsp-signer", ""} {
+		cfg := ACMEServerCfg{IssuerName: "sub-ca", Profile: profile}
+		if _, err := NewACMEServer(pki, cfg); err == nil {
+			t.Errorf("created acme server with profile %q", profile)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// A backup is a tar archive containing every object of the PKI
+// (configuration, private keys, certificates, CRLs and index), a manifest
+// listing the SHA-256 digest of each object, the signature of the manifest
+// and the certificate used to sign it. The archive is encrypted with
+// AES-256-GCM, using either a key derived from a passphrase with scrypt or
+// a key agreed with the public key of a recipient using ECDH, and stored in
+// a PEM block.
+
+const (
+	BackupPEMBlockType = "PKI BACKUP"
+
+	BackupManifestVersion = 1
+
+	backupManifestPath    = "manifest.json"
+	backupSignaturePath   = "manifest.sig"
+	backupSignerCertPath  = "signer.crt"
+	backupObjectPathRoot  = "objects"
+	backupEncryptionKey   = "Encryption"
+	backupSaltKey         = "Salt"
+	backupNonceKey        = "Nonce"
+	backupEphemeralKeyKey = "Ephemeral-Key"
+
+	backupPassphraseEncryption = "passphrase"
+	backupPublicKeyEncryption  = "public-key"
+)
+
+type BackupManifest struct {
+	Version      int                  `json:"version"`
+	CreationDate time.Time            `json:"creationDate"`
+	Files        []BackupManifestFile `json:"files"`
+}
+
+type BackupManifestFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func (pki *PKI) CreateBackupArchive(signerCert *x509.Certificate, signerKey crypto.PrivateKey) ([]byte, error) {
+	files := make(map[string][]byte)
+
+	manifest := BackupManifest{
+		Version:      BackupManifestVersion,
+		CreationDate: time.Now().UTC(),
+	}
+
+	for _, objType := range ObjectTypes {
+		names, err := pki.Storage.ListObjects(objType)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list %s objects: %w",
+				objType, err)
+		}
+
+		for _, name := range names {
+			data, err := pki.Storage.ReadObject(objType, name)
+			if err != nil {
+				return nil, err
+			}
+
+			filePath := backupObjectPath(objType, name)
+			files[filePath] = data
+
+			digest := sha256.Sum256(data)
+
+			manifest.Files = append(manifest.Files, BackupManifestFile{
+				Path:   filePath,
+				SHA256: hex.EncodeToString(digest[:]),
+			})
+		}
+	}
+
+	manifestData, err := encodeJSON(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode manifest: %w", err)
+	}
+
+	signature, err := signData(signerKey, manifestData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign manifest: %w", err)
+	}
+
+	signerCertBlock := pem.Block{Type: "CERTIFICATE", Bytes: signerCert.Raw}
+
+	files[backupManifestPath] = manifestData
+	files[backupSignaturePath] = signature
+	files[backupSignerCertPath] = pem.EncodeToMemory(&signerCertBlock)
+
+	return writeTarArchive(files, manifest.CreationDate)
+}
+
+// Verify a backup archive and return the list of objects it contains. The
+// signer certificate stored in the archive must either be the trusted
+// certificate or chain to it, possibly through certificates of the backup;
+// the archive itself cannot be used to establish trust.
+func ReadBackupArchive(data []byte, trustedCert *x509.Certificate) ([]StorageWrite, *BackupManifest, error) {
+	if trustedCert == nil {
+		return nil, nil, errors.New("missing trusted certificate")
+	}
+
+	files, err := readTarArchive(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifestData, found := files[backupManifestPath]
+	if !found {
+		return nil, nil, errors.New("missing manifest")
+	}
+
+	signature, found := files[backupSignaturePath]
+	if !found {
+		return nil, nil, errors.New("missing manifest signature")
+	}
+
+	signerCertData, found := files[backupSignerCertPath]
+	if !found {
+		return nil, nil, errors.New("missing signer certificate")
+	}
+
+	signerCert, err := decodePEMCertificate(signerCertData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signer certificate: %w", err)
+	}
+
+	if err := verifySignature(signerCert, manifestData, signature); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest signature: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(manifestData))
+	d.DisallowUnknownFields()
+
+	var manifest BackupManifest
+	if err := d.Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode manifest: %w", err)
+	}
+
+	if manifest.Version != BackupManifestVersion {
+		return nil, nil, fmt.Errorf("unsupported manifest version %d",
+			manifest.Version)
+	}
+
+	delete(files, backupManifestPath)
+	delete(files, backupSignaturePath)
+	delete(files, backupSignerCertPath)
+
+	var writes []StorageWrite
+	var certs []*x509.Certificate
+
+	for _, file := range manifest.Files {
+		data, found := files[file.Path]
+		if !found {
+			return nil, nil, fmt.Errorf("missing file %q", file.Path)
+		}
+		delete(files, file.Path)
+
+		digest := sha256.Sum256(data)
+		if hex.EncodeToString(digest[:]) != file.SHA256 {
+			return nil, nil, fmt.Errorf("invalid digest for file %q",
+				file.Path)
+		}
+
+		objType, name, err := parseBackupObjectPath(file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if objType == ObjectTypeCertificate {
+			cert, err := decodePEMCertificate(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid certificate %q: %w",
+					name, err)
+			}
+
+			certs = append(certs, cert)
+		}
+
+		writes = append(writes, StorageWrite{
+			Type: objType,
+			Name: name,
+			Data: data,
+		})
+	}
+
+	for filePath := range files {
+		return nil, nil, fmt.Errorf("unexpected file %q", filePath)
+	}
+
+	err = verifyBackupSigner(signerCert, trustedCert, certs,
+		manifest.CreationDate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return writes, &manifest, nil
+}
+
+// The signer certificate is verified at the creation date of the backup
+// since backups are usually restored long after they were created.
+func verifyBackupSigner(signerCert, trustedCert *x509.Certificate, certs []*x509.Certificate, date time.Time) error {
+	if bytes.Equal(signerCert.Raw, trustedCert.Raw) {
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(trustedCert)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   date,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	if _, err := signerCert.Verify(opts); err != nil {
+		return fmt.Errorf("backup was not signed by a certificate "+
+			"trusted by %q: %w", trustedCert.Subject.String(), err)
+	}
+
+	return nil
+}
+
+func backupObjectPath(objType ObjectType, name string) string {
+	return backupObjectPathRoot + "/" + string(objType) + "/" + name
+}
+
+func parseBackupObjectPath(filePath string) (ObjectType, string, error) {
+	parts := strings.Split(filePath, "/")
+	if len(parts) != 3 || parts[0] != backupObjectPathRoot {
+		return "", "", fmt.Errorf("invalid file path %q", filePath)
+	}
+
+	objType := ObjectType(parts[1])
+	name := parts[2]
+
+	found := false
+	for _, t := range ObjectTypes {
+		if t == objType {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return "", "", fmt.Errorf("unknown object type %q in file "+
+			"path %q", objType, filePath)
+	}
+
+	if name == "" || name == "." || name == ".." {
+		return "", "", fmt.Errorf("invalid file path %q", filePath)
+	}
+
+	return objType, name, nil
+}
+
+func writeTarArchive(files map[string][]byte, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	paths := make([]string, 0, len(files))
+	for filePath := range files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	w := tar.NewWriter(&buf)
+
+	for _, filePath := range paths {
+		data := files[filePath]
+
+		header := tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filePath,
+			Size:     int64(len(data)),
+			Mode:     0600,
+			ModTime:  modTime,
+		}
+
+		if err := w.WriteHeader(&header); err != nil {
+			return nil, fmt.Errorf("cannot write tar header: %w", err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("cannot write tar data: %w", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot close tar archive: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func readTarArchive(data []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	r := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read tar archive: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("invalid entry %q in tar archive",
+				header.Name)
+		}
+
+		if _, found := files[header.Name]; found {
+			return nil, fmt.Errorf("duplicate entry %q in tar archive",
+				header.Name)
+		}
+
+		fileData, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tar entry %q: %w",
+				header.Name, err)
+		}
+
+		files[header.Name] = fileData
+	}
+
+	return files, nil
+}
+
+func EncryptBackupWithPassphrase(archive, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("cannot generate salt: %w", err)
+	}
+
+	key, err := backupPassphraseKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block := pem.Block{
+		Type: BackupPEMBlockType,
+		Headers: map[string]string{
+			backupEncryptionKey: backupPassphraseEncryption,
+			backupSaltKey:       hex.EncodeToString(salt),
+		},
+	}
+
+	if err := encryptBackupBlock(&block, key, archive); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+func EncryptBackupForRecipient(archive []byte, publicKey crypto.PublicKey) (*pem.Block, error) {
+	recipientKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("recipient public key is not an " +
+			"ecdsa key")
+	}
+
+	curve := recipientKey.Curve
+
+	ephemeralKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate ephemeral key: %w", err)
+	}
+
+	ephemeralKeyData := elliptic.Marshal(curve, ephemeralKey.X,
+		ephemeralKey.Y)
+
+	secret, _ := curve.ScalarMult(recipientKey.X, recipientKey.Y,
+		ephemeralKey.D.Bytes())
+
+	key, err := backupPublicKeyKey(curve, secret.Bytes(), ephemeralKeyData)
+	if err != nil {
+		return nil, err
+	}
+
+	block := pem.Block{
+		Type: BackupPEMBlockType,
+		Headers: map[string]string{
+			backupEncryptionKey:   backupPublicKeyEncryption,
+			backupEphemeralKeyKey: hex.EncodeToString(ephemeralKeyData),
+		},
+	}
+
+	if err := encryptBackupBlock(&block, key, archive); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+func IsPassphraseEncryptedBackup(block *pem.Block) bool {
+	return block.Headers[backupEncryptionKey] == backupPassphraseEncryption
+}
+
+func DecryptBackupWithPassphrase(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if !IsPassphraseEncryptedBackup(block) {
+		return nil, errors.New("backup is not encrypted with a " +
+			"passphrase")
+	}
+
+	salt, err := hex.DecodeString(block.Headers[backupSaltKey])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid salt")
+	}
+
+	key, err := backupPassphraseKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptBackupBlock(block, key)
+}
+
+func DecryptBackupWithPrivateKey(block *pem.Block, privateKey crypto.PrivateKey) ([]byte, error) {
+	if block.Headers[backupEncryptionKey] != backupPublicKeyEncryption {
+		return nil, errors.New("backup is not encrypted with a " +
+			"public key")
+	}
+
+	recipientKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an ecdsa key")
+	}
+
+	curve := recipientKey.Curve
+
+	ephemeralKeyData, err := hex.DecodeString(
+		block.Headers[backupEphemeralKeyKey])
+	if err != nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+
+	x, y := elliptic.Unmarshal(curve, ephemeralKeyData)
+	if x == nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+
+	secret, _ := curve.ScalarMult(x, y, recipientKey.D.Bytes())
+
+	key, err := backupPublicKeyKey(curve, secret.Bytes(), ephemeralKeyData)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptBackupBlock(block, key)
+}
+
+func backupPassphraseKey(passphrase, salt []byte) ([]byte, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive key: %w", err)
+	}
+
+	return key, nil
+}
+
+func backupPublicKeyKey(curve elliptic.Curve, secret, ephemeralKeyData []byte) ([]byte, error) {
+	// The shared secret is the x coordinate of the shared point, padded to
+	// the size of the curve.
+	size := (curve.Params().BitSize + 7) / 8
+	paddedSecret := make([]byte, size)
+	copy(paddedSecret[size-len(secret):], secret)
+
+	r := hkdf.New(sha256.New, paddedSecret, ephemeralKeyData,
+		[]byte("pki backup"))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, fmt.Errorf("cannot derive key: %w", err)
+	}
+
+	return key, nil
+}
+
+func encryptBackupBlock(block *pem.Block, key, data []byte) error {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cannot generate nonce: %w", err)
+	}
+
+	block.Headers[backupNonceKey] = hex.EncodeToString(nonce)
+	block.Bytes = aead.Seal(nil, nonce, data, nil)
+
+	return nil
+}
+
+func decryptBackupBlock(block *pem.Block, key []byte) ([]byte, error) {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(block.Headers[backupNonceKey])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	data, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt backup: invalid key " +
+			"or corrupted data")
+	}
+
+	return data, nil
+}
+
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(blockCipher)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create gcm cipher: %w", err)
+	}
+
+	return aead, nil
+}
+
+func signData(key crypto.PrivateKey, data []byte) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(data)
+
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verifySignature(cert *x509.Certificate, data, signature []byte) error {
+	var algorithm x509.SignatureAlgorithm
+
+	switch cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algorithm = x509.SHA256WithRSA
+	case ed25519.PublicKey:
+		algorithm = x509.PureEd25519
+	default:
+		return fmt.Errorf("unsupported public key %T", cert.PublicKey)
+	}
+
+	return cert.CheckSignature(algorithm, data, signature)
+}
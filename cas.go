@@ -0,0 +1,293 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A pki can contain several independent root cas. Each ca, root or
+// intermediate, can have its own section in the configuration; settings
+// which are not set in this section are read from the global configuration.
+
+type CACfg struct {
+	Certificates *CertificateData `json:"certificates,omitempty"`
+
+	// Signature algorithm names are the ones used by the Go x509
+	// package, e.g. "ECDSA-SHA384".
+	CRLSignatureAlgorithm string `json:"crlSignatureAlgorithm,omitempty"`
+
+	// The number of days during which a CRL remains valid after having
+	// been signed (default: DefaultCRLLifetime).
+	CRLLifetime int `json:"crlLifetime,omitempty"`
+
+	// Delta CRLs are only generated if this section is set.
+	DeltaCRLs *DeltaCRLCfg `json:"deltaCRLs,omitempty"`
+
+	// Entries of expired certificates are only removed from CRLs if this
+	// section is set.
+	CRLPruning *CRLPruningCfg `json:"crlPruning,omitempty"`
+
+	OCSP *OCSPCfg `json:"ocsp,omitempty"`
+}
+
+type OCSPCfg struct {
+	// The name of a certificate issued by the ca with the OCSPSigning
+	// extended key usage. If not set, responses are signed with the key
+	// of the ca.
+	SigningCertificate string `json:"signingCertificate,omitempty"`
+
+	// The number of hours during which a response remains valid
+	// (default: DefaultOCSPResponseValidity).
+	Validity int `json:"validity,omitempty"`
+
+	// The number of days during which delegated responder certificates
+	// created by rotate-ocsp-signer remain valid (default:
+	// DefaultOCSPSigningCertificateValidity).
+	SigningCertificateValidity int `json:"signingCertificateValidity,omitempty"`
+}
+
+func (cfg *OCSPCfg) Validate() error {
+	if cfg.Validity < 0 {
+		return errors.New("validity must be positive")
+	}
+
+	if cfg.SigningCertificateValidity < 0 {
+		return errors.New("signing certificate validity must be " +
+			"positive")
+	}
+
+	return nil
+}
+
+type CRLPruningCfg struct {
+	// The number of days after which the entry of an expired certificate
+	// is removed from the CRL.
+	GracePeriod int `json:"gracePeriod"`
+}
+
+func (cfg *CRLPruningCfg) Validate() error {
+	if cfg.GracePeriod < 0 {
+		return errors.New("gracePeriod: grace period must be positive")
+	}
+
+	return nil
+}
+
+// Delta CRLs are updated on their own schedule, usually much more often
+// than complete CRLs.
+type DeltaCRLCfg struct {
+	// The number of hours during which a delta CRL remains valid after
+	// having been signed (default: DefaultDeltaCRLLifetime).
+	Lifetime int `json:"lifetime,omitempty"`
+
+	// The locations where delta CRLs are published, referenced in complete
+	// CRLs with the freshest CRL extension.
+	URIs []string `json:"uris"`
+}
+
+func (cfg *DeltaCRLCfg) Validate() error {
+	if cfg.Lifetime < 0 {
+		return errors.New("lifetime must be positive")
+	}
+
+	if len(cfg.URIs) == 0 {
+		return errors.New("missing uris")
+	}
+
+	for _, s := range cfg.URIs {
+		if uri, err := url.Parse(s); err != nil {
+			return fmt.Errorf("invalid uri %q: %w", s, err)
+		} else if !uri.IsAbs() {
+			return fmt.Errorf("invalid uri %q: uri is not absolute", s)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *CACfg) Validate() error {
+	if cfg.Certificates != nil && cfg.Certificates.Validity < 0 {
+		return errors.New("certificates: validity must be positive")
+	}
+
+	if cfg.CRLLifetime < 0 {
+		return errors.New("crlLifetime: lifetime must be positive")
+	}
+
+	if cfg.DeltaCRLs != nil {
+		if err := cfg.DeltaCRLs.Validate(); err != nil {
+			return fmt.Errorf("deltaCRLs: %w", err)
+		}
+	}
+
+	if cfg.CRLPruning != nil {
+		if err := cfg.CRLPruning.Validate(); err != nil {
+			return fmt.Errorf("crlPruning: %w", err)
+		}
+	}
+
+	if cfg.OCSP != nil {
+		if err := cfg.OCSP.Validate(); err != nil {
+			return fmt.Errorf("ocsp: %w", err)
+		}
+	}
+
+	if cfg.CRLSignatureAlgorithm != "" {
+		_, err := parseSignatureAlgorithm(cfg.CRLSignatureAlgorithm)
+		if err != nil {
+			return fmt.Errorf("crlSignatureAlgorithm: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (pki *PKI) CACfg(name string) *CACfg {
+	if caCfg, found := pki.Cfg.CAs[name]; found && caCfg != nil {
+		return caCfg
+	}
+
+	return &CACfg{}
+}
+
+// Return the default certificate data used for certificates issued by a ca.
+func (pki *PKI) CertificateDefaults(issuerName string) *CertificateData {
+	caCfg := pki.CACfg(issuerName)
+
+	if caCfg.Certificates == nil {
+		return &pki.Cfg.Certificates
+	}
+
+	data := *caCfg.Certificates
+	data.UpdateFromDefaults(&pki.Cfg.Certificates)
+
+	return &data
+}
+
+func (pki *PKI) RootCANames() ([]string, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range index.Entries {
+		if entry.IsCA && entry.IssuerName == entry.Name {
+			names = append(names, entry.Name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Return the names of all cas, root or intermediate.
+func (pki *PKI) CANames() ([]string, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range index.Entries {
+		if entry.IsCA {
+			names = append(names, entry.Name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Return the name of the root ca to use when none was provided, i.e. the
+// only root ca of the pki.
+func (pki *PKI) DefaultRootCAName() (string, error) {
+	names, err := pki.RootCANames()
+	if err != nil {
+		return "", err
+	}
+
+	switch len(names) {
+	case 0:
+		return "", errors.New("no root ca found")
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("multiple root cas found (%s), the issuer "+
+			"must be set explicitly", strings.Join(names, ", "))
+	}
+}
+
+func (pki *PKI) CreateRootCA(name string, certData *CertificateData, privateKeyPassword []byte) error {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	if index.EntryByName(name) != nil {
+		return fmt.Errorf("certificate %q already exists", name)
+	}
+
+	return pki.WithTransaction(func() error {
+		if err := pki.createRootCA(name, certData,
+			privateKeyPassword); err != nil {
+			return err
+		}
+
+		return pki.WriteConfiguration()
+	})
+}
+
+func (pki *PKI) createRootCA(name string, certData *CertificateData, privateKeyPassword []byte) error {
+	p.Info("creating root ca %q", name)
+
+	// Private key
+	key, err := pki.CreatePrivateKey(name, privateKeyPassword)
+	if err != nil {
+		return fmt.Errorf("cannot create root ca private key: %w", err)
+	}
+
+	// Certificate
+	cert, err := pki.CreateCertificate(name, certData, "", nil, key,
+		PublicKey(key))
+	if err != nil {
+		return fmt.Errorf("cannot create root ca certificate: %w", err)
+	}
+
+	// CRL
+	if _, err := pki.CreateCRL(name, cert, key, &CRLData{}); err != nil {
+		return fmt.Errorf("cannot create root ca crl: %w", err)
+	}
+
+	// Configuration section
+	if pki.Cfg.CAs == nil {
+		pki.Cfg.CAs = make(map[string]*CACfg)
+	}
+
+	if _, found := pki.Cfg.CAs[name]; !found {
+		pki.Cfg.CAs[name] = &CACfg{}
+	}
+
+	return nil
+}
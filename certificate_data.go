@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -70,12 +71,77 @@ func (s *Subject) PKIXName() pkix.Name {
 	return name
 }
 
+// Profiles describe the purpose of a certificate. They matter most when
+// certificates are issued from certificate requests: the pki selects the
+// profile, not the requester.
+var CertificateProfiles = []string{"server", "client", "ocsp-signer"}
+
+func (data *CertificateData) ApplyProfile(profile string) error {
+	switch profile {
+	case "server":
+
+	case "client":
+		data.IsClientCertificate = true
+
+	case "ocsp-signer":
+		data.IsOCSPSigner = true
+
+	default:
+		return fmt.Errorf("unknown certificate profile %q (valid "+
+			"profiles: %s)", profile,
+			strings.Join(CertificateProfiles, ", "))
+	}
+
+	return nil
+}
+
+// Profiles which can be used by enrollment servers (acme, est, scep). Any
+// client able to pass a challenge or to authenticate obtains certificates
+// with these profiles, so OCSP signing certificates, which can vouch for
+// the status of every certificate of their ca, are excluded.
+var EnrollmentProfiles = []string{"server", "client"}
+
+func CheckEnrollmentProfile(profile string) error {
+	for _, name := range EnrollmentProfiles {
+		if name == profile {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid enrollment profile %q (valid profiles: "+
+		"%s)", profile, strings.Join(EnrollmentProfiles, ", "))
+}
+
+// Return the subject corresponding to a name, keeping the first value of
+// each attribute.
+func subjectFromPKIXName(name pkix.Name) Subject {
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+
+		return values[0]
+	}
+
+	return Subject{
+		Country:            first(name.Country),
+		Organization:       first(name.Organization),
+		OrganizationalUnit: first(name.OrganizationalUnit),
+		Locality:           first(name.Locality),
+		Province:           first(name.Province),
+		StreetAddress:      first(name.StreetAddress),
+		PostalCode:         first(name.PostalCode),
+		CommonName:         name.CommonName,
+	}
+}
+
 type CertificateData struct {
 	Validity            int     `json:"validity"` // days
 	Subject             Subject `json:"subject"`
 	SAN                 SAN     `json:"san"`
 	IsCA                bool    `json:"isCA,omitempty"`
 	IsClientCertificate bool    `json:"isClientCertificate,omitempty"`
+	IsOCSPSigner        bool    `json:"isOCSPSigner,omitempty"`
 }
 
 func (data *CertificateData) UpdateFromDefaults(defaultData *CertificateData) {
@@ -151,8 +217,10 @@ func (data *CertificateData) CertificateTemplate() (*x509.Certificate, error) {
 	notAfter := now.Add(time.Duration(data.Validity) * 24 * time.Hour)
 
 	var keyUsage x509.KeyUsage
-	keyUsage |= x509.KeyUsageKeyEncipherment
 	keyUsage |= x509.KeyUsageDigitalSignature
+	if !data.IsOCSPSigner {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
 	if data.IsCA {
 		keyUsage |= x509.KeyUsageCertSign
 		keyUsage |= x509.KeyUsageCRLSign
@@ -177,5 +245,20 @@ func (data *CertificateData) CertificateTemplate() (*x509.Certificate, error) {
 		EmailAddresses: data.SAN.EmailAddresses,
 	}
 
+	if data.IsOCSPSigner {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{
+			x509.ExtKeyUsageOCSPSigning,
+		}
+
+		noCheckData, err := (&ExtOCSPNoCheck{}).Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode ocsp no check "+
+				"extension: %w", err)
+		}
+
+		template.ExtraExtensions = append(template.ExtraExtensions,
+			pkix.Extension{Id: oidExtOCSPNoCheck, Value: noCheckData})
+	}
+
 	return &template, nil
 }
@@ -26,22 +26,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/big"
-	"path"
 	"time"
 )
 
 func (pki *PKI) LoadCertificate(name string) (*x509.Certificate, error) {
 	p.Info("loading certificate %q", name)
 
-	certPath := pki.CertificatePath(name)
-
-	data, err := ioutil.ReadFile(certPath)
+	data, err := pki.Storage.ReadObject(ObjectTypeCertificate, name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read %q: %w", certPath, err)
+		return nil, err
 	}
 
+	return decodePEMCertificate(data)
+}
+
+func decodePEMCertificate(data []byte) (*x509.Certificate, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("no pem block found")
@@ -55,9 +55,36 @@ func (pki *PKI) LoadCertificate(name string) (*x509.Certificate, error) {
 	return cert, nil
 }
 
-func (pki *PKI) CreateCertificate(name string, data *CertificateData, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey, publicKey crypto.PublicKey) (*x509.Certificate, error) {
+// If issuerCert is nil, the certificate is self-signed and issuerName is
+// ignored.
+func (pki *PKI) CreateCertificate(name string, data *CertificateData, issuerName string, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey, publicKey crypto.PublicKey) (*x509.Certificate, error) {
 	p.Info("creating certificate %q", name)
 
+	return pki.issueCertificate(name, data, issuerName, issuerCert,
+		issuerKey, publicKey, false)
+}
+
+// Issue a certificate for the public key of a certificate request, e.g. one
+// received by an enrollment server. The private key stays with the
+// requester. Only the public key is read from the request: the content of
+// the certificate is entirely controlled by the caller.
+func (pki *PKI) SignCertificateRequest(name string, csr *x509.CertificateRequest, data *CertificateData, issuerName string, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey) (*x509.Certificate, error) {
+	p.Info("signing certificate request for %q", name)
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request "+
+			"signature: %w", err)
+	}
+
+	return pki.issueCertificate(name, data, issuerName, issuerCert,
+		issuerKey, csr.PublicKey, true)
+}
+
+func (pki *PKI) issueCertificate(name string, data *CertificateData, issuerName string, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey, publicKey crypto.PublicKey, externalKey bool) (*x509.Certificate, error) {
+	if issuerCert == nil {
+		issuerName = name
+	}
+
 	cert, err := pki.GenerateCertificate(data, issuerCert, issuerKey,
 		publicKey)
 	if err != nil {
@@ -68,9 +95,66 @@ func (pki *PKI) CreateCertificate(name string, data *CertificateData, issuerCert
 		return nil, fmt.Errorf("cannot write certificate: %w", err)
 	}
 
+	entry := NewIndexEntry(name, issuerName, cert)
+	entry.ExternalPrivateKey = externalKey
+
+	if err := pki.AddIndexEntry(entry); err != nil {
+		return nil, fmt.Errorf("cannot update index: %w", err)
+	}
+
 	return cert, nil
 }
 
+// Return the certificates of the issuers of a certificate, starting with its
+// direct issuer and ending before the root ca, i.e. the intermediate
+// certificates a server sends along with its own certificate.
+func (pki *PKI) CertificateChain(name string) ([]*x509.Certificate, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+
+	for {
+		entry := index.EntryByName(name)
+		if entry == nil {
+			return nil, fmt.Errorf("certificate %q not found in index",
+				name)
+		}
+
+		if entry.IssuerName == "" {
+			return nil, fmt.Errorf("unknown issuer for certificate %q",
+				name)
+		}
+
+		issuerEntry := index.EntryByName(entry.IssuerName)
+		if issuerEntry == nil {
+			return nil, fmt.Errorf("certificate %q not found in index",
+				entry.IssuerName)
+		}
+
+		if issuerEntry.IssuerName == issuerEntry.Name {
+			break
+		}
+
+		issuerCert, err := pki.LoadCertificate(issuerEntry.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, issuerCert)
+		name = issuerEntry.Name
+
+		if len(chain) > len(index.Entries) {
+			return nil, fmt.Errorf("issuer loop for certificate %q",
+				name)
+		}
+	}
+
+	return chain, nil
+}
+
 func (pki *PKI) GenerateCertificate(data *CertificateData, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey, publicKey crypto.PublicKey) (*x509.Certificate, error) {
 	template, err := data.CertificateTemplate()
 	if err != nil {
@@ -99,17 +183,7 @@ func (pki *PKI) WriteCertificate(cert *x509.Certificate, name string) error {
 	block := pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
 	pemData := pem.EncodeToMemory(&block)
 
-	certPath := pki.CertificatePath(name)
-
-	return createFile(certPath, pemData, 0644)
-}
-
-func (pki *PKI) CertificatesPath() string {
-	return path.Join(pki.Path, "certificates")
-}
-
-func (pki *PKI) CertificatePath(name string) string {
-	return path.Join(pki.CertificatesPath(), name+".crt")
+	return pki.createObject(ObjectTypeCertificate, name, pemData)
 }
 
 func PrintCertificate(cert *x509.Certificate, w io.Writer) error {
@@ -187,6 +261,9 @@ func printCertificateExtensions(p *Printer, cert *x509.Certificate) {
 		case "2.5.29.37":
 			printCertificateExtensionExtendedKeyUsage(p, ext)
 
+		case "1.3.6.1.5.5.7.48.1.5":
+			printCertificateExtensionOCSPNoCheck(p, ext)
+
 		default:
 			printCertificateExtension(p, ext, idString, func() {
 				p.Line("Non-decoded data: %s", p.Hex(ext.Value))
@@ -287,6 +364,18 @@ func printCertificateExtensionExtendedKeyUsage(p *Printer, ext pkix.Extension) {
 	})
 }
 
+func printCertificateExtensionOCSPNoCheck(p *Printer, ext pkix.Extension) {
+	var noCheck ExtOCSPNoCheck
+	if err := noCheck.Decode(ext.Value); err != nil {
+		panic(fmt.Sprintf("cannot decode ocsp no check extension: %v",
+			err))
+	}
+
+	printCertificateExtension(p, ext, "OCSP no check", func() {
+		p.Line("revocation status not checked by clients")
+	})
+}
+
 func printCertificateSignature(p *Printer, cert *x509.Certificate) {
 	p.Line("Algorithm: %v", cert.SignatureAlgorithm)
 	p.Line("Data: %v", p.Hex(cert.Signature))
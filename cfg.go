@@ -0,0 +1,466 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The configuration is versioned: configurations written by older versions
+// of the program are migrated to the current schema when they are loaded.
+// Configurations without a version field predate versioning and are
+// considered to be at version 0.
+
+const CurrentCfgVersion = 3
+
+// Each function migrates a configuration from version i to version i+1.
+var cfgMigrations = []func(map[string]interface{}) error{
+	// Version 1 introduces the version field.
+	func(doc map[string]interface{}) error {
+		return nil
+	},
+
+	// Version 2 introduces per-ca sections, which are optional.
+	func(doc map[string]interface{}) error {
+		return nil
+	},
+
+	// Version 3 introduces the scep section, which is optional.
+	func(doc map[string]interface{}) error {
+		return nil
+	},
+}
+
+type PKICfg struct {
+	Version      int               `json:"version"`
+	Certificates CertificateData   `json:"certificates"`
+	CAs          map[string]*CACfg `json:"cas,omitempty"`
+	SCEP         *SCEPCfg          `json:"scep,omitempty"`
+}
+
+func DefaultPKICfg() *PKICfg {
+	cfg := PKICfg{
+		Version: CurrentCfgVersion,
+
+		Certificates: CertificateData{
+			Validity: 365,
+			Subject:  Subject{CommonName: "localhost"},
+		},
+	}
+
+	return &cfg
+}
+
+func (cfg *PKICfg) Validate() error {
+	if cfg.Certificates.Validity < 1 {
+		return errors.New("certificates: validity must be strictly " +
+			"positive")
+	}
+
+	if cfg.Certificates.Subject.CommonName == "" {
+		return errors.New("certificates: missing subject common name")
+	}
+
+	for name, caCfg := range cfg.CAs {
+		if caCfg == nil {
+			return fmt.Errorf("cas: %s: invalid null section", name)
+		}
+
+		if err := caCfg.Validate(); err != nil {
+			return fmt.Errorf("cas: %s: %w", name, err)
+		}
+	}
+
+	if cfg.SCEP != nil {
+		if err := cfg.SCEP.Validate(); err != nil {
+			return fmt.Errorf("scep: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type CfgError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func NewCfgError(data []byte, offset int64, format string, args ...interface{}) *CfgError {
+	line, column := 1, 1
+
+	for i := int64(0); i < offset && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	err := CfgError{
+		Line:    line,
+		Column:  column,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	return &err
+}
+
+func (err *CfgError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s",
+		err.Line, err.Column, err.Message)
+}
+
+// Decode a configuration, migrating it if necessary. The version returned
+// is the version of the configuration before migration.
+func DecodePKICfg(data []byte) (*PKICfg, int, error) {
+	var doc map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	if err := d.Decode(&doc); err != nil {
+		return nil, 0, convertJSONError(data, err)
+	}
+
+	version := 0
+	if value, found := doc["version"]; found {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, 0, errors.New("invalid version: value " +
+				"is not a number")
+		}
+
+		i64, err := number.Int64()
+		if err != nil || i64 < 0 {
+			return nil, 0, fmt.Errorf("invalid version %v", number)
+		}
+
+		version = int(i64)
+	}
+
+	if version > CurrentCfgVersion {
+		return nil, version, fmt.Errorf("unsupported configuration "+
+			"version %d (current version: %d)",
+			version, CurrentCfgVersion)
+	}
+
+	if version < CurrentCfgVersion {
+		for v := version; v < CurrentCfgVersion; v++ {
+			if err := cfgMigrations[v](doc); err != nil {
+				return nil, version, fmt.Errorf("cannot migrate "+
+					"configuration to version %d: %w", v+1, err)
+			}
+
+			doc["version"] = v + 1
+		}
+
+		migratedData, err := encodeJSON(doc)
+		if err != nil {
+			return nil, version, fmt.Errorf("cannot encode migrated "+
+				"configuration: %w", err)
+		}
+
+		cfg, err := decodeCfgStrict(migratedData)
+		if err != nil {
+			return nil, version, fmt.Errorf("invalid configuration "+
+				"after migration to version %d: %w",
+				CurrentCfgVersion, err)
+		}
+
+		return cfg, version, nil
+	}
+
+	cfg, err := decodeCfgStrict(data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	return cfg, version, nil
+}
+
+func decodeCfgStrict(data []byte) (*PKICfg, error) {
+	if err := checkJSONFields(data, reflect.TypeOf(PKICfg{})); err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	var cfg PKICfg
+	if err := d.Decode(&cfg); err != nil {
+		return nil, convertJSONError(data, err)
+	}
+
+	if _, err := d.Token(); err != io.EOF {
+		return nil, NewCfgError(data, d.InputOffset(),
+			"unexpected data after configuration object")
+	}
+
+	return &cfg, nil
+}
+
+func (pki *PKI) LoadConfiguration() error {
+	p.Info("loading configuration")
+
+	data, err := pki.Storage.ReadObject(ObjectTypeConfiguration,
+		CfgObjectName)
+	if err != nil {
+		return fmt.Errorf("cannot read configuration: %w", err)
+	}
+
+	cfg, version, err := DecodePKICfg(data)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	pki.Cfg = cfg
+
+	if version < CurrentCfgVersion {
+		if pki.lockMode != LockModeExclusive {
+			p.Info("configuration will be migrated from version %d "+
+				"to version %d by the next command modifying the "+
+				"pki", version, CurrentCfgVersion)
+			return nil
+		}
+
+		if err := pki.migrateConfiguration(data, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pki *PKI) WriteConfiguration() error {
+	data, err := encodeJSON(pki.Cfg)
+	if err != nil {
+		return fmt.Errorf("cannot encode configuration: %w", err)
+	}
+
+	err = pki.createOrReplaceObject(ObjectTypeConfiguration, CfgObjectName,
+		data)
+	if err != nil {
+		return fmt.Errorf("cannot write configuration: %w", err)
+	}
+
+	return nil
+}
+
+func (pki *PKI) migrateConfiguration(originalData []byte, version int) error {
+	p.Info("migrating configuration from version %d to version %d",
+		version, CurrentCfgVersion)
+
+	cfgData, err := encodeJSON(pki.Cfg)
+	if err != nil {
+		return fmt.Errorf("cannot encode configuration: %w", err)
+	}
+
+	backupName := fmt.Sprintf("cfg-v%d-%s", version,
+		time.Now().UTC().Format("20060102T150405Z"))
+
+	return pki.WithTransaction(func() error {
+		p.Info("saving original configuration as %q", backupName)
+
+		err := pki.createObject(ObjectTypeCfgBackup, backupName,
+			originalData)
+		if err != nil {
+			return fmt.Errorf("cannot write configuration backup: %w",
+				err)
+		}
+
+		err = pki.createOrReplaceObject(ObjectTypeConfiguration,
+			CfgObjectName, cfgData)
+		if err != nil {
+			return fmt.Errorf("cannot write configuration: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Check that every field of a JSON document exists in the type it is going
+// to be decoded into. The json package can reject unknown fields but does
+// not report where they are.
+func checkJSONFields(data []byte, t reflect.Type) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	if err := checkJSONValue(d, data, t); err != nil {
+		return convertJSONError(data, err)
+	}
+
+	return nil
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func checkJSONValue(d *json.Decoder, data []byte, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Values decoded by custom functions or stored in interfaces are not
+	// checked.
+	if t != nil {
+		ptrType := reflect.PtrTo(t)
+		if ptrType.Implements(jsonUnmarshalerType) ||
+			ptrType.Implements(textUnmarshalerType) ||
+			t.Kind() == reflect.Interface {
+			t = nil
+		}
+	}
+
+	token, err := d.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		for d.More() {
+			offset := skipJSONSeparators(data, d.InputOffset())
+
+			token, err := d.Token()
+			if err != nil {
+				return err
+			}
+
+			key := token.(string)
+
+			var valueType reflect.Type
+
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Struct:
+					fieldType, found := jsonStructField(t, key)
+					if !found {
+						return NewCfgError(data, offset,
+							"unknown field %q", key)
+					}
+
+					valueType = fieldType
+
+				case reflect.Map:
+					valueType = t.Elem()
+				}
+			}
+
+			if err := checkJSONValue(d, data, valueType); err != nil {
+				return err
+			}
+		}
+
+	case '[':
+		var elemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice ||
+			t.Kind() == reflect.Array) {
+			elemType = t.Elem()
+		}
+
+		for d.More() {
+			if err := checkJSONValue(d, data, elemType); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Closing delimiter
+	_, err = d.Token()
+	return err
+}
+
+func jsonStructField(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+
+		if tag := field.Tag.Get("json"); tag != "" {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			} else if tagName != "" {
+				name = tagName
+			}
+		}
+
+		if name == key {
+			return field.Type, true
+		}
+	}
+
+	return nil, false
+}
+
+func skipJSONSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+
+	return offset
+}
+
+func convertJSONError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return NewCfgError(data, syntaxErr.Offset, "%v", err)
+
+	case errors.As(err, &typeErr):
+		return NewCfgError(data, typeErr.Offset, "invalid value for "+
+			"field %q: cannot decode %s into %v",
+			typeErr.Field, typeErr.Value, typeErr.Type)
+
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return NewCfgError(data, int64(len(data)),
+			"unexpected end of data")
+
+	default:
+		return err
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addSubjectOptions(c *program.Command) {
+	c.AddOption("", "country", "name", "", "the subject country")
+	c.AddOption("", "organization", "name", "", "the subject organization")
+	c.AddOption("", "organizational-unit", "name", "",
+		"the subject organizational unit")
+	c.AddOption("", "locality", "name", "", "the subject locality")
+	c.AddOption("", "province", "name", "", "the subject province")
+	c.AddOption("", "street-address", "address", "",
+		"the subject street-address")
+	c.AddOption("", "postal-code", "code", "", "the subject postal code")
+	c.AddOption("", "common-name", "name", "", "the subject common name")
+}
+
+func subjectOptionValues(p *program.Program) Subject {
+	return Subject{
+		Country:            p.OptionValue("country"),
+		Organization:       p.OptionValue("organization"),
+		OrganizationalUnit: p.OptionValue("organizational-unit"),
+		Locality:           p.OptionValue("locality"),
+		Province:           p.OptionValue("province"),
+		StreetAddress:      p.OptionValue("street-address"),
+		PostalCode:         p.OptionValue("postal-code"),
+		CommonName:         p.OptionValue("common-name"),
+	}
+}
+
+func validityOptionValue(p *program.Program) int {
+	validityString := p.OptionValue("validity")
+
+	i64, err := strconv.ParseInt(validityString, 10, 64)
+	if err != nil || i64 < 1 || i64 > math.MaxInt32 {
+		p.Fatal("invalid validity")
+	}
+
+	return int(i64)
+}
+
+// Return the name of the issuer certificate selected with the
+// --issuer-certificate option, or the only root ca of the pki if the
+// option is not set.
+func issuerOptionValue(p *program.Program) string {
+	if ref := p.OptionValue("issuer-certificate"); ref != "" {
+		name, err := pki.ResolveCertificateName(ref)
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		return name
+	}
+
+	name, err := pki.DefaultRootCAName()
+	if err != nil {
+		p.Fatal("cannot select issuer certificate: %v", err)
+	}
+
+	return name
+}
+
+func secondsOptionValue(p *program.Program, name string, min int64) time.Duration {
+	s := p.OptionValue(name)
+
+	i64, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || i64 < min || i64 > math.MaxInt32 {
+		p.Fatal("invalid %s", strings.ReplaceAll(name, "-", " "))
+	}
+
+	return time.Duration(i64) * time.Second
+}
+
+// Call a function at regular intervals while holding a shared lock on the
+// pki. Used by servers which only lock the pki when they reload data.
+func refreshPeriodically(p *program.Program, fn func() error, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pki.WithLock(LockModeShared, fn); err != nil {
+			p.Error("cannot reload data: %v", err)
+		}
+	}
+}
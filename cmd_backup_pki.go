@@ -0,0 +1,162 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdBackupPKI(p *program.Program) {
+	c := p.AddCommand("backup-pki",
+		"create an encrypted and signed backup of the pki", cmdBackupPKI)
+
+	c.AddArgument("path", "the path of the backup file")
+
+	c.AddOption("s", "signing-certificate", "name", "",
+		"the name of the certificate used to sign the backup "+
+			"(default: the root ca if there is only one)")
+	c.AddFlag("", "passphrase", "encrypt the backup with a passphrase")
+	c.AddOption("", "recipient", "path", "",
+		"the path of a pem certificate or public key to encrypt "+
+			"the backup for")
+}
+
+func cmdBackupPKI(p *program.Program) {
+	backupPath := p.ArgumentValue("path")
+	signerName := p.OptionValue("signing-certificate")
+	if signerName != "" {
+		name, err := pki.ResolveCertificateName(signerName)
+		if err != nil {
+			p.Fatal("cannot find signing certificate: %v", err)
+		}
+
+		signerName = name
+	} else {
+		name, err := pki.DefaultRootCAName()
+		if err != nil {
+			p.Fatal("cannot select signing certificate: %v", err)
+		}
+
+		signerName = name
+	}
+
+	usePassphrase := p.IsOptionSet("passphrase")
+	recipientPath := p.OptionValue("recipient")
+
+	if usePassphrase == (recipientPath != "") {
+		p.Fatal("exactly one of --passphrase and --recipient must " +
+			"be set")
+	}
+
+	var recipientKey crypto.PublicKey
+	if recipientPath != "" {
+		key, err := loadPEMPublicKey(recipientPath)
+		if err != nil {
+			p.Fatal("cannot load recipient public key: %v", err)
+		}
+
+		recipientKey = key
+	}
+
+	var passphrase []byte
+	if usePassphrase {
+		data, err := ReadPasswordWithConfirmation(
+			"backup passphrase: ", "confirmation: ")
+		if err != nil {
+			p.Fatal("cannot read passphrase: %v", err)
+		}
+
+		if len(data) == 0 {
+			p.Fatal("empty passphrase")
+		}
+
+		passphrase = data
+	}
+
+	signerCert, err := pki.LoadCertificate(signerName)
+	if err != nil {
+		p.Fatal("cannot load signing certificate: %v", err)
+	}
+
+	signerKey, err := pki.LoadPrivateKey(signerName,
+		func() ([]byte, error) {
+			return ReadPrivateKeyPassword(signerName)
+		})
+	if err != nil {
+		p.Fatal("cannot load signing private key: %v", err)
+	}
+
+	archive, err := pki.CreateBackupArchive(signerCert, signerKey)
+	if err != nil {
+		p.Fatal("cannot create backup archive: %v", err)
+	}
+
+	var block *pem.Block
+	if usePassphrase {
+		block, err = EncryptBackupWithPassphrase(archive, passphrase)
+	} else {
+		block, err = EncryptBackupForRecipient(archive, recipientKey)
+	}
+	if err != nil {
+		p.Fatal("cannot encrypt backup: %v", err)
+	}
+
+	p.Info("writing backup to %q", backupPath)
+
+	if err := createFile(backupPath, pem.EncodeToMemory(block), 0600); err != nil {
+		p.Fatal("cannot write backup: %v", err)
+	}
+}
+
+func loadPEMPublicKey(filePath string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate: %w", err)
+		}
+
+		return cert.PublicKey, nil
+
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key: %w", err)
+		}
+
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q",
+			block.Type)
+	}
+}
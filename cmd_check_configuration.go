@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"github.com/galdor/go-program"
+)
+
+func addCmdCheckConfiguration(p *program.Program) {
+	p.AddCommand("check-configuration",
+		"check the pki configuration file", cmdCheckConfiguration)
+}
+
+func cmdCheckConfiguration(p *program.Program) {
+	data, err := pki.Storage.ReadObject(ObjectTypeConfiguration,
+		CfgObjectName)
+	if err != nil {
+		p.Fatal("cannot read configuration: %v", err)
+	}
+
+	cfg, version, err := DecodePKICfg(data)
+	if err != nil {
+		p.Fatal("invalid configuration: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		p.Fatal("invalid configuration: %v", err)
+	}
+
+	if version < CurrentCfgVersion {
+		p.Info("configuration is valid but will be migrated from "+
+			"version %d to version %d", version, CurrentCfgVersion)
+	} else {
+		p.Info("configuration is valid")
+	}
+}
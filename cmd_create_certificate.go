@@ -15,10 +15,9 @@
 package main
 
 import (
-	"math"
+	"fmt"
 	"net"
 	"net/url"
-	"strconv"
 
 	"github.com/galdor/go-program"
 )
@@ -29,26 +28,21 @@ func addCmdCreateCertificate(p *program.Program) {
 
 	c.AddArgument("name", "the name of the certificate")
 
-	c.AddOption("i", "issuer-certificate", "name", RootCAName,
-		"the name of the issuer certificate")
+	c.AddOption("i", "issuer-certificate", "name", "",
+		"the name of the issuer certificate (default: the root ca "+
+			"if there is only one)")
 
 	c.AddFlag("", "ca", "create a ca certificate")
 	c.AddFlag("", "client", "create a client certificate")
+	c.AddOption("", "profile", "name", "",
+		"the profile of the certificate (server, client or "+
+			"ocsp-signer)")
 	c.AddFlag("e", "encrypt-private-key", "encrypt the private key")
 
 	c.AddOption("", "validity", "days", "",
 		"the duration during which the certificate will remain valid")
 
-	c.AddOption("", "country", "name", "", "the subject country")
-	c.AddOption("", "organization", "name", "", "the subject organization")
-	c.AddOption("", "organizational-unit", "name", "",
-		"the subject organizational unit")
-	c.AddOption("", "locality", "name", "", "the subject locality")
-	c.AddOption("", "province", "name", "", "the subject province")
-	c.AddOption("", "street-address", "address", "",
-		"the subject street-address")
-	c.AddOption("", "postal-code", "code", "", "the subject postal code")
-	c.AddOption("", "common-name", "domain", "", "the subject common name")
+	addSubjectOptions(c)
 
 	c.AddOption("", "san-uris", "uris", "",
 		"a list of uris used for the san extension")
@@ -63,18 +57,12 @@ func addCmdCreateCertificate(p *program.Program) {
 func cmdCreateCertificate(p *program.Program) {
 	name := p.ArgumentValue("name")
 
-	issuerCertName := p.OptionValue("issuer-certificate")
+	issuerCertName := issuerOptionValue(p)
 	issuerKeyName := issuerCertName
 
 	validity := 0
 	if p.IsOptionSet("validity") {
-		validityString := p.OptionValue("validity")
-		i64, err := strconv.ParseInt(validityString, 10, 64)
-		if err != nil || i64 < 1 || i64 > math.MaxInt32 {
-			p.Fatal("invalid validity")
-		}
-
-		validity = int(i64)
+		validity = validityOptionValue(p)
 	}
 
 	var sanURIs []*url.URL
@@ -133,16 +121,7 @@ func cmdCreateCertificate(p *program.Program) {
 	certData := CertificateData{
 		Validity: validity,
 
-		Subject: Subject{
-			Country:            p.OptionValue("country"),
-			Organization:       p.OptionValue("organization"),
-			OrganizationalUnit: p.OptionValue("organizational-unit"),
-			Locality:           p.OptionValue("locality"),
-			Province:           p.OptionValue("province"),
-			StreetAddress:      p.OptionValue("street-address"),
-			PostalCode:         p.OptionValue("postal-code"),
-			CommonName:         p.OptionValue("common-name"),
-		},
+		Subject: subjectOptionValues(p),
 
 		SAN: SAN{
 			URIs:           sanURIs,
@@ -155,7 +134,24 @@ func cmdCreateCertificate(p *program.Program) {
 		IsClientCertificate: p.IsOptionSet("client"),
 	}
 
-	certData.UpdateFromDefaults(&pki.Cfg.Certificates)
+	if profile := p.OptionValue("profile"); profile != "" {
+		if certData.IsCA || certData.IsClientCertificate {
+			p.Fatal("cannot use --ca or --client with a profile")
+		}
+
+		if err := certData.ApplyProfile(profile); err != nil {
+			p.Fatal("%v", err)
+		}
+	}
+
+	// Delegated responder certificates are not checked for revocation, so
+	// they must not be valid for long.
+	if certData.IsOCSPSigner && certData.Validity == 0 {
+		certData.Validity =
+			pki.OCSPSigningCertificateValidity(issuerCertName)
+	}
+
+	certData.UpdateFromDefaults(pki.CertificateDefaults(issuerCertName))
 
 	var privateKeyPassword []byte
 	if p.IsOptionSet("encrypt-private-key") {
@@ -167,14 +163,38 @@ func cmdCreateCertificate(p *program.Program) {
 		privateKeyPassword = password
 	}
 
-	key, err := pki.CreatePrivateKey(name, privateKeyPassword)
+	// The private key, the certificate and the crl of ca certificates are
+	// written together so that a failure does not leave an orphan private
+	// key behind.
+	err = pki.WithTransaction(func() error {
+		key, err := pki.CreatePrivateKey(name, privateKeyPassword)
+		if err != nil {
+			return fmt.Errorf("cannot create private key: %w", err)
+		}
+
+		cert, err := pki.CreateCertificate(name, &certData,
+			issuerCertName, issuerCert, issuerKey, PublicKey(key))
+		if err != nil {
+			return fmt.Errorf("cannot create certificate: %w", err)
+		}
+
+		if certData.IsCA {
+			_, err := pki.CreateCRL(name, cert, key, &CRLData{})
+			if err != nil {
+				return fmt.Errorf("cannot create crl: %w", err)
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		p.Fatal("cannot private key: %v", err)
+		p.Fatal("%v", err)
 	}
 
-	_, err = pki.CreateCertificate(name, &certData, issuerCert, issuerKey,
-		PublicKey(key))
-	if err != nil {
-		p.Fatal("cannot initialize pki: %v", err)
+	if certData.IsOCSPSigner &&
+		pki.OCSPSigningCertificateName(issuerCertName) != name {
+		p.Info("set cas.%s.ocsp.signingCertificate to %q in the "+
+			"configuration to sign ocsp responses with this certificate",
+			issuerCertName, name)
 	}
 }
@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"github.com/galdor/go-program"
+)
+
+func addCmdCreateRootCA(p *program.Program) {
+	c := p.AddCommand("create-root-ca",
+		"create a new root certificate authority", cmdCreateRootCA)
+
+	c.AddArgument("name", "the name of the root certificate")
+
+	c.AddOption("", "validity", "days", "365",
+		"the duration during which the root certificate will remain valid")
+	c.AddFlag("e", "encrypt-private-key", "encrypt the private key")
+
+	addSubjectOptions(c)
+}
+
+func cmdCreateRootCA(p *program.Program) {
+	name := p.ArgumentValue("name")
+	validity := validityOptionValue(p)
+
+	var privateKeyPassword []byte
+	if p.IsOptionSet("encrypt-private-key") {
+		password, err := ReadPrivateKeyPasswordForCreation(name)
+		if err != nil {
+			p.Fatal("cannot read private key password: %v", err)
+		}
+
+		privateKeyPassword = password
+	}
+
+	certData := CertificateData{
+		Validity: validity,
+		Subject:  subjectOptionValues(p),
+		IsCA:     true,
+	}
+
+	err := pki.CreateRootCA(name, &certData, privateKeyPassword)
+	if err != nil {
+		p.Fatal("cannot create root ca: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdCreateSCEPChallenge(p *program.Program) {
+	c := p.AddCommand("create-scep-challenge", "create a one-time "+
+		"challenge password for the scep server", cmdCreateSCEPChallenge)
+
+	c.AddOption("", "validity", "hours", "",
+		"the duration during which the challenge password can be used")
+}
+
+func cmdCreateSCEPChallenge(p *program.Program) {
+	cfg, err := pki.SCEPCfg()
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	validity := DefaultSCEPChallengeValidity
+	if cfg.ChallengeValidity > 0 {
+		validity = cfg.ChallengeValidity
+	}
+
+	// The limit also prevents the duration from overflowing.
+	if p.IsOptionSet("validity") {
+		s := p.OptionValue("validity")
+
+		i64, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i64 < 1 || i64 > MaxSCEPChallengeValidity {
+			p.Fatal("invalid validity: value must be between 1 and %d "+
+				"hours", MaxSCEPChallengeValidity)
+		}
+
+		validity = int(i64)
+	}
+
+	var password string
+	var challenge *SCEPChallenge
+
+	err = pki.WithTransaction(func() error {
+		var err error
+		password, challenge, err = pki.CreateSCEPChallenge(
+			time.Duration(validity) * time.Hour)
+		return err
+	})
+	if err != nil {
+		p.Fatal("cannot create challenge: %v", err)
+	}
+
+	p.Info("challenge valid until %s",
+		challenge.ExpirationDate.Format(time.RFC3339))
+
+	fmt.Println(password)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"path"
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdGenerateOCSPResponse(p *program.Program) {
+	c := p.AddCommand("generate-ocsp-response",
+		"write signed ocsp responses for stapling",
+		cmdGenerateOCSPResponse)
+
+	c.AddFlag("a", "all", "generate responses for all valid certificates")
+	c.AddOption("o", "output", "path", "",
+		"the path of the response file (default: <name>.ocsp), or of "+
+			"the directory where responses are written with --all "+
+			"(default: the current directory)")
+
+	c.AddOptionalArgument("name", "the name, serial:<hex>, sha256:<hex> "+
+		"or path of the certificate")
+}
+
+func cmdGenerateOCSPResponse(p *program.Program) {
+	output := p.OptionValue("output")
+
+	var entries []*IndexEntry
+
+	switch {
+	case p.IsOptionSet("all") && p.IsArgumentSet("name"):
+		p.Fatal("cannot use both a certificate and --all")
+
+	case p.IsOptionSet("all"):
+		index, err := pki.LoadIndex()
+		if err != nil {
+			p.Fatal("cannot load index: %v", err)
+		}
+
+		// Revoked certificates are included: their responses must be
+		// updated so that servers stop stapling a good status.
+		now := time.Now()
+
+		for _, entry := range index.Entries {
+			if entry.IssuerName == entry.Name {
+				continue
+			} else if entry.IssuerName == "" {
+				p.Error("skipping certificate %q: unknown issuer",
+					entry.Name)
+				continue
+			}
+
+			if now.Before(entry.NotBefore) || now.After(entry.NotAfter) {
+				continue
+			}
+
+			entries = append(entries, entry)
+		}
+
+		if output == "" {
+			output = "."
+		}
+
+	case p.IsArgumentSet("name"):
+		entry, err := pki.ResolveIndexEntry(p.ArgumentValue("name"))
+		if err != nil {
+			p.Fatal("cannot find certificate: %v", err)
+		}
+
+		if entry.IssuerName == entry.Name {
+			p.Fatal("cannot generate ocsp responses for root cas")
+		} else if entry.IssuerName == "" {
+			p.Fatal("unknown issuer for certificate %q", entry.Name)
+		}
+
+		entries = []*IndexEntry{entry}
+
+	default:
+		p.Fatal("missing certificate or --all")
+	}
+
+	signers := make(map[string]*OCSPSigner)
+	statuses := make(map[string]*RevocationStatus)
+
+	for _, entry := range entries {
+		issuerName := entry.IssuerName
+
+		signer, found := signers[issuerName]
+		if !found {
+			var err error
+
+			signer, err = pki.LoadOCSPSigner(issuerName,
+				ReadPrivateKeyPassword)
+			if err != nil {
+				p.Fatal("cannot load ocsp signer for %q: %v",
+					issuerName, err)
+			}
+
+			status, err := pki.LoadRevocationStatus(issuerName)
+			if err != nil {
+				p.Fatal("cannot load revocation status of %q: %v",
+					issuerName, err)
+			}
+
+			signers[issuerName] = signer
+			statuses[issuerName] = status
+		}
+
+		response, err := pki.GenerateOCSPResponse(entry, signer,
+			statuses[issuerName])
+		if err != nil {
+			p.Fatal("cannot generate ocsp response for %q: %v",
+				entry.Name, err)
+		}
+
+		filePath := output
+		if p.IsOptionSet("all") {
+			filePath = path.Join(output, entry.Name+".ocsp")
+		} else if filePath == "" {
+			filePath = entry.Name + ".ocsp"
+		}
+
+		p.Info("writing ocsp response for %q to %q", entry.Name, filePath)
+
+		if err := createOrReplaceFile(filePath, response, 0644); err != nil {
+			p.Fatal("cannot write ocsp response: %v", err)
+		}
+	}
+}
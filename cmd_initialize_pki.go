@@ -15,9 +15,6 @@
 package main
 
 import (
-	"math"
-	"strconv"
-
 	"github.com/galdor/go-program"
 )
 
@@ -25,32 +22,22 @@ func addCmdInitializePKI(p *program.Program) {
 	c := p.AddCommand("initialize-pki",
 		"initialize a new public key infrastructure", cmdInitializePKI)
 
+	c.AddOption("n", "name", "name", RootCAName,
+		"the name of the root certificate")
 	c.AddOption("", "validity", "days", "365",
 		"the duration during which the root certificate will remain valid")
 	c.AddFlag("e", "encrypt-private-key", "encrypt the private key")
 
-	c.AddOption("", "country", "name", "", "the subject country")
-	c.AddOption("", "organization", "name", "", "the subject organization")
-	c.AddOption("", "organizational-unit", "name", "",
-		"the subject organizational unit")
-	c.AddOption("", "locality", "name", "", "the subject locality")
-	c.AddOption("", "province", "name", "", "the subject province")
-	c.AddOption("", "street-address", "name", "", "the subject street-address")
-	c.AddOption("", "postal-code", "name", "", "the subject postal code")
-	c.AddOption("", "common-name", "name", "", "the subject common name")
+	addSubjectOptions(c)
 }
 
 func cmdInitializePKI(p *program.Program) {
-	validityString := p.OptionValue("validity")
-	i64, err := strconv.ParseInt(validityString, 10, 64)
-	if err != nil || i64 < 1 || i64 > math.MaxInt32 {
-		p.Fatal("invalid validity")
-	}
-	validity := int(i64)
+	name := p.OptionValue("name")
+	validity := validityOptionValue(p)
 
 	var privateKeyPassword []byte
 	if p.IsOptionSet("encrypt-private-key") {
-		password, err := ReadPrivateKeyPasswordForCreation(RootCAName)
+		password, err := ReadPrivateKeyPasswordForCreation(name)
 		if err != nil {
 			p.Fatal("cannot read private key password: %v", err)
 		}
@@ -60,22 +47,12 @@ func cmdInitializePKI(p *program.Program) {
 
 	certData := CertificateData{
 		Validity: validity,
-
-		Subject: Subject{
-			Country:            p.OptionValue("country"),
-			Organization:       p.OptionValue("organization"),
-			OrganizationalUnit: p.OptionValue("organizational-unit"),
-			Locality:           p.OptionValue("locality"),
-			Province:           p.OptionValue("province"),
-			StreetAddress:      p.OptionValue("street-address"),
-			PostalCode:         p.OptionValue("postal-code"),
-			CommonName:         p.OptionValue("common-name"),
-		},
-
-		IsCA: true,
+		Subject:  subjectOptionValues(p),
+		IsCA:     true,
 	}
 
-	if err := pki.Initialize(&certData, privateKeyPassword); err != nil {
+	err := pki.Initialize(name, &certData, privateKeyPassword)
+	if err != nil {
 		p.Fatal("cannot initialize pki: %v", err)
 	}
 }
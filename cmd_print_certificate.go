@@ -24,13 +24,14 @@ func addCmdPrintCertificate(p *program.Program) {
 	c := p.AddCommand("print-certificate",
 		"print the content of a certificate", cmdPrintCertificate)
 
-	c.AddArgument("name", "the name of the certificate")
+	c.AddArgument("name", "the name, serial:<hex>, sha256:<hex> or path "+
+		"of the certificate")
 }
 
 func cmdPrintCertificate(p *program.Program) {
-	name := p.ArgumentValue("name")
+	ref := p.ArgumentValue("name")
 
-	cert, err := pki.LoadCertificate(name)
+	_, cert, err := pki.ResolveCertificate(ref)
 	if err != nil {
 		p.Fatal("cannot load certificate: %v", err)
 	}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdPrintCRL(p *program.Program) {
+	c := p.AddCommand("print-crl", "print the content of a crl", cmdPrintCRL)
+
+	c.AddFlag("", "delta", "print the delta crl of the issuer")
+
+	c.AddArgument("issuer", "the name, serial:<hex> or sha256:<hex> of the "+
+		"issuer certificate, or the path of a crl file")
+}
+
+func cmdPrintCRL(p *program.Program) {
+	ref := p.ArgumentValue("issuer")
+
+	var data []byte
+	var issuerName string
+
+	if strings.Contains(ref, "/") {
+		if p.IsOptionSet("delta") {
+			p.Fatal("--delta cannot be used with a crl file")
+		}
+
+		fileData, err := ioutil.ReadFile(ref)
+		if err != nil {
+			p.Fatal("cannot read %q: %v", ref, err)
+		}
+
+		data = fileData
+		if block, _ := pem.Decode(fileData); block != nil {
+			data = block.Bytes
+		}
+
+		// The issuer of a crl file is looked for among the cas of the
+		// pki so that its signature can be verified.
+		name, err := pki.FindCRLIssuerName(data)
+		if err != nil {
+			p.Info("cannot find issuer: %v", err)
+		}
+
+		issuerName = name
+	} else {
+		name, err := pki.ResolveCertificateName(ref)
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		issuerName = name
+
+		if p.IsOptionSet("delta") {
+			data, err = pki.LoadDeltaCRL(issuerName)
+		} else {
+			data, err = pki.LoadCRL(issuerName)
+		}
+		if err != nil {
+			p.Fatal("cannot load crl: %v", err)
+		}
+	}
+
+	var issuerCert *x509.Certificate
+	if issuerName != "" {
+		cert, err := pki.LoadCertificate(issuerName)
+		if err != nil {
+			p.Fatal("cannot load issuer certificate: %v", err)
+		}
+
+		issuerCert = cert
+	}
+
+	if err := PrintCRL(data, issuerCert, os.Stdout); err != nil {
+		p.Fatal("cannot print crl: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		p.Fatal("cannot parse crl: %v", err)
+	}
+
+	if nextUpdate := crl.NextUpdate; nextUpdate.Before(time.Now()) {
+		p.Error("stale crl (next update: %s)",
+			nextUpdate.Format(time.RFC3339))
+	}
+}
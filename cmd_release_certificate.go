@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"github.com/galdor/go-program"
+)
+
+func addCmdReleaseCertificate(p *program.Program) {
+	c := p.AddCommand("release-certificate",
+		"remove a certificate on hold from the crl of its issuer",
+		cmdReleaseCertificate)
+
+	c.AddOption("i", "issuer-certificate", "name", "",
+		"the name of the issuer certificate (default: the issuer "+
+			"recorded in the index)")
+	c.AddOption("s", "serial", "hex", "",
+		"the serial number of the certificate")
+
+	c.AddOptionalArgument("name", "the name, serial:<hex>, sha256:<hex> "+
+		"or path of the certificate")
+}
+
+func cmdReleaseCertificate(p *program.Program) {
+	var issuerName string
+	if s := p.OptionValue("issuer-certificate"); s != "" {
+		name, err := pki.ResolveCertificateName(s)
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		issuerName = name
+	}
+
+	var ref string
+
+	switch {
+	case p.IsArgumentSet("name") && p.IsOptionSet("serial"):
+		p.Fatal("certificates must be referenced by either name or " +
+			"serial number")
+	case p.IsArgumentSet("name"):
+		ref = p.ArgumentValue("name")
+	case p.IsOptionSet("serial"):
+		ref = "serial:" + p.OptionValue("serial")
+	default:
+		p.Fatal("missing certificate name or serial number")
+	}
+
+	entry, err := resolveRevokedCertificate(ref, issuerName)
+	if err != nil {
+		p.Fatal("cannot find certificate %q: %v", ref, err)
+	}
+
+	serialNumber, err := entry.SerialNumberValue()
+	if err != nil {
+		p.Fatal("invalid index entry %q: %v", entry.Name, err)
+	}
+
+	issuerName = entry.IssuerName
+
+	issuerCert, err := pki.LoadCertificate(issuerName)
+	if err != nil {
+		p.Fatal("cannot load issuer certificate: %v", err)
+	}
+
+	issuerKey, err := pki.LoadPrivateKey(issuerName,
+		func() ([]byte, error) {
+			return ReadPrivateKeyPassword(issuerName)
+		})
+	if err != nil {
+		p.Fatal("cannot load issuer private key: %v", err)
+	}
+
+	p.Info("releasing certificate %q (serial number %s)", entry.Name,
+		entry.SerialNumber)
+
+	err = pki.ReleaseCertificate(issuerName, issuerCert, issuerKey,
+		serialNumber)
+	if err != nil {
+		p.Fatal("cannot release certificate %q: %v", entry.Name, err)
+	}
+}
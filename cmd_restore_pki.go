@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdRestorePKI(p *program.Program) {
+	c := p.AddCommand("restore-pki",
+		"restore a pki from a backup", cmdRestorePKI)
+
+	c.AddArgument("path", "the path of the backup file")
+	c.AddArgument("directory", "the path of the pki to create")
+
+	c.AddOption("", "private-key", "path", "",
+		"the path of the pem private key used to decrypt the backup")
+	c.AddOption("", "trusted-certificate", "path", "",
+		"the path of the pem certificate which signed the backup or of "+
+			"a ca certificate it was issued by (required)")
+}
+
+func cmdRestorePKI(p *program.Program) {
+	backupPath := p.ArgumentValue("path")
+	dirPath := p.ArgumentValue("directory")
+
+	data, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		p.Fatal("cannot read %q: %v", backupPath, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != BackupPEMBlockType {
+		p.Fatal("%q is not a pki backup", backupPath)
+	}
+
+	// The signer certificate stored in the backup cannot be trusted on
+	// its own: anyone able to encrypt a backup could have signed it.
+	certPath := p.OptionValue("trusted-certificate")
+	if certPath == "" {
+		p.Fatal("missing trusted certificate")
+	}
+
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		p.Fatal("cannot read %q: %v", certPath, err)
+	}
+
+	trustedCert, err := decodePEMCertificate(certData)
+	if err != nil {
+		p.Fatal("cannot load trusted certificate: %v", err)
+	}
+
+	var archive []byte
+
+	if IsPassphraseEncryptedBackup(block) {
+		passphrase, err := ReadPassword("backup passphrase: ")
+		if err != nil {
+			p.Fatal("cannot read passphrase: %v", err)
+		}
+
+		archive, err = DecryptBackupWithPassphrase(block, passphrase)
+		if err != nil {
+			p.Fatal("%v", err)
+		}
+	} else {
+		keyPath := p.OptionValue("private-key")
+		if keyPath == "" {
+			p.Fatal("backup is encrypted with a public key: " +
+				"--private-key must be set")
+		}
+
+		keyData, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			p.Fatal("cannot read %q: %v", keyPath, err)
+		}
+
+		key, err := decodePEMPrivateKey(keyData,
+			func() ([]byte, error) {
+				return ReadPassword("private key password: ")
+			})
+		if err != nil {
+			p.Fatal("cannot load private key: %v", err)
+		}
+
+		archive, err = DecryptBackupWithPrivateKey(block, key)
+		if err != nil {
+			p.Fatal("%v", err)
+		}
+	}
+
+	writes, manifest, err := ReadBackupArchive(archive, trustedCert)
+	if err != nil {
+		p.Fatal("invalid backup: %v", err)
+	}
+
+	p.Info("restoring backup created on %v (%d objects)",
+		manifest.CreationDate, len(writes))
+
+	storage, err := NewStorage(p.OptionValue("storage"), dirPath)
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	target := NewPKI(storage)
+	target.LockTimeout = pki.LockTimeout
+
+	if err := target.Restore(writes); err != nil {
+		p.Fatal("cannot restore pki: %v", err)
+	}
+}
@@ -15,67 +15,360 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/galdor/go-program"
 )
 
 func addCmdRevokeCertificate(p *program.Program) {
-	c := p.AddCommand("revoke-certificate", "revoke a certificate",
+	c := p.AddCommand("revoke-certificate", "revoke one or more certificates",
 		cmdRevokeCertificate)
 
-	c.AddOption("i", "issuer-certificate", "name", RootCAName,
-		"the name of the issuer certificate")
+	c.AddOption("i", "issuer-certificate", "name", "",
+		"the name of the issuer certificate (default: the issuer "+
+			"recorded in the index)")
+	c.AddOption("r", "reason", "reason", "unspecified",
+		"the reason of the revocation")
+	c.AddOption("", "invalidity-date", "date", "",
+		"the date at which the certificate became invalid (rfc 3339 "+
+			"date-time or yyyy-mm-dd date)")
+	c.AddOption("s", "serial", "hex", "",
+		"the serial number of the certificate")
+	c.AddOption("f", "file", "path", "",
+		"a file containing one certificate reference per line")
+	c.AddFlag("", "cascade", "revoke ca certificates and all the "+
+		"certificates they issued directly or indirectly")
 
-	c.AddArgument("name", "the name of the certificate")
+	c.AddOptionalArgument("name", "the name, serial:<hex>, sha256:<hex> "+
+		"or path of the certificate")
 }
 
 func cmdRevokeCertificate(p *program.Program) {
-	issuerCertName := p.OptionValue("issuer-certificate")
-	issuerKeyName := issuerCertName
+	reason, err := ParseRevocationReason(p.OptionValue("reason"))
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	// A compromised ca cannot be trusted anymore for any certificate it
+	// issued, so the whole subtree is revoked with the same reason.
+	cascade := p.IsOptionSet("cascade")
+	if cascade {
+		if p.IsOptionSet("reason") &&
+			reason != RevocationReasonCACompromise {
+			p.Fatal("cascading revocations must use the %s reason",
+				RevocationReasonCACompromise)
+		}
+
+		reason = RevocationReasonCACompromise
+	}
+
+	var invalidityDate time.Time
+	if s := p.OptionValue("invalidity-date"); s != "" {
+		date, err := parseDate(s)
+		if err != nil {
+			p.Fatal("invalid invalidity date: %v", err)
+		}
+
+		if date.After(time.Now()) {
+			p.Fatal("invalid invalidity date: date is in the future")
+		}
+
+		invalidityDate = date
+	}
+
+	var issuerName string
+	if s := p.OptionValue("issuer-certificate"); s != "" {
+		name, err := pki.ResolveCertificateName(s)
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		issuerName = name
+	}
+
+	// Certificates to revoke
+	var refs []string
+
+	nbSources := 0
+
+	if p.IsArgumentSet("name") {
+		refs = append(refs, p.ArgumentValue("name"))
+		nbSources++
+	}
+
+	if s := p.OptionValue("serial"); s != "" {
+		refs = append(refs, "serial:"+s)
+		nbSources++
+	}
+
+	if filePath := p.OptionValue("file"); filePath != "" {
+		fileRefs, err := readCertificateReferenceFile(filePath)
+		if err != nil {
+			p.Fatal("%v", err)
+		}
+
+		refs = append(refs, fileRefs...)
+		nbSources++
+	}
+
+	switch nbSources {
+	case 0:
+		p.Fatal("missing certificate name, serial number or file")
+	case 1:
+	default:
+		p.Fatal("certificates must be referenced by either name, " +
+			"serial number or file")
+	}
+
+	// Revoked certificates are grouped by issuer so that each crl is
+	// only updated once.
+	var issuerNames []string
+	rcs := make(map[string][]CRLRevokedCert)
+	revokedNames := make(map[string]bool)
+
+	var revokedEntries, skippedEntries []*IndexEntry
+	skippedReasons := make(map[string]RevocationReason)
+
+	revocationDate := time.Now().UTC()
+
+	revoke := func(entry *IndexEntry) {
+		serialNumber, err := entry.SerialNumberValue()
+		if err != nil {
+			p.Fatal("invalid index entry %q: %v", entry.Name, err)
+		}
+
+		err = pki.CheckRevocation(entry, serialNumber, reason)
+		if err != nil {
+			p.Fatal("%v", err)
+		}
+
+		p.Info("revoking certificate %q (serial number %s)", entry.Name,
+			entry.SerialNumber)
+
+		if _, found := rcs[entry.IssuerName]; !found {
+			issuerNames = append(issuerNames, entry.IssuerName)
+		}
+
+		rcs[entry.IssuerName] = append(rcs[entry.IssuerName],
+			CRLRevokedCert{
+				SerialNumber:   *serialNumber,
+				RevocationDate: revocationDate,
+				Reason:         reason,
+				InvalidityDate: invalidityDate,
+			})
+
+		revokedNames[entry.Name] = true
+		revokedEntries = append(revokedEntries, entry)
+	}
+
+	for _, ref := range refs {
+		entry, err := resolveRevokedCertificate(ref, issuerName)
+		if err != nil {
+			p.Fatal("cannot find certificate %q: %v", ref, err)
+		}
+
+		if revokedNames[entry.Name] {
+			p.Fatal("certificate %q is referenced multiple times",
+				entry.Name)
+		}
+
+		if cascade && !entry.IsCA {
+			p.Fatal("certificate %q is not a ca certificate",
+				entry.Name)
+		}
 
-	certName := p.ArgumentValue("name")
+		revoke(entry)
 
-	issuerCert, err := pki.LoadCertificate(issuerCertName)
+		if !cascade {
+			continue
+		}
+
+		index, err := pki.LoadIndex()
+		if err != nil {
+			p.Fatal("%v", err)
+		}
+
+		for _, descendant := range index.Descendants(entry.Name) {
+			if revokedNames[descendant.Name] {
+				continue
+			}
+
+			serialNumber, err := descendant.SerialNumberValue()
+			if err != nil {
+				p.Fatal("invalid index entry %q: %v",
+					descendant.Name, err)
+			}
+
+			rc, err := pki.FindRevokedCertificate(
+				descendant.IssuerName, serialNumber)
+			if err != nil {
+				p.Fatal("%v", err)
+			}
+
+			if rc != nil && rc.Reason != RevocationReasonCertificateHold {
+				skippedEntries = append(skippedEntries, descendant)
+				skippedReasons[descendant.Name] = rc.Reason
+				continue
+			}
+
+			revoke(descendant)
+		}
+	}
+
+	// Either all crls are updated or none of them
+	err = pki.WithTransaction(func() error {
+		for _, name := range issuerNames {
+			cert, err := pki.LoadCertificate(name)
+			if err != nil {
+				return fmt.Errorf("cannot load issuer certificate: %w",
+					err)
+			}
+
+			key, err := pki.LoadPrivateKey(name,
+				func() ([]byte, error) {
+					return ReadPrivateKeyPassword(name)
+				})
+			if err != nil {
+				return fmt.Errorf("cannot load issuer private key: %w",
+					err)
+			}
+
+			err = pki.AddRevokedCertificates(name, cert, key, rcs[name])
+			if err != nil {
+				return fmt.Errorf("cannot update crl %q: %w", name, err)
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		p.Fatal("cannot load issuer certificate: %v", err)
+		p.Fatal("%v", err)
 	}
 
-	issuerKey, err := pki.LoadPrivateKey(issuerKeyName,
-		func() ([]byte, error) {
-			return ReadPrivateKeyPassword(issuerKeyName)
+	if cascade {
+		printer := NewPrinter(os.Stdout)
+
+		printer.Line("Revoked certificates:")
+		printer.WithIndent(func() {
+			for _, entry := range revokedEntries {
+				printer.Line("%s (serial number %s, issuer %s)",
+					entry.Name, entry.SerialNumber, entry.IssuerName)
+			}
 		})
-	if err != nil {
-		p.Fatal("cannot load issuer private key: %v", err)
+
+		if len(skippedEntries) > 0 {
+			printer.Line("Certificates already revoked:")
+			printer.WithIndent(func() {
+				for _, entry := range skippedEntries {
+					printer.Line("%s (serial number %s, issuer %s, "+
+						"reason %s)", entry.Name, entry.SerialNumber,
+						entry.IssuerName, skippedReasons[entry.Name])
+				}
+			})
+		}
+
+		if err := printer.Error(); err != nil {
+			p.Fatal("cannot print report: %v", err)
+		}
 	}
+}
 
-	cert, err := pki.LoadCertificate(certName)
-	if err != nil {
-		p.Fatal("cannot load certificate: %v", err)
+// Find the index entry of a certificate to revoke or release, making sure
+// it was issued by the issuer if one was provided. Serial numbers are only
+// unique for a given issuer, so they are looked up among the certificates
+// issued by the issuer if it is known.
+func resolveRevokedCertificate(ref, issuerName string) (*IndexEntry, error) {
+	if !strings.HasPrefix(ref, "serial:") || issuerName == "" {
+		entry, err := pki.ResolveIndexEntry(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		// Indexes rebuilt from existing certificates may not know
+		// the issuer of some certificates, in which case we look for
+		// it among the cas of the pki.
+		if entry.IssuerName == "" {
+			cert, err := pki.LoadCertificate(entry.Name)
+			if err != nil {
+				return nil, fmt.Errorf("unknown issuer for "+
+					"certificate %q: %w", entry.Name, err)
+			}
+
+			name, err := pki.FindIssuerName(cert)
+			if err != nil {
+				return nil, fmt.Errorf("unknown issuer for "+
+					"certificate %q: %w", entry.Name, err)
+			}
+
+			entryCopy := *entry
+			entryCopy.IssuerName = name
+			entry = &entryCopy
+		}
+
+		if issuerName != "" && entry.IssuerName != issuerName {
+			return nil, fmt.Errorf("certificate %q was not issued "+
+				"by %q", entry.Name, issuerName)
+		}
+
+		return entry, nil
 	}
 
-	data, err := pki.LoadCRL(issuerCertName)
+	serialNumber, err := parseSerialNumberReference(
+		strings.TrimPrefix(ref, "serial:"))
 	if err != nil {
-		p.Fatal("cannot load crl: %v", err)
+		return nil, err
 	}
 
-	var crlData CRLData
-	if err := crlData.Read(data); err != nil {
-		p.Fatal("cannot read crl data: %v", err)
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
 	}
 
-	// Since we always create CRLs with an expiration date equal to the
-	// expiration date of the CA certificate, there is no point in
-	// updating it.
-	crlData.CreationDate = time.Now().UTC()
+	entry := index.EntryBySerialNumber(issuerName, serialNumber)
+	if entry == nil {
+		return nil, fmt.Errorf("no certificate with serial number %s "+
+			"issued by %q", serialNumberString(serialNumber),
+			issuerName)
+	}
 
-	crlData.AddRevokedCertificate(CRLRevokedCert{
-		SerialNumber:   *cert.SerialNumber,
-		RevocationDate: time.Now().UTC(),
-	})
+	return entry, nil
+}
 
-	_, err = pki.UpdateCRL(issuerCertName, issuerCert, issuerKey, &crlData)
+// Certificate reference files contain one reference per line, using the
+// same syntax as command line arguments. Empty lines and lines starting with
+// '#' are ignored.
+func readCertificateReferenceFile(filePath string) ([]string, error) {
+	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		p.Fatal("cannot create crl: %v", err)
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
 	}
+
+	var refs []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		refs = append(refs, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no certificate reference found in %q",
+			filePath)
+	}
+
+	return refs, nil
 }
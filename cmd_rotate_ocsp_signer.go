@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdRotateOCSPSigner(p *program.Program) {
+	c := p.AddCommand("rotate-ocsp-signer",
+		"replace the delegated ocsp signing certificate of a ca",
+		cmdRotateOCSPSigner)
+
+	c.AddFlag("a", "all", "rotate the ocsp signers of all cas using a "+
+		"delegated signing certificate")
+	c.AddFlag("f", "force", "rotate even if the current signing "+
+		"certificate is not close to expiry")
+
+	c.AddOptionalArgument("issuer", "the name, serial:<hex>, sha256:<hex> "+
+		"or path of the ca certificate")
+}
+
+func cmdRotateOCSPSigner(p *program.Program) {
+	var names []string
+
+	switch {
+	case p.IsOptionSet("all") && p.IsArgumentSet("issuer"):
+		p.Fatal("cannot use both an issuer and --all")
+
+	case p.IsOptionSet("all"):
+		caNames, err := pki.CANames()
+		if err != nil {
+			p.Fatal("cannot list cas: %v", err)
+		}
+
+		for _, name := range caNames {
+			if pki.OCSPSigningCertificateName(name) != name {
+				names = append(names, name)
+			}
+		}
+
+	case p.IsArgumentSet("issuer"):
+		name, err := pki.ResolveCertificateName(
+			p.ArgumentValue("issuer"))
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		names = []string{name}
+
+	default:
+		p.Fatal("missing issuer or --all")
+	}
+
+	now := time.Now()
+
+	for _, name := range names {
+		if !p.IsOptionSet("force") {
+			rotate, err := pki.OCSPSignerNeedsRotation(name, now)
+			if err != nil {
+				p.Fatal("cannot check ocsp signer of %q: %v", name, err)
+			}
+
+			if !rotate {
+				p.Info("ocsp signing certificate of %q is not close "+
+					"to expiry", name)
+				continue
+			}
+		}
+
+		rotateOCSPSigner(p, name)
+	}
+}
+
+func rotateOCSPSigner(p *program.Program, name string) {
+	cert, err := pki.LoadCertificate(name)
+	if err != nil {
+		p.Fatal("cannot load certificate: %v", err)
+	}
+
+	if !cert.IsCA {
+		p.Fatal("certificate %q is not a ca certificate", name)
+	}
+
+	key, err := pki.LoadPrivateKey(name, func() ([]byte, error) {
+		return ReadPrivateKeyPassword(name)
+	})
+	if err != nil {
+		p.Fatal("cannot load private key: %v", err)
+	}
+
+	certName, err := pki.RotateOCSPSigner(name, cert, key)
+	if err != nil {
+		p.Fatal("cannot rotate ocsp signer of %q: %v", name, err)
+	}
+
+	p.Info("ocsp responses for %q are now signed by %q", name, certName)
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/go-program"
+)
+
+var ACMEChallengeTypes = []string{"http-01", "dns-01", "tls-alpn-01"}
+
+func addCmdServeACME(p *program.Program) {
+	c := p.AddCommand("serve-acme", "run an acme server issuing "+
+		"certificates with a ca", cmdServeACME)
+
+	c.AddOption("", "address", "address", "localhost:8082",
+		"the address to listen on")
+	c.AddOption("", "url", "url", "",
+		"the external url of the server (default: built from the "+
+			"listening address)")
+	c.AddOption("i", "issuer-certificate", "name", "",
+		"the name of the ca issuing certificates (default: the only "+
+			"root ca of the pki)")
+	c.AddOption("", "profile", "profile", "server",
+		"the profile of issued certificates ("+
+			strings.Join(EnrollmentProfiles, ", ")+")")
+	c.AddOption("", "challenge-types", "types",
+		strings.Join(ACMEChallengeTypes, ","),
+		"a comma-separated list of supported challenge types")
+	c.AddOption("", "http-01-port", "port", "80",
+		"the port used to validate http-01 challenges")
+	c.AddOption("", "tls-alpn-01-port", "port", "443",
+		"the port used to validate tls-alpn-01 challenges")
+	c.AddOption("", "dns-resolver", "address", "",
+		"the address of the dns server used to validate dns-01 "+
+			"challenges (default: the system resolver)")
+	c.AddOption("", "tls-certificate", "name", "",
+		"the name of a certificate of the pki used to serve https")
+}
+
+func cmdServeACME(p *program.Program) {
+	issuerName := issuerOptionValue(p)
+
+	profile := p.OptionValue("profile")
+	if err := CheckEnrollmentProfile(profile); err != nil {
+		p.Fatal("%v", err)
+	}
+
+	var challengeTypes []string
+	for _, s := range strings.Split(p.OptionValue("challenge-types"), ",") {
+		challengeType := strings.TrimSpace(s)
+		if !isACMEChallengeType(challengeType) {
+			p.Fatal("invalid challenge type %q", challengeType)
+		}
+
+		challengeTypes = append(challengeTypes, challengeType)
+	}
+
+	address := p.OptionValue("address")
+	tlsCertName := p.OptionValue("tls-certificate")
+
+	serverURL := p.OptionValue("url")
+	if serverURL == "" {
+		if tlsCertName != "" {
+			serverURL = "https://" + address
+		} else {
+			serverURL = "http://" + address
+		}
+	}
+
+	cfg := ACMEServerCfg{
+		URL:            serverURL,
+		IssuerName:     issuerName,
+		Profile:        profile,
+		ChallengeTypes: challengeTypes,
+		HTTP01Port:     portOptionValue(p, "http-01-port"),
+		TLSALPN01Port:  portOptionValue(p, "tls-alpn-01-port"),
+		DNSResolver:    p.OptionValue("dns-resolver"),
+	}
+
+	issuerCert, err := pki.LoadCertificate(issuerName)
+	if err != nil {
+		p.Fatal("cannot load issuer certificate: %v", err)
+	}
+
+	if !issuerCert.IsCA {
+		p.Fatal("certificate %q is not a ca certificate", issuerName)
+	}
+
+	issuerKey, err := pki.LoadPrivateKey(issuerName,
+		func() ([]byte, error) {
+			return ReadPrivateKeyPassword(issuerName)
+		})
+	if err != nil {
+		p.Fatal("cannot load issuer private key: %v", err)
+	}
+
+	var tlsCfg *tls.Config
+	if tlsCertName != "" {
+		tlsCert, err := loadTLSCertificate(tlsCertName)
+		if err != nil {
+			p.Fatal("cannot load tls certificate: %v", err)
+		}
+
+		tlsCfg = &tls.Config{
+			Certificates: []tls.Certificate{*tlsCert},
+		}
+	}
+
+	server, err := NewACMEServer(pki, cfg)
+	if err != nil {
+		p.Fatal("cannot create acme server: %v", err)
+	}
+
+	server.SetIssuer(issuerCert, issuerKey)
+
+	// The server only locks the pki when it issues or revokes a
+	// certificate so that other commands can run.
+	if err := pki.Unlock(); err != nil {
+		p.Fatal("cannot unlock pki: %v", err)
+	}
+
+	httpServer := http.Server{
+		Addr:      address,
+		Handler:   server,
+		TLSConfig: tlsCfg,
+	}
+
+	p.Info("listening on %s (directory: %s/directory)", address,
+		strings.TrimSuffix(serverURL, "/"))
+
+	if tlsCfg != nil {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+
+	if err != nil {
+		p.Fatal("cannot run http server: %v", err)
+	}
+}
+
+func isACMEChallengeType(s string) bool {
+	for _, challengeType := range ACMEChallengeTypes {
+		if s == challengeType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func portOptionValue(p *program.Program, name string) int {
+	i64, err := strconv.ParseInt(p.OptionValue(name), 10, 64)
+	if err != nil || i64 < 1 || i64 > math.MaxUint16 {
+		p.Fatal("invalid %s", strings.ReplaceAll(name, "-", " "))
+	}
+
+	return int(i64)
+}
+
+// Load a certificate of the pki, its private key and the certificates of
+// its issuers for a tls server.
+func loadTLSCertificate(name string) (*tls.Certificate, error) {
+	cert, err := pki.LoadCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := pki.LoadPrivateKey(name, func() ([]byte, error) {
+		return ReadPrivateKeyPassword(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := pki.CertificateChain(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCert := tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+
+	for _, c := range chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+	}
+
+	return &tlsCert, nil
+}
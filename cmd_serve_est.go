@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdServeEST(p *program.Program) {
+	c := p.AddCommand("serve-est", "run an est enrollment server issuing "+
+		"certificates with a ca", cmdServeEST)
+
+	c.AddOption("", "address", "address", "localhost:8443",
+		"the address to listen on")
+	c.AddOption("i", "issuer-certificate", "name", "",
+		"the name of the ca issuing certificates (default: the only "+
+			"root ca of the pki)")
+	c.AddOption("", "profile", "profile", "client",
+		"the profile of issued certificates ("+
+			strings.Join(EnrollmentProfiles, ", ")+")")
+	c.AddOption("", "tls-certificate", "name", "",
+		"the name of the certificate of the pki used to serve https")
+	c.AddOption("", "users", "path", "",
+		"a file containing the users allowed to authenticate with http "+
+			"basic authentication and the names they can request "+
+			"certificates for")
+}
+
+func cmdServeEST(p *program.Program) {
+	issuerName := issuerOptionValue(p)
+
+	profile := p.OptionValue("profile")
+	if err := CheckEnrollmentProfile(profile); err != nil {
+		p.Fatal("%v", err)
+	}
+
+	// EST requires tls (RFC 7030 3.3), which is also used to authenticate
+	// clients with their certificate.
+	tlsCertName := p.OptionValue("tls-certificate")
+	if tlsCertName == "" {
+		p.Fatal("missing tls certificate")
+	}
+
+	cfg := ESTServerCfg{
+		IssuerName: issuerName,
+		Profile:    profile,
+	}
+
+	if filePath := p.OptionValue("users"); filePath != "" {
+		users, err := LoadESTUsers(filePath)
+		if err != nil {
+			p.Fatal("cannot load users: %v", err)
+		}
+
+		cfg.Users = users
+	}
+
+	issuerCert, err := pki.LoadCertificate(issuerName)
+	if err != nil {
+		p.Fatal("cannot load issuer certificate: %v", err)
+	}
+
+	if !issuerCert.IsCA {
+		p.Fatal("certificate %q is not a ca certificate", issuerName)
+	}
+
+	issuerKey, err := pki.LoadPrivateKey(issuerName,
+		func() ([]byte, error) {
+			return ReadPrivateKeyPassword(issuerName)
+		})
+	if err != nil {
+		p.Fatal("cannot load issuer private key: %v", err)
+	}
+
+	tlsCert, err := loadTLSCertificate(tlsCertName)
+	if err != nil {
+		p.Fatal("cannot load tls certificate: %v", err)
+	}
+
+	// Client certificates issued by any ca of the pki are accepted
+	clientCAs, err := caCertPool()
+	if err != nil {
+		p.Fatal("cannot load ca certificates: %v", err)
+	}
+
+	server, err := NewESTServer(pki, cfg, issuerCert, issuerKey)
+	if err != nil {
+		p.Fatal("cannot create est server: %v", err)
+	}
+
+	// The server only locks the pki when it authenticates a client or
+	// issues a certificate so that other commands can run.
+	if err := pki.Unlock(); err != nil {
+		p.Fatal("cannot unlock pki: %v", err)
+	}
+
+	address := p.OptionValue("address")
+
+	httpServer := http.Server{
+		Addr:    address,
+		Handler: server,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*tlsCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    clientCAs,
+		},
+	}
+
+	p.Info("listening on %s", address)
+
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		p.Fatal("cannot run http server: %v", err)
+	}
+}
+
+func caCertPool() (*x509.CertPool, error) {
+	names, err := pki.CANames()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	for _, name := range names {
+		cert, err := pki.LoadCertificate(name)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.AddCert(cert)
+	}
+
+	return pool, nil
+}
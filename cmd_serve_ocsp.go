@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdServeOCSP(p *program.Program) {
+	c := p.AddCommand("serve-ocsp", "run an ocsp responder for all cas",
+		cmdServeOCSP)
+
+	c.AddOption("", "address", "address", "localhost:8080",
+		"the address to listen on")
+	c.AddOption("", "refresh-interval", "seconds", "60",
+		"the interval between two reloads of revocation data")
+}
+
+func cmdServeOCSP(p *program.Program) {
+	refreshInterval := secondsOptionValue(p, "refresh-interval", 1)
+
+	caNames, err := pki.CANames()
+	if err != nil {
+		p.Fatal("cannot list cas: %v", err)
+	}
+
+	var signers []*OCSPSigner
+
+	for _, name := range caNames {
+		signer, err := pki.LoadOCSPSigner(name, ReadPrivateKeyPassword)
+		if err != nil {
+			p.Fatal("cannot load ocsp signer for %q: %v", name, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	responder := NewOCSPResponder(pki, signers)
+
+	if err := responder.Refresh(); err != nil {
+		p.Fatal("cannot load revocation data: %v", err)
+	}
+
+	// The responder runs for a long time: only hold the lock while
+	// revocation data are reloaded so that other commands can run.
+	if err := pki.Unlock(); err != nil {
+		p.Fatal("cannot unlock pki: %v", err)
+	}
+
+	go refreshPeriodically(p, responder.Refresh, refreshInterval)
+
+	address := p.OptionValue("address")
+
+	p.Info("listening on %s", address)
+
+	if err := http.ListenAndServe(address, responder); err != nil {
+		p.Fatal("cannot run http server: %v", err)
+	}
+}
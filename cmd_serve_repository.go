@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdServeRepository(p *program.Program) {
+	c := p.AddCommand("serve-repository",
+		"serve ca certificates and crls over http", cmdServeRepository)
+
+	c.AddOption("", "address", "address", "localhost:8081",
+		"the address to listen on")
+	c.AddOption("", "refresh-interval", "seconds", "60",
+		"the interval between two reloads of the repository")
+	c.AddOption("", "max-age", "seconds",
+		strconv.Itoa(DefaultRepositoryMaxAge),
+		"the maximum time during which clients can cache files")
+	c.AddOption("", "export", "path", "",
+		"write the repository to a directory instead of serving it")
+}
+
+func cmdServeRepository(p *program.Program) {
+	refreshInterval := secondsOptionValue(p, "refresh-interval", 1)
+	maxAge := secondsOptionValue(p, "max-age", 0)
+
+	if dirPath := p.OptionValue("export"); dirPath != "" {
+		repository, err := pki.BuildRepository()
+		if err != nil {
+			p.Fatal("cannot load repository: %v", err)
+		}
+
+		p.Info("exporting repository to %q", dirPath)
+
+		if err := repository.Export(dirPath); err != nil {
+			p.Fatal("cannot export repository: %v", err)
+		}
+
+		return
+	}
+
+	server := NewRepositoryServer(pki)
+	server.MaxAge = maxAge
+
+	if err := server.Refresh(); err != nil {
+		p.Fatal("cannot load repository: %v", err)
+	}
+
+	// Only hold the lock while the repository is reloaded so that other
+	// commands can run.
+	if err := pki.Unlock(); err != nil {
+		p.Fatal("cannot unlock pki: %v", err)
+	}
+
+	go refreshPeriodically(p, server.Refresh, refreshInterval)
+
+	address := p.OptionValue("address")
+
+	p.Info("listening on %s", address)
+
+	if err := http.ListenAndServe(address, server); err != nil {
+		p.Fatal("cannot run http server: %v", err)
+	}
+}
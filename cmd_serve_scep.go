@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdServeSCEP(p *program.Program) {
+	c := p.AddCommand("serve-scep", "run a scep enrollment server issuing "+
+		"certificates with the ca set in the configuration", cmdServeSCEP)
+
+	c.AddOption("", "address", "address", "localhost:8083",
+		"the address to listen on")
+}
+
+func cmdServeSCEP(p *program.Program) {
+	cfg, err := pki.SCEPCfg()
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	issuerName := cfg.Issuer
+
+	issuerCert, err := pki.LoadCertificate(issuerName)
+	if err != nil {
+		p.Fatal("cannot load issuer certificate: %v", err)
+	}
+
+	if !issuerCert.IsCA {
+		p.Fatal("certificate %q is not a ca certificate", issuerName)
+	}
+
+	issuerKey, err := pki.LoadPrivateKey(issuerName,
+		func() ([]byte, error) {
+			return ReadPrivateKeyPassword(issuerName)
+		})
+	if err != nil {
+		p.Fatal("cannot load issuer private key: %v", err)
+	}
+
+	raCert, raKey, err := pki.LoadSCEPRA(cfg, issuerCert)
+	if err != nil {
+		p.Fatal("cannot load scep ra certificate: %v", err)
+	}
+
+	if raCert == nil {
+		raCert, raKey, err = pki.CreateSCEPRA(cfg, issuerCert, issuerKey)
+		if err != nil {
+			p.Fatal("cannot create scep ra certificate: %v", err)
+		}
+
+		p.Info("created scep ra certificate %q", cfg.RACertificate)
+	}
+
+	server, err := NewSCEPServer(pki, cfg, issuerCert, issuerKey,
+		raCert, raKey)
+	if err != nil {
+		p.Fatal("cannot create scep server: %v", err)
+	}
+
+	// The server only locks the pki when it issues a certificate so that
+	// other commands can run.
+	if err := pki.Unlock(); err != nil {
+		p.Fatal("cannot unlock pki: %v", err)
+	}
+
+	address := p.OptionValue("address")
+
+	httpServer := http.Server{
+		Addr:    address,
+		Handler: server,
+	}
+
+	p.Info("listening on %s", address)
+
+	if err := httpServer.ListenAndServe(); err != nil {
+		p.Fatal("cannot run http server: %v", err)
+	}
+}
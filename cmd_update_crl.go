@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdUpdateCRL(p *program.Program) {
+	c := p.AddCommand("update-crl", "sign the crl of a ca again",
+		cmdUpdateCRL)
+
+	c.AddFlag("a", "all", "update the crls of all cas")
+	c.AddFlag("", "delta", "only update delta crls")
+
+	c.AddOptionalArgument("issuer", "the name, serial:<hex>, sha256:<hex> "+
+		"or path of the ca certificate")
+}
+
+func cmdUpdateCRL(p *program.Program) {
+	delta := p.IsOptionSet("delta")
+
+	var names []string
+
+	switch {
+	case p.IsOptionSet("all") && p.IsArgumentSet("issuer"):
+		p.Fatal("cannot use both an issuer and --all")
+
+	case p.IsOptionSet("all"):
+		caNames, err := pki.CANames()
+		if err != nil {
+			p.Fatal("cannot list cas: %v", err)
+		}
+
+		for _, name := range caNames {
+			if delta && pki.CACfg(name).DeltaCRLs == nil {
+				continue
+			}
+
+			names = append(names, name)
+		}
+
+	case p.IsArgumentSet("issuer"):
+		name, err := pki.ResolveCertificateName(
+			p.ArgumentValue("issuer"))
+		if err != nil {
+			p.Fatal("cannot find issuer certificate: %v", err)
+		}
+
+		names = []string{name}
+
+	default:
+		p.Fatal("missing issuer or --all")
+	}
+
+	for _, name := range names {
+		updateCRL(p, name, delta)
+	}
+}
+
+func updateCRL(p *program.Program, name string, delta bool) {
+	cert, err := pki.LoadCertificate(name)
+	if err != nil {
+		p.Fatal("cannot load certificate: %v", err)
+	}
+
+	if !cert.IsCA {
+		p.Fatal("certificate %q is not a ca certificate", name)
+	}
+
+	if delta && pki.CACfg(name).DeltaCRLs == nil {
+		p.Fatal("delta crls are not enabled for %q", name)
+	}
+
+	crlType := ObjectTypeCRL
+	loadCRLData := pki.LoadCRLData
+	update := pki.UpdateCRL
+
+	if delta {
+		crlType = ObjectTypeDeltaCRL
+		loadCRLData = pki.LoadDeltaCRLData
+		update = pki.UpdateDeltaCRL
+	}
+
+	crlData, err := loadCRLData(name)
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	// If the crl was about to expire when we update it, the update
+	// interval is probably too long compared to the lifetime of the crl.
+	now := time.Now()
+	nextUpdate := crlData.ExpirationDate
+
+	if !nextUpdate.IsZero() {
+		if nextUpdate.Before(now) {
+			p.Error("%s %q expired on %s", crlType, name,
+				nextUpdate.Format(time.RFC3339))
+		} else if crlCloseToExpiry(crlData.CreationDate, nextUpdate,
+			now) {
+			p.Error("%s %q was close to expiry (next update: %s)",
+				crlType, name, nextUpdate.Format(time.RFC3339))
+		}
+	}
+
+	key, err := pki.LoadPrivateKey(name, func() ([]byte, error) {
+		return ReadPrivateKeyPassword(name)
+	})
+	if err != nil {
+		p.Fatal("cannot load private key: %v", err)
+	}
+
+	if _, err := update(name, cert, key, crlData); err != nil {
+		p.Fatal("cannot update %s: %v", crlType, err)
+	}
+}
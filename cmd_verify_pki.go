@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/galdor/go-program"
+)
+
+func addCmdVerifyPKI(p *program.Program) {
+	p.AddCommand("verify-pki", "check the integrity of the pki",
+		cmdVerifyPKI)
+}
+
+func cmdVerifyPKI(p *program.Program) {
+	report, err := pki.Verify()
+	if err != nil {
+		p.Fatal("cannot verify pki: %v", err)
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println(problem.String())
+	}
+
+	if n := report.NbErrors(); n > 0 {
+		p.Fatal("%d error(s) found", n)
+	}
+
+	p.Info("no error found")
+}
@@ -0,0 +1,1150 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// See RFC 5652. Enrollment protocols transport certificates and requests in
+// CMS structures; the Go standard library does not support CMS, so we encode
+// and decode the structures we need ourselves.
+//
+// Only key transport recipients with RSA keys are supported for enveloped
+// data, since this is what enrollment clients use.
+
+var (
+	oidCMSData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCMSSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidCMSEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidCMSAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidCMSAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidCMSAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidEncryptionRSA          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSignatureRSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSignatureRSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureRSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSignatureRSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidPublicKeyECDSA         = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidSignatureECDSAWithSHA1 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+
+	oidCipherDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidCipherAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidCipherAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidCipherAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type cmsEnvelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo cmsEncryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsKeyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type cmsEncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// The asn1 package does not handle explicit tags on raw values, so
+// explicitly tagged content is wrapped and unwrapped manually.
+func cmsExplicitContent(data []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      data,
+	}
+}
+
+func marshalCMSContentInfo(contentType asn1.ObjectIdentifier, content interface{}) ([]byte, error) {
+	contentData, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	contentInfo := cmsContentInfo{
+		ContentType: contentType,
+		Content:     cmsExplicitContent(contentData),
+	}
+
+	return asn1.Marshal(contentInfo)
+}
+
+// Decode a content info structure, returning the der data of its content.
+// BER data, which some clients still produce, are converted first.
+func unmarshalCMSContentInfo(data []byte, contentType asn1.ObjectIdentifier) ([]byte, error) {
+	derData, err := berToDER(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentInfo cmsContentInfo
+	if rest, err := asn1.Unmarshal(derData, &contentInfo); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after content info")
+	}
+
+	if !contentInfo.ContentType.Equal(contentType) {
+		return nil, fmt.Errorf("unexpected content type %v",
+			contentInfo.ContentType)
+	}
+
+	return contentInfo.Content.Bytes, nil
+}
+
+func cmsCertificates(certs []*x509.Certificate) asn1.RawValue {
+	var certsData []byte
+	for _, cert := range certs {
+		certsData = append(certsData, cert.Raw...)
+	}
+
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      certsData,
+	}
+}
+
+// Create a degenerate signed data structure, i.e. one without any signer,
+// used to transport a set of certificates (RFC 5652 5.2).
+func CreateCertsOnlyCMS(certs []*x509.Certificate) ([]byte, error) {
+	signedData := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		EncapContentInfo: cmsEncapsulatedContentInfo{
+			ContentType: oidCMSData,
+		},
+		Certificates: cmsCertificates(certs),
+		SignerInfos:  []cmsSignerInfo{},
+	}
+
+	data, err := marshalCMSContentInfo(oidCMSSignedData, signedData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode signed data: %w", err)
+	}
+
+	return data, nil
+}
+
+// Signed data
+
+type CMSSignedData struct {
+	// Nil if the signed data structure does not have any content
+	Content []byte
+
+	Certificates []*x509.Certificate
+
+	// Set once the signature has been verified
+	SignerCertificate *x509.Certificate
+	DigestAlgorithm   crypto.Hash
+	SignedAttributes  []CMSAttribute
+
+	signedData cmsSignedData
+}
+
+type CMSAttribute struct {
+	Type asn1.ObjectIdentifier
+
+	// The der data of the value
+	Value []byte
+}
+
+func NewCMSAttribute(oid asn1.ObjectIdentifier, value interface{}) (CMSAttribute, error) {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return CMSAttribute{}, fmt.Errorf("cannot encode attribute %v: %w",
+			oid, err)
+	}
+
+	return CMSAttribute{Type: oid, Value: data}, nil
+}
+
+func ParseCMSSignedData(data []byte) (*CMSSignedData, error) {
+	contentData, err := unmarshalCMSContentInfo(data, oidCMSSignedData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content info: %w", err)
+	}
+
+	var sd CMSSignedData
+
+	if _, err := asn1.Unmarshal(contentData, &sd.signedData); err != nil {
+		return nil, fmt.Errorf("invalid signed data: %w", err)
+	}
+
+	if content := sd.signedData.EncapContentInfo.Content; len(content.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(content.Bytes,
+			&sd.Content); err != nil {
+			return nil, fmt.Errorf("invalid content: %w", err)
+		}
+	}
+
+	if certsData := sd.signedData.Certificates.Bytes; len(certsData) > 0 {
+		certs, err := x509.ParseCertificates(certsData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificates: %w", err)
+		}
+
+		sd.Certificates = certs
+	}
+
+	return &sd, nil
+}
+
+// Verify the signature of the only signer of the data. The signer
+// certificate must be part of the certificates of the structure; it is not
+// verified since enrollment requests are usually signed with self-signed
+// certificates.
+func (sd *CMSSignedData) Verify() error {
+	if len(sd.signedData.SignerInfos) != 1 {
+		return fmt.Errorf("signed data contain %d signers instead of one",
+			len(sd.signedData.SignerInfos))
+	}
+
+	si := &sd.signedData.SignerInfos[0]
+
+	cert, err := sd.findSignerCertificate(si.SID)
+	if err != nil {
+		return err
+	}
+
+	hash, err := cmsDigestAlgorithm(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	// Enrollment messages always encapsulate data
+	contentType := sd.signedData.EncapContentInfo.ContentType
+	if !contentType.Equal(oidCMSData) {
+		return fmt.Errorf("unsupported content type %v", contentType)
+	}
+
+	// Without content (e.g. SCEP failure responses), signed attributes
+	// contain the digest of empty data.
+	content := sd.Content
+	if content == nil && len(si.SignedAttrs.FullBytes) == 0 {
+		return errors.New("missing content")
+	}
+
+	signedData := content
+
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		attrs, err := parseCMSAttributes(si.SignedAttrs.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid signed attributes: %w", err)
+		}
+
+		// RFC 5652 5.3: the content type and message digest
+		// attributes are mandatory.
+		contentTypeData := findCMSAttribute(attrs,
+			oidCMSAttributeContentType)
+		if contentTypeData == nil {
+			return errors.New("missing content type attribute")
+		}
+
+		var attrContentType asn1.ObjectIdentifier
+		if rest, err := asn1.Unmarshal(contentTypeData,
+			&attrContentType); err != nil {
+			return fmt.Errorf("invalid content type: %w", err)
+		} else if len(rest) > 0 {
+			return errors.New("invalid content type: trailing data")
+		}
+
+		if !attrContentType.Equal(contentType) {
+			return fmt.Errorf("content type attribute %v does not "+
+				"match content type %v", attrContentType, contentType)
+		}
+
+		digestData := findCMSAttribute(attrs,
+			oidCMSAttributeMessageDigest)
+		if digestData == nil {
+			return errors.New("missing message digest attribute")
+		}
+
+		var expectedDigest []byte
+		if rest, err := asn1.Unmarshal(digestData,
+			&expectedDigest); err != nil {
+			return fmt.Errorf("invalid message digest: %w", err)
+		} else if len(rest) > 0 {
+			return errors.New("invalid message digest: trailing data")
+		}
+
+		h := hash.New()
+		h.Write(content)
+		if !bytes.Equal(h.Sum(nil), expectedDigest) {
+			return errors.New("message digest mismatch")
+		}
+
+		// RFC 5652 5.4: the signature is computed on the der encoding
+		// of the attributes as a SET OF, not as an implicitly tagged
+		// value.
+		signedData = append([]byte{0x31},
+			si.SignedAttrs.FullBytes[1:]...)
+
+		sd.SignedAttributes = attrs
+	}
+
+	if err := verifyCMSSignature(cert.PublicKey, si.SignatureAlgorithm,
+		hash, signedData, si.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	sd.SignerCertificate = cert
+	sd.DigestAlgorithm = hash
+
+	return nil
+}
+
+func (sd *CMSSignedData) findSignerCertificate(sid asn1.RawValue) (*x509.Certificate, error) {
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		for _, cert := range sd.Certificates {
+			if bytes.Equal(cert.SubjectKeyId, sid.Bytes) {
+				return cert, nil
+			}
+		}
+	} else {
+		var ias cmsIssuerAndSerialNumber
+		if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+			return nil, fmt.Errorf("invalid signer identifier: %w", err)
+		}
+
+		for _, cert := range sd.Certificates {
+			if bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) &&
+				cert.SerialNumber.Cmp(ias.SerialNumber) == 0 {
+				return cert, nil
+			}
+		}
+	}
+
+	return nil, errors.New("signer certificate not found")
+}
+
+// Return the value of a signed attribute, or nil if it is not set.
+func (sd *CMSSignedData) SignedAttribute(oid asn1.ObjectIdentifier) []byte {
+	return findCMSAttribute(sd.SignedAttributes, oid)
+}
+
+func findCMSAttribute(attrs []CMSAttribute, oid asn1.ObjectIdentifier) []byte {
+	for _, attr := range attrs {
+		if attr.Type.Equal(oid) {
+			return attr.Value
+		}
+	}
+
+	return nil
+}
+
+// Parse the content of a SET OF attributes. Each attribute type can only
+// appear once, so that all readers agree on the value of an attribute.
+func parseCMSAttributes(data []byte) ([]CMSAttribute, error) {
+	var attrs []CMSAttribute
+
+	types := make(map[string]bool)
+
+	for len(data) > 0 {
+		var attr cmsAttribute
+
+		rest, err := asn1.Unmarshal(data, &attr)
+		if err != nil {
+			return nil, err
+		}
+
+		data = rest
+
+		if types[attr.Type.String()] {
+			return nil, fmt.Errorf("duplicate attribute %v", attr.Type)
+		}
+
+		types[attr.Type.String()] = true
+
+		if attr.Values.Tag != asn1.TagSet {
+			return nil, fmt.Errorf("invalid values for attribute %v",
+				attr.Type)
+		}
+
+		// Attributes used in enrollment messages are single-valued
+		var value asn1.RawValue
+		if rest, err := asn1.Unmarshal(attr.Values.Bytes,
+			&value); err != nil {
+			return nil, fmt.Errorf("invalid value for attribute %v: %w",
+				attr.Type, err)
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("multiple values for attribute %v",
+				attr.Type)
+		}
+
+		attrs = append(attrs, CMSAttribute{
+			Type:  attr.Type,
+			Value: value.FullBytes,
+		})
+	}
+
+	return attrs, nil
+}
+
+// Encode attributes as the content of a DER SET OF, whose elements must be
+// sorted.
+func encodeCMSAttributes(attrs []CMSAttribute) ([]byte, error) {
+	encodedAttrs := make([][]byte, len(attrs))
+
+	for i, attr := range attrs {
+		data, err := asn1.Marshal(cmsAttribute{
+			Type: attr.Type,
+			Values: asn1.RawValue{
+				Class:      asn1.ClassUniversal,
+				Tag:        asn1.TagSet,
+				IsCompound: true,
+				Bytes:      attr.Value,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode attribute %v: %w",
+				attr.Type, err)
+		}
+
+		encodedAttrs[i] = data
+	}
+
+	sort.Slice(encodedAttrs, func(i, j int) bool {
+		return bytes.Compare(encodedAttrs[i], encodedAttrs[j]) < 0
+	})
+
+	return bytes.Join(encodedAttrs, nil), nil
+}
+
+// Create a signed data structure with a single signer. If content is nil,
+// the structure does not contain any content, but the message digest
+// attribute is still computed on an empty content.
+func CreateCMSSignedData(content []byte, certs []*x509.Certificate, signerCert *x509.Certificate, signerKey crypto.Signer, hash crypto.Hash, attrs []CMSAttribute) ([]byte, error) {
+	digestAlgorithm, err := cmsDigestAlgorithmIdentifier(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(content)
+
+	contentTypeAttr, err := NewCMSAttribute(oidCMSAttributeContentType,
+		oidCMSData)
+	if err != nil {
+		return nil, err
+	}
+
+	digestAttr, err := NewCMSAttribute(oidCMSAttributeMessageDigest,
+		h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs = append([]CMSAttribute{contentTypeAttr, digestAttr}, attrs...)
+
+	attrsData, err := encodeCMSAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      attrsData,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode signed attributes: %w", err)
+	}
+
+	signatureAlgorithm, signature, err := signCMSData(signerKey, hash,
+		signedAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign data: %w", err)
+	}
+
+	sid, err := asn1.Marshal(cmsIssuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: signerCert.RawIssuer},
+		SerialNumber: signerCert.SerialNumber,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode signer identifier: %w", err)
+	}
+
+	signedData := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: cmsEncapsulatedContentInfo{
+			ContentType: oidCMSData,
+		},
+		Certificates: cmsCertificates(certs),
+		SignerInfos: []cmsSignerInfo{{
+			Version:         1,
+			SID:             asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm: digestAlgorithm,
+			SignedAttrs: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      attrsData,
+			},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	}
+
+	if content != nil {
+		contentData, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode content: %w", err)
+		}
+
+		signedData.EncapContentInfo.Content = cmsExplicitContent(contentData)
+	}
+
+	data, err := marshalCMSContentInfo(oidCMSSignedData, signedData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode signed data: %w", err)
+	}
+
+	return data, nil
+}
+
+func cmsDigestAlgorithm(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidHashSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidHashSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidHashSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidHashSHA512):
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported digest algorithm %v", oid)
+	}
+}
+
+func cmsDigestAlgorithmIdentifier(hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+
+	switch hash {
+	case crypto.SHA1:
+		oid = oidHashSHA1
+	case crypto.SHA256:
+		oid = oidHashSHA256
+	case crypto.SHA384:
+		oid = oidHashSHA384
+	case crypto.SHA512:
+		oid = oidHashSHA512
+	default:
+		return pkix.AlgorithmIdentifier{},
+			fmt.Errorf("unsupported digest algorithm %v", hash)
+	}
+
+	return pkix.AlgorithmIdentifier{Algorithm: oid}, nil
+}
+
+// SHA-1 signatures are still accepted: legacy enrollment clients use them,
+// and requests are authenticated by other means.
+func verifyCMSSignature(publicKey crypto.PublicKey, algorithm pkix.AlgorithmIdentifier, hash crypto.Hash, data, signature []byte) error {
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		oid := algorithm.Algorithm
+		if !oid.Equal(oidEncryptionRSA) &&
+			!oid.Equal(oidSignatureRSAWithSHA1) &&
+			!oid.Equal(oidSignatureRSAWithSHA256) &&
+			!oid.Equal(oidSignatureRSAWithSHA384) &&
+			!oid.Equal(oidSignatureRSAWithSHA512) {
+			return fmt.Errorf("unsupported signature algorithm %v", oid)
+		}
+
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+
+	case *ecdsa.PublicKey:
+		oid := algorithm.Algorithm
+		if !oid.Equal(oidPublicKeyECDSA) &&
+			!oid.Equal(oidSignatureECDSAWithSHA1) &&
+			!oid.Equal(oidSignatureECDSAWithSHA256) &&
+			!oid.Equal(oidSignatureECDSAWithSHA384) &&
+			!oid.Equal(oidSignatureECDSAWithSHA512) {
+			return fmt.Errorf("unsupported signature algorithm %v", oid)
+		}
+
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("verification failure")
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+func signCMSData(key crypto.Signer, hash crypto.Hash, data []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	var algorithm pkix.AlgorithmIdentifier
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm.Algorithm = oidEncryptionRSA
+		algorithm.Parameters = asn1.NullRawValue
+
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA1:
+			algorithm.Algorithm = oidSignatureECDSAWithSHA1
+		case crypto.SHA256:
+			algorithm.Algorithm = oidSignatureECDSAWithSHA256
+		case crypto.SHA384:
+			algorithm.Algorithm = oidSignatureECDSAWithSHA384
+		default:
+			algorithm.Algorithm = oidSignatureECDSAWithSHA512
+		}
+
+	default:
+		return algorithm, nil, fmt.Errorf("unsupported key type %T",
+			key.Public())
+	}
+
+	h := hash.New()
+	h.Write(data)
+
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return algorithm, nil, err
+	}
+
+	return algorithm, signature, nil
+}
+
+// Enveloped data
+
+type CMSEnvelopedData struct {
+	// The content encryption algorithm, which can be reused to encrypt
+	// responses
+	ContentEncryptionAlgorithm asn1.ObjectIdentifier
+
+	envelopedData cmsEnvelopedData
+}
+
+func ParseCMSEnvelopedData(data []byte) (*CMSEnvelopedData, error) {
+	contentData, err := unmarshalCMSContentInfo(data, oidCMSEnvelopedData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content info: %w", err)
+	}
+
+	var ed CMSEnvelopedData
+
+	if _, err := asn1.Unmarshal(contentData, &ed.envelopedData); err != nil {
+		return nil, fmt.Errorf("invalid enveloped data: %w", err)
+	}
+
+	ed.ContentEncryptionAlgorithm = ed.envelopedData.EncryptedContentInfo.
+		ContentEncryptionAlgorithm.Algorithm
+
+	return &ed, nil
+}
+
+// Decrypt the content of enveloped data for a recipient.
+func (ed *CMSEnvelopedData) Decrypt(cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	var recipient *cmsKeyTransRecipientInfo
+
+	for _, ri := range ed.envelopedData.RecipientInfos {
+		// Key transport recipient infos are the only ones which are
+		// not tagged.
+		if ri.Class != asn1.ClassUniversal {
+			continue
+		}
+
+		var ktri cmsKeyTransRecipientInfo
+		if _, err := asn1.Unmarshal(ri.FullBytes, &ktri); err != nil {
+			return nil, fmt.Errorf("invalid recipient info: %w", err)
+		}
+
+		if cmsIdentifiesCertificate(ktri.RID, cert) {
+			recipient = &ktri
+			break
+		}
+	}
+
+	if recipient == nil {
+		return nil, errors.New("no recipient info found for the " +
+			"certificate")
+	}
+
+	if !recipient.KeyEncryptionAlgorithm.Algorithm.Equal(oidEncryptionRSA) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm %v",
+			recipient.KeyEncryptionAlgorithm.Algorithm)
+	}
+
+	eci := &ed.envelopedData.EncryptedContentInfo
+	algorithm := eci.ContentEncryptionAlgorithm
+
+	keySize, err := cmsContentEncryptionKeySize(algorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes,
+		&iv); err != nil {
+		return nil, fmt.Errorf("invalid initialization vector: %w", err)
+	}
+
+	// An invalid encrypted key is not reported as an error, and leads to
+	// invalid content instead (RFC 3218). The errors returned by this
+	// function still reveal whether the padding of the content is valid:
+	// callers must not let clients distinguish them from errors caused by
+	// invalid content, otherwise they provide a CBC padding oracle.
+	contentKey := make([]byte, keySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, fmt.Errorf("cannot generate random key: %w", err)
+	}
+
+	if err := rsa.DecryptPKCS1v15SessionKey(nil, key,
+		recipient.EncryptedKey, contentKey); err != nil {
+		return nil, fmt.Errorf("cannot decrypt content key: %w", err)
+	}
+
+	block, err := cmsContentCipher(algorithm.Algorithm, contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The encrypted content is an implicitly tagged octet string, which
+	// can be made of several segments.
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		ciphertext, err = concatBERSegments(ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted content: %w", err)
+		}
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted content length")
+	}
+
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid initialization vector length")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	return removePKCS7Padding(plaintext, block.BlockSize())
+}
+
+func cmsIdentifiesCertificate(id asn1.RawValue, cert *x509.Certificate) bool {
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 &&
+			bytes.Equal(id.Bytes, cert.SubjectKeyId)
+	}
+
+	var ias cmsIssuerAndSerialNumber
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+		return false
+	}
+
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) &&
+		ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// Create enveloped data for a single recipient with a RSA key.
+func CreateCMSEnvelopedData(content []byte, recipientCert *x509.Certificate, algorithm asn1.ObjectIdentifier) ([]byte, error) {
+	publicKey, ok := recipientCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported recipient public key type %T",
+			recipientCert.PublicKey)
+	}
+
+	keySize, err := cmsContentEncryptionKeySize(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	contentKey := make([]byte, keySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, fmt.Errorf("cannot generate random key: %w", err)
+	}
+
+	block, err := cmsContentCipher(algorithm, contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("cannot generate initialization vector: %w",
+			err)
+	}
+
+	plaintext := addPKCS7Padding(content, block.BlockSize())
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey,
+		contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt content key: %w", err)
+	}
+
+	rid, err := asn1.Marshal(cmsIssuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: recipientCert.RawIssuer},
+		SerialNumber: recipientCert.SerialNumber,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode recipient identifier: %w",
+			err)
+	}
+
+	ri, err := asn1.Marshal(cmsKeyTransRecipientInfo{
+		Version: 0,
+		RID:     asn1.RawValue{FullBytes: rid},
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidEncryptionRSA,
+			Parameters: asn1.NullRawValue,
+		},
+		EncryptedKey: encryptedKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode recipient info: %w", err)
+	}
+
+	ivData, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode initialization vector: %w",
+			err)
+	}
+
+	envelopedData := cmsEnvelopedData{
+		Version:        0,
+		RecipientInfos: []asn1.RawValue{{FullBytes: ri}},
+		EncryptedContentInfo: cmsEncryptedContentInfo{
+			ContentType: oidCMSData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  algorithm,
+				Parameters: asn1.RawValue{FullBytes: ivData},
+			},
+			EncryptedContent: asn1.RawValue{
+				Class: asn1.ClassContextSpecific,
+				Tag:   0,
+				Bytes: ciphertext,
+			},
+		},
+	}
+
+	data, err := marshalCMSContentInfo(oidCMSEnvelopedData, envelopedData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode enveloped data: %w", err)
+	}
+
+	return data, nil
+}
+
+func cmsContentEncryptionKeySize(oid asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case oid.Equal(oidCipherDESEDE3CBC):
+		return 24, nil
+	case oid.Equal(oidCipherAES128CBC):
+		return 16, nil
+	case oid.Equal(oidCipherAES192CBC):
+		return 24, nil
+	case oid.Equal(oidCipherAES256CBC):
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("unsupported content encryption algorithm %v",
+			oid)
+	}
+}
+
+func cmsContentCipher(oid asn1.ObjectIdentifier, key []byte) (cipher.Block, error) {
+	if oid.Equal(oidCipherDESEDE3CBC) {
+		return des.NewTripleDESCipher(key)
+	}
+
+	return aes.NewCipher(key)
+}
+
+func addPKCS7Padding(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)},
+		n)...)
+}
+
+func removePKCS7Padding(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("invalid padding")
+	}
+
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New("invalid padding")
+	}
+
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("invalid padding")
+		}
+	}
+
+	return data[:len(data)-n], nil
+}
+
+// BER encoding
+
+// Convert BER data to DER: indefinite lengths are replaced by definite ones,
+// and constructed universal strings are replaced by primitive ones. Other
+// BER features (e.g. unsorted sets) are not relevant for the structures we
+// decode.
+func berToDER(data []byte) ([]byte, error) {
+	der, rest, err := berElementToDER(data, 0)
+	if err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after ber element")
+	}
+
+	return der, nil
+}
+
+const maxBERDepth = 64
+
+func berElementToDER(data []byte, depth int) ([]byte, []byte, error) {
+	if depth > maxBERDepth {
+		return nil, nil, errors.New("ber data nested too deeply")
+	}
+
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated ber element")
+	}
+
+	identifierEnd := 1
+	if data[0]&0x1f == 0x1f {
+		for identifierEnd < len(data) && data[identifierEnd]&0x80 != 0 {
+			identifierEnd++
+		}
+
+		identifierEnd++
+		if identifierEnd >= len(data) {
+			return nil, nil, errors.New("truncated ber identifier")
+		}
+	}
+
+	identifier := data[:identifierEnd]
+	constructed := data[0]&0x20 != 0
+	data = data[identifierEnd:]
+
+	var content []byte
+
+	if data[0] == 0x80 {
+		// Indefinite length: the content is a sequence of elements
+		// terminated by an end-of-contents element.
+		if !constructed {
+			return nil, nil, errors.New("indefinite length for " +
+				"primitive ber element")
+		}
+
+		data = data[1:]
+
+		for {
+			if len(data) < 2 {
+				return nil, nil, errors.New("truncated ber element")
+			}
+
+			if data[0] == 0 && data[1] == 0 {
+				data = data[2:]
+				break
+			}
+
+			child, rest, err := berElementToDER(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			content = append(content, child...)
+			data = rest
+		}
+	} else {
+		length := int(data[0])
+		data = data[1:]
+
+		if length&0x80 != 0 {
+			nbBytes := length & 0x7f
+			if nbBytes > 4 || nbBytes > len(data) {
+				return nil, nil, errors.New("invalid ber length")
+			}
+
+			length = 0
+			for _, b := range data[:nbBytes] {
+				length = length<<8 | int(b)
+			}
+
+			data = data[nbBytes:]
+		}
+
+		if length < 0 || length > len(data) {
+			return nil, nil, errors.New("truncated ber element")
+		}
+
+		value := data[:length]
+		data = data[length:]
+
+		if constructed {
+			for len(value) > 0 {
+				child, rest, err := berElementToDER(value, depth+1)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				content = append(content, child...)
+				value = rest
+			}
+		} else {
+			content = value
+		}
+	}
+
+	// Constructed strings are made of primitive string segments
+	if constructed && identifierEnd == 1 && isBERStringTag(identifier[0]) {
+		value, err := concatBERSegments(content)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		identifier = []byte{identifier[0] &^ 0x20}
+		content = value
+	}
+
+	der := append([]byte{}, identifier...)
+	der = append(der, encodeDERLength(len(content))...)
+	der = append(der, content...)
+
+	return der, data, nil
+}
+
+func isBERStringTag(identifier byte) bool {
+	if identifier&0xc0 != 0 {
+		return false
+	}
+
+	switch int(identifier & 0x1f) {
+	case asn1.TagOctetString, asn1.TagUTF8String,
+		asn1.TagPrintableString, asn1.TagT61String, asn1.TagIA5String,
+		asn1.TagGeneralString, asn1.TagBMPString:
+		return true
+	default:
+		return false
+	}
+}
+
+func concatBERSegments(data []byte) ([]byte, error) {
+	var value []byte
+
+	for len(data) > 0 {
+		var segment asn1.RawValue
+
+		rest, err := asn1.Unmarshal(data, &segment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string segment: %w", err)
+		}
+
+		value = append(value, segment.Bytes...)
+		data = rest
+	}
+
+	return value, nil
+}
+
+func encodeDERLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+
+	var lengthBytes []byte
+	for n := length; n > 0; n >>= 8 {
+		lengthBytes = append([]byte{byte(n)}, lengthBytes...)
+	}
+
+	return append([]byte{0x80 | byte(len(lengthBytes))}, lengthBytes...)
+}
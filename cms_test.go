@@ -0,0 +1,359 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Create a self-signed certificate, as used by enrollment clients to sign
+// their requests.
+func createTestSelfSignedCertificate(t *testing.T, key crypto.Signer, commonName string) *x509.Certificate {
+	t.Helper()
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+
+	return cert
+}
+
+// Create a signed data structure with exactly the signed attributes
+// provided, unlike CreateCMSSignedData which adds mandatory attributes.
+func createTestCMSSignedData(t *testing.T, contentType asn1.ObjectIdentifier, content []byte, cert *x509.Certificate, key crypto.Signer, attrs []CMSAttribute) []byte {
+	t.Helper()
+
+	digestAlgorithm, err := cmsDigestAlgorithmIdentifier(crypto.SHA256)
+	if err != nil {
+		t.Fatalf("cannot create digest algorithm: %v", err)
+	}
+
+	attrsData, err := encodeCMSAttributes(attrs)
+	if err != nil {
+		t.Fatalf("cannot encode attributes: %v", err)
+	}
+
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      attrsData,
+	})
+	if err != nil {
+		t.Fatalf("cannot encode signed attributes: %v", err)
+	}
+
+	signatureAlgorithm, signature, err := signCMSData(key, crypto.SHA256,
+		signedAttrs)
+	if err != nil {
+		t.Fatalf("cannot sign data: %v", err)
+	}
+
+	sid, err := asn1.Marshal(cmsIssuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	})
+	if err != nil {
+		t.Fatalf("cannot encode signer identifier: %v", err)
+	}
+
+	contentData, err := asn1.Marshal(content)
+	if err != nil {
+		t.Fatalf("cannot encode content: %v", err)
+	}
+
+	signedData := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: cmsEncapsulatedContentInfo{
+			ContentType: contentType,
+			Content:     cmsExplicitContent(contentData),
+		},
+		Certificates: cmsCertificates([]*x509.Certificate{cert}),
+		SignerInfos: []cmsSignerInfo{{
+			Version:         1,
+			SID:             asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm: digestAlgorithm,
+			SignedAttrs: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      attrsData,
+			},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	}
+
+	data, err := marshalCMSContentInfo(oidCMSSignedData, signedData)
+	if err != nil {
+		t.Fatalf("cannot encode signed data: %v", err)
+	}
+
+	return data
+}
+
+func newTestCMSAttribute(t *testing.T, oid asn1.ObjectIdentifier, value interface{}) CMSAttribute {
+	t.Helper()
+
+	attr, err := NewCMSAttribute(oid, value)
+	if err != nil {
+		t.Fatalf("cannot create attribute: %v", err)
+	}
+
+	return attr
+}
+
+func TestCMSSignedDataVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	cert := createTestSelfSignedCertificate(t, key, "client")
+
+	content := []byte("hello world")
+
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+
+	dataType := newTestCMSAttribute(t, oidCMSAttributeContentType,
+		oidCMSData)
+	envelopedDataType := newTestCMSAttribute(t, oidCMSAttributeContentType,
+		oidCMSEnvelopedData)
+	validDigest := newTestCMSAttribute(t, oidCMSAttributeMessageDigest,
+		digest.Sum(nil))
+	invalidDigest := newTestCMSAttribute(t, oidCMSAttributeMessageDigest,
+		make([]byte, 32))
+
+	tests := []struct {
+		Name        string
+		ContentType asn1.ObjectIdentifier
+		Attrs       []CMSAttribute
+		Valid       bool
+	}{
+		{"valid", oidCMSData,
+			[]CMSAttribute{dataType, validDigest}, true},
+		{"missing content type", oidCMSData,
+			[]CMSAttribute{validDigest}, false},
+		{"content type mismatch", oidCMSData,
+			[]CMSAttribute{envelopedDataType, validDigest}, false},
+		{"unsupported content type", oidCMSEnvelopedData,
+			[]CMSAttribute{envelopedDataType, validDigest}, false},
+		{"missing message digest", oidCMSData,
+			[]CMSAttribute{dataType}, false},
+		{"invalid message digest", oidCMSData,
+			[]CMSAttribute{dataType, invalidDigest}, false},
+		{"duplicate message digest", oidCMSData,
+			[]CMSAttribute{dataType, validDigest, invalidDigest}, false},
+		{"duplicate content type", oidCMSData,
+			[]CMSAttribute{dataType, dataType, validDigest}, false},
+	}
+
+	for _, test := range tests {
+		data := createTestCMSSignedData(t, test.ContentType, content, cert,
+			key, test.Attrs)
+
+		sd, err := ParseCMSSignedData(data)
+		if err != nil {
+			t.Fatalf("%s: cannot parse signed data: %v", test.Name, err)
+		}
+
+		err = sd.Verify()
+		if test.Valid && err != nil {
+			t.Errorf("%s: verification failed: %v", test.Name, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("%s: verification succeeded", test.Name)
+		}
+	}
+
+	// Structures created by CreateCMSSignedData must be valid
+	data, err := CreateCMSSignedData(content, []*x509.Certificate{cert},
+		cert, key, crypto.SHA256, nil)
+	if err != nil {
+		t.Fatalf("cannot create signed data: %v", err)
+	}
+
+	sd, err := ParseCMSSignedData(data)
+	if err != nil {
+		t.Fatalf("cannot parse signed data: %v", err)
+	}
+
+	if err := sd.Verify(); err != nil {
+		t.Errorf("verification failed: %v", err)
+	}
+
+	if !bytes.Equal(sd.Content, content) {
+		t.Errorf("content is %q instead of %q", sd.Content, content)
+	}
+}
+
+func TestBERToDER(t *testing.T) {
+	tests := []struct {
+		Name string
+		BER  []byte
+		DER  []byte
+	}{
+		{"der",
+			[]byte{0x30, 0x03, 0x02, 0x01, 0x05},
+			[]byte{0x30, 0x03, 0x02, 0x01, 0x05}},
+		{"indefinite length",
+			[]byte{0x30, 0x80, 0x02, 0x01, 0x05, 0x00, 0x00},
+			[]byte{0x30, 0x03, 0x02, 0x01, 0x05}},
+		{"nested indefinite lengths",
+			[]byte{0x30, 0x80, 0x30, 0x80, 0x05, 0x00, 0x00, 0x00, 0x00,
+				0x00},
+			[]byte{0x30, 0x04, 0x30, 0x02, 0x05, 0x00}},
+		{"long form length",
+			[]byte{0x04, 0x81, 0x03, 0x61, 0x62, 0x63},
+			[]byte{0x04, 0x03, 0x61, 0x62, 0x63}},
+		{"constructed octet string",
+			[]byte{0x24, 0x08, 0x04, 0x02, 0x61, 0x62, 0x04, 0x02, 0x63,
+				0x64},
+			[]byte{0x04, 0x04, 0x61, 0x62, 0x63, 0x64}},
+		{"indefinite constructed octet string",
+			[]byte{0x30, 0x80, 0x24, 0x80, 0x04, 0x01, 0x61, 0x04, 0x01,
+				0x62, 0x00, 0x00, 0x00, 0x00},
+			[]byte{0x30, 0x04, 0x04, 0x02, 0x61, 0x62}},
+		{"tagged constructed octet string",
+			[]byte{0xa0, 0x80, 0x24, 0x80, 0x04, 0x01, 0x61, 0x00, 0x00,
+				0x00, 0x00},
+			[]byte{0xa0, 0x03, 0x04, 0x01, 0x61}},
+		{"long content",
+			append([]byte{0x30, 0x80, 0x04, 0x81, 0x80},
+				append(make([]byte, 128), 0x00, 0x00)...),
+			append([]byte{0x30, 0x81, 0x83, 0x04, 0x81, 0x80},
+				make([]byte, 128)...)},
+	}
+
+	for _, test := range tests {
+		der, err := berToDER(test.BER)
+		if err != nil {
+			t.Errorf("%s: cannot convert ber data: %v", test.Name, err)
+			continue
+		}
+
+		if !bytes.Equal(der, test.DER) {
+			t.Errorf("%s: ber data converted to %x instead of %x",
+				test.Name, der, test.DER)
+		}
+	}
+
+	invalidTests := []struct {
+		Name string
+		BER  []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated element", []byte{0x30, 0x05, 0x02, 0x01}},
+		{"truncated length", []byte{0x04, 0x82, 0x01}},
+		{"oversized length", []byte{0x04, 0x85, 0x01, 0x00, 0x00, 0x00,
+			0x00}},
+		{"missing end of contents", []byte{0x30, 0x80, 0x02, 0x01, 0x05}},
+		{"indefinite primitive element", []byte{0x04, 0x80, 0x61, 0x00,
+			0x00}},
+		{"trailing data", []byte{0x30, 0x00, 0x00}},
+		{"invalid string segment", []byte{0x24, 0x03, 0x30, 0x01, 0x00}},
+	}
+
+	for _, test := range invalidTests {
+		if _, err := berToDER(test.BER); err == nil {
+			t.Errorf("%s: invalid ber data converted", test.Name)
+		}
+	}
+}
+
+func TestBERToDERDepth(t *testing.T) {
+	nestedBER := func(depth int) []byte {
+		data := bytes.Repeat([]byte{0x30, 0x80}, depth)
+		data = append(data, 0x05, 0x00)
+		return append(data, make([]byte, depth*2)...)
+	}
+
+	// The outermost element has a depth of zero, so the innermost element
+	// has the depth of the number of sequences containing it.
+	if _, err := berToDER(nestedBER(maxBERDepth)); err != nil {
+		t.Errorf("cannot convert ber data with the maximum depth: %v", err)
+	}
+
+	if _, err := berToDER(nestedBER(maxBERDepth + 1)); err == nil {
+		t.Errorf("ber data nested too deeply converted")
+	}
+
+	if _, err := berToDER(nestedBER(100000)); err == nil {
+		t.Errorf("ber data nested too deeply converted")
+	}
+}
+
+func TestPKCS7Padding(t *testing.T) {
+	for n := 0; n <= 33; n++ {
+		data := bytes.Repeat([]byte{0xff}, n)
+
+		paddedData := addPKCS7Padding(data, 16)
+		if len(paddedData)%16 != 0 || len(paddedData) <= n {
+			t.Errorf("invalid padded length %d for %d bytes",
+				len(paddedData), n)
+			continue
+		}
+
+		unpaddedData, err := removePKCS7Padding(paddedData, 16)
+		if err != nil {
+			t.Errorf("cannot remove padding of %d bytes: %v", n, err)
+		} else if !bytes.Equal(unpaddedData, data) {
+			t.Errorf("padding of %d bytes removed as %x", n, unpaddedData)
+		}
+	}
+
+	invalidTests := []struct {
+		Name string
+		Data []byte
+	}{
+		{"empty", []byte{}},
+		{"zero padding length", []byte{0x61, 0x00}},
+		{"padding larger than the block size",
+			append(bytes.Repeat([]byte{0x11}, 16), 0x11)},
+		{"padding larger than the data", []byte{0x03, 0x03}},
+		{"inconsistent padding", []byte{0x61, 0x02, 0x03, 0x03}},
+	}
+
+	for _, test := range invalidTests {
+		if _, err := removePKCS7Padding(test.Data, 16); err == nil {
+			t.Errorf("%s: invalid padding removed", test.Name)
+		}
+	}
+}
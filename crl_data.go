@@ -25,53 +25,285 @@ import (
 type CRLRevokedCert struct {
 	SerialNumber   big.Int
 	RevocationDate time.Time
+	Reason         RevocationReason
+	InvalidityDate time.Time // optional
 }
 
 type CRLData struct {
 	RevokedCerts   []CRLRevokedCert
 	CreationDate   time.Time
 	ExpirationDate time.Time
+
+	// The CRL number is assigned when the CRL is generated
+	Number *big.Int
+
+	// If not set, the default algorithm for the key of the issuer is used
+	SignatureAlgorithm x509.SignatureAlgorithm
+
+	// Delta CRLs contain the number of the complete CRL they are based on
+	BaseNumber *big.Int
+
+	// Complete CRLs reference the location of delta CRLs if there are any
+	FreshestCRLURIs []string
+
+	// Set if entries of expired certificates are pruned from the CRL
+	ExpiredCertsOnCRL time.Time
+}
+
+func (crl *CRLData) IsDelta() bool {
+	return crl.BaseNumber != nil
 }
 
 func (crl *CRLData) AddRevokedCertificate(rc CRLRevokedCert) {
 	crl.RevokedCerts = append(crl.RevokedCerts, rc)
 }
 
+// Add a revoked certificate, replacing the existing entry for the same
+// serial number if there is one.
+func (crl *CRLData) SetRevokedCertificate(rc CRLRevokedCert) {
+	crl.RemoveRevokedCert(&rc.SerialNumber)
+	crl.AddRevokedCertificate(rc)
+}
+
+// Apply the entries of a delta CRL: certificates marked with the
+// removeFromCRL reason are removed, other entries are added, replacing any
+// existing entry for the same certificate (e.g. when a certificate on hold
+// is permanently revoked).
+func (crl *CRLData) MergeRevokedCerts(deltaCRL *CRLData) {
+	for _, rc := range deltaCRL.RevokedCerts {
+		if rc.Reason == RevocationReasonRemoveFromCRL {
+			crl.RemoveRevokedCert(&rc.SerialNumber)
+		} else {
+			crl.SetRevokedCertificate(rc)
+		}
+	}
+}
+
+func (crl *CRLData) RemoveRevokedCert(serialNumber *big.Int) bool {
+	for i := range crl.RevokedCerts {
+		if crl.RevokedCerts[i].SerialNumber.Cmp(serialNumber) == 0 {
+			crl.RevokedCerts = append(crl.RevokedCerts[:i],
+				crl.RevokedCerts[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (crl *CRLData) RevokedCert(serialNumber *big.Int) *CRLRevokedCert {
+	for i := range crl.RevokedCerts {
+		rc := &crl.RevokedCerts[i]
+
+		if rc.SerialNumber.Cmp(serialNumber) == 0 {
+			return rc
+		}
+	}
+
+	return nil
+}
+
 func (crl *CRLData) Read(data []byte) error {
-	cl, err := x509.ParseCRL(data)
+	rl, err := x509.ParseRevocationList(data)
 	if err != nil {
 		return fmt.Errorf("cannot parse crl: %w", err)
 	}
 
-	crl.CreationDate = cl.TBSCertList.ThisUpdate
-	crl.ExpirationDate = cl.TBSCertList.NextUpdate
+	crl.CreationDate = rl.ThisUpdate
+	crl.ExpirationDate = rl.NextUpdate
+	crl.Number = rl.Number
+	crl.SignatureAlgorithm = rl.SignatureAlgorithm
+
+	if err := crl.readExtensions(rl.Extensions); err != nil {
+		return err
+	}
 
-	crl.RevokedCerts = make([]CRLRevokedCert,
-		len(cl.TBSCertList.RevokedCertificates))
+	crl.RevokedCerts = make([]CRLRevokedCert, len(rl.RevokedCertificates))
 
-	for i, pkixRc := range cl.TBSCertList.RevokedCertificates {
+	for i, pkixRc := range rl.RevokedCertificates {
 		rc := CRLRevokedCert{
 			RevocationDate: pkixRc.RevocationTime,
 			SerialNumber:   *pkixRc.SerialNumber,
 		}
 
+		if err := rc.readExtensions(pkixRc.Extensions); err != nil {
+			return fmt.Errorf("invalid entry for serial number %s: %w",
+				serialNumberString(pkixRc.SerialNumber), err)
+		}
+
 		crl.RevokedCerts[i] = rc
 	}
 
 	return nil
 }
 
-func (crl *CRLData) PKIXRevokedCerts() []pkix.RevokedCertificate {
+func (crl *CRLData) readExtensions(exts []pkix.Extension) error {
+	for _, ext := range exts {
+		switch {
+		case ext.Id.Equal(oidExtDeltaCRLIndicator):
+			var indicator ExtDeltaCRLIndicator
+			if err := indicator.Decode(ext.Value); err != nil {
+				return fmt.Errorf("invalid delta crl indicator: %w",
+					err)
+			}
+
+			crl.BaseNumber = indicator.BaseCRLNumber
+
+		case ext.Id.Equal(oidExtFreshestCRL):
+			var freshestCRL ExtFreshestCRL
+			if err := freshestCRL.Decode(ext.Value); err != nil {
+				return fmt.Errorf("invalid freshest crl: %w", err)
+			}
+
+			crl.FreshestCRLURIs = freshestCRL.URIs
+
+		case ext.Id.Equal(oidExtExpiredCertsOnCRL):
+			var date ExtExpiredCertsOnCRL
+			if err := date.Decode(ext.Value); err != nil {
+				return fmt.Errorf("invalid expired certs on crl: %w",
+					err)
+			}
+
+			crl.ExpiredCertsOnCRL = date.Date
+		}
+	}
+
+	return nil
+}
+
+func (rc *CRLRevokedCert) readExtensions(exts []pkix.Extension) error {
+	for _, ext := range exts {
+		switch {
+		case ext.Id.Equal(oidExtCRLReason):
+			var reason ExtCRLReason
+			if err := reason.Decode(ext.Value); err != nil {
+				return fmt.Errorf("invalid reason code: %w", err)
+			}
+
+			rc.Reason = reason.Reason
+
+		case ext.Id.Equal(oidExtInvalidityDate):
+			var date ExtInvalidityDate
+			if err := date.Decode(ext.Value); err != nil {
+				return fmt.Errorf("invalid invalidity date: %w", err)
+			}
+
+			rc.InvalidityDate = date.Date
+		}
+	}
+
+	return nil
+}
+
+func (crl *CRLData) PKIXRevokedCerts() ([]pkix.RevokedCertificate, error) {
 	rcs := make([]pkix.RevokedCertificate, len(crl.RevokedCerts))
 
-	for i, c := range crl.RevokedCerts {
+	for i := range crl.RevokedCerts {
+		c := &crl.RevokedCerts[i]
+
+		exts, err := c.pkixExtensions()
+		if err != nil {
+			return nil, err
+		}
+
 		rc := pkix.RevokedCertificate{
 			SerialNumber:   &c.SerialNumber,
 			RevocationTime: c.RevocationDate,
+			Extensions:     exts,
 		}
 
 		rcs[i] = rc
 	}
 
-	return rcs
+	return rcs, nil
+}
+
+func (crl *CRLData) PKIXExtensions() ([]pkix.Extension, error) {
+	var exts []pkix.Extension
+
+	if crl.BaseNumber != nil {
+		ext := ExtDeltaCRLIndicator{BaseCRLNumber: crl.BaseNumber}
+
+		value, err := ext.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode delta crl "+
+				"indicator: %w", err)
+		}
+
+		// RFC 5280 5.2.4: the extension must be critical.
+		exts = append(exts, pkix.Extension{
+			Id:       oidExtDeltaCRLIndicator,
+			Critical: true,
+			Value:    value,
+		})
+	}
+
+	if len(crl.FreshestCRLURIs) > 0 {
+		ext := ExtFreshestCRL{URIs: crl.FreshestCRLURIs}
+
+		value, err := ext.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode freshest crl: %w",
+				err)
+		}
+
+		exts = append(exts, pkix.Extension{
+			Id:    oidExtFreshestCRL,
+			Value: value,
+		})
+	}
+
+	if !crl.ExpiredCertsOnCRL.IsZero() {
+		ext := ExtExpiredCertsOnCRL{Date: crl.ExpiredCertsOnCRL}
+
+		value, err := ext.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode expired certs on "+
+				"crl: %w", err)
+		}
+
+		exts = append(exts, pkix.Extension{
+			Id:    oidExtExpiredCertsOnCRL,
+			Value: value,
+		})
+	}
+
+	return exts, nil
+}
+
+func (rc *CRLRevokedCert) pkixExtensions() ([]pkix.Extension, error) {
+	var exts []pkix.Extension
+
+	// RFC 5280 5.3.1: the reason code extension should be absent
+	// instead of using the unspecified reason code value.
+	if rc.Reason != RevocationReasonUnspecified {
+		ext := ExtCRLReason{Reason: rc.Reason}
+
+		value, err := ext.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode reason code: %w", err)
+		}
+
+		exts = append(exts, pkix.Extension{
+			Id:    oidExtCRLReason,
+			Value: value,
+		})
+	}
+
+	if !rc.InvalidityDate.IsZero() {
+		ext := ExtInvalidityDate{Date: rc.InvalidityDate}
+
+		value, err := ext.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode invalidity date: %w",
+				err)
+		}
+
+		exts = append(exts, pkix.Extension{
+			Id:    oidExtInvalidityDate,
+			Value: value,
+		})
+	}
+
+	return exts, nil
 }
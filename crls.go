@@ -15,24 +15,36 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"path"
+	"io"
+	"math/big"
+	"strings"
+	"time"
 )
 
 func (pki *PKI) LoadCRL(name string) ([]byte, error) {
 	p.Info("loading crl %q", name)
 
-	crlPath := pki.CRLPath(name)
+	return pki.loadCRL(ObjectTypeCRL, name)
+}
+
+func (pki *PKI) LoadDeltaCRL(name string) ([]byte, error) {
+	p.Info("loading delta crl %q", name)
+
+	return pki.loadCRL(ObjectTypeDeltaCRL, name)
+}
 
-	data, err := ioutil.ReadFile(crlPath)
+func (pki *PKI) loadCRL(objType ObjectType, name string) ([]byte, error) {
+	data, err := pki.readObject(objType, name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read %q: %w", crlPath, err)
+		return nil, err
 	}
 
 	block, _ := pem.Decode(data)
@@ -45,57 +57,627 @@ func (pki *PKI) LoadCRL(name string) ([]byte, error) {
 	return crl, nil
 }
 
+// The default number of days during which a CRL is valid. CRLs must be
+// updated before they expire, usually with a periodic job.
+const DefaultCRLLifetime = 7
+
+// The default number of hours during which a delta CRL is valid.
+const DefaultDeltaCRLLifetime = 24
+
+// Load the current content of the CRL of an issuer. If the issuer does not
+// have a CRL yet, an empty CRL is returned.
+func (pki *PKI) LoadCRLData(name string) (*CRLData, error) {
+	return pki.loadCRLData(ObjectTypeCRL, name)
+}
+
+// Load the current content of the delta CRL of an issuer, i.e. revocations
+// which happened since the last complete CRL. If the issuer does not have a
+// delta CRL, an empty CRL is returned.
+func (pki *PKI) LoadDeltaCRLData(name string) (*CRLData, error) {
+	return pki.loadCRLData(ObjectTypeDeltaCRL, name)
+}
+
+func (pki *PKI) loadCRLData(objType ObjectType, name string) (*CRLData, error) {
+	var crlData CRLData
+
+	data, err := pki.loadCRL(objType, name)
+	if errors.Is(err, ErrObjectNotFound) {
+		return &crlData, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot load %s: %w", objType, err)
+	}
+
+	if err := crlData.Read(data); err != nil {
+		return nil, fmt.Errorf("cannot read %s data: %w", objType, err)
+	}
+
+	return &crlData, nil
+}
+
 func (pki *PKI) CreateCRL(name string, cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
 	p.Info("creating crl %q", name)
 
-	crl, err := pki.GenerateCRL(cert, key, crlData)
+	return pki.writeNewCRL(ObjectTypeCRL, name, cert, key, crlData)
+}
+
+// Update the complete CRL of an issuer. If the issuer has a delta CRL,
+// revocations it contains are merged in the complete CRL, and a new empty
+// delta CRL based on the new complete CRL is written.
+func (pki *PKI) UpdateCRL(name string, cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
+	p.Info("updating crl %q", name)
+
+	var crl []byte
+
+	err := pki.WithTransaction(func() error {
+		deltaCRLData, err := pki.LoadDeltaCRLData(name)
+		if err != nil {
+			return err
+		}
+
+		crlData.MergeRevokedCerts(deltaCRLData)
+
+		if err := pki.pruneCRL(name, crlData); err != nil {
+			return fmt.Errorf("cannot prune crl: %w", err)
+		}
+
+		crlData.FreshestCRLURIs = nil
+		deltaCRLs := pki.CACfg(name).DeltaCRLs
+		if deltaCRLs != nil {
+			crlData.FreshestCRLURIs = deltaCRLs.URIs
+		}
+
+		crl, err = pki.writeNewCRL(ObjectTypeCRL, name, cert, key,
+			crlData)
+		if err != nil {
+			return err
+		}
+
+		if deltaCRLs != nil {
+			newDeltaCRLData := CRLData{Number: deltaCRLData.Number}
+
+			_, err := pki.UpdateDeltaCRL(name, cert, key,
+				&newDeltaCRLData)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("cannot generate crl: %w", err)
+		return nil, err
+	}
+
+	return crl, nil
+}
+
+// Update the delta CRL of an issuer. The delta CRL is always based on the
+// current complete CRL of the issuer.
+func (pki *PKI) UpdateDeltaCRL(name string, cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
+	p.Info("updating delta crl %q", name)
+
+	if pki.CACfg(name).DeltaCRLs == nil {
+		return nil, fmt.Errorf("delta crls are not enabled for %q", name)
 	}
 
-	if err := pki.WriteCRL(crl, name); err != nil {
-		return nil, fmt.Errorf("cannot write crl: %w", err)
+	var crl []byte
+
+	err := pki.WithTransaction(func() error {
+		baseCRLData, err := pki.LoadCRLData(name)
+		if err != nil {
+			return err
+		}
+
+		if baseCRLData.Number == nil {
+			return fmt.Errorf("missing complete crl for %q", name)
+		}
+
+		crlData.BaseNumber = baseCRLData.Number
+		crlData.FreshestCRLURIs = nil
+
+		crl, err = pki.writeNewCRL(ObjectTypeDeltaCRL, name, cert, key,
+			crlData)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return crl, nil
 }
 
-func (pki *PKI) UpdateCRL(name string, cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
-	p.Info("updating crl %q", name)
+// Add revoked certificates to the CRL of an issuer. If delta CRLs are
+// enabled for the issuer, certificates are only added to the delta CRL and
+// will be part of the complete CRL the next time it is updated.
+func (pki *PKI) AddRevokedCertificates(name string, cert *x509.Certificate, key crypto.PrivateKey, rcs []CRLRevokedCert) error {
+	if pki.CACfg(name).DeltaCRLs != nil {
+		crlData, err := pki.LoadDeltaCRLData(name)
+		if err != nil {
+			return err
+		}
+
+		for _, rc := range rcs {
+			crlData.SetRevokedCertificate(rc)
+		}
+
+		_, err = pki.UpdateDeltaCRL(name, cert, key, crlData)
+		return err
+	}
 
-	crl, err := pki.GenerateCRL(cert, key, crlData)
+	crlData, err := pki.LoadCRLData(name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot generate crl: %w", err)
+		return err
 	}
 
-	if err := pki.WriteCRL(crl, name); err != nil {
-		return nil, fmt.Errorf("cannot write crl: %w", err)
+	for _, rc := range rcs {
+		crlData.SetRevokedCertificate(rc)
+	}
+
+	_, err = pki.UpdateCRL(name, cert, key, crlData)
+	return err
+}
+
+// Remove the entries of certificates which expired more than the grace
+// period of the issuer ago. Certificates which are not in the index are
+// kept since we do not know when they expire.
+func (pki *PKI) pruneCRL(name string, crlData *CRLData) error {
+	crlData.ExpiredCertsOnCRL = time.Time{}
+
+	pruningCfg := pki.CACfg(name).CRLPruning
+	if pruningCfg == nil {
+		return nil
+	}
+
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	gracePeriod := time.Duration(pruningCfg.GracePeriod) * 24 * time.Hour
+	limit := time.Now().UTC().Add(-gracePeriod).Truncate(time.Second)
+
+	var rcs []CRLRevokedCert
+
+	for _, rc := range crlData.RevokedCerts {
+		entry := index.EntryBySerialNumber(name, &rc.SerialNumber)
+		if entry != nil && entry.NotAfter.Before(limit) {
+			p.Info("removing expired certificate %q from crl %q",
+				entry.Name, name)
+			continue
+		}
+
+		rcs = append(rcs, rc)
+	}
+
+	crlData.RevokedCerts = rcs
+	crlData.ExpiredCertsOnCRL = limit
+
+	return nil
+}
+
+// Return the current revocation entry of a certificate issued by a ca, or
+// nil if the certificate is not revoked. Delta CRLs are taken into account.
+func (pki *PKI) FindRevokedCertificate(name string, serialNumber *big.Int) (*CRLRevokedCert, error) {
+	deltaCRLData, err := pki.LoadDeltaCRLData(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rc := deltaCRLData.RevokedCert(serialNumber); rc != nil {
+		if rc.Reason == RevocationReasonRemoveFromCRL {
+			return nil, nil
+		}
+
+		return rc, nil
+	}
+
+	crlData, err := pki.LoadCRLData(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return crlData.RevokedCert(serialNumber), nil
+}
+
+// Remove a certificate on hold from the CRL of an issuer. If delta CRLs are
+// enabled and the certificate is already listed in the complete CRL, a
+// removeFromCRL entry is added to the delta CRL; the certificate will be
+// removed from the complete CRL the next time it is updated.
+func (pki *PKI) ReleaseCertificate(name string, cert *x509.Certificate, key crypto.PrivateKey, serialNumber *big.Int) error {
+	return pki.WithTransaction(func() error {
+		rc, err := pki.FindRevokedCertificate(name, serialNumber)
+		if err != nil {
+			return err
+		}
+
+		if rc == nil {
+			return errors.New("certificate is not revoked")
+		} else if rc.Reason != RevocationReasonCertificateHold {
+			return fmt.Errorf("certificate was revoked with reason %s "+
+				"and cannot be released", rc.Reason)
+		}
+
+		crlData, err := pki.LoadCRLData(name)
+		if err != nil {
+			return err
+		}
+
+		if pki.CACfg(name).DeltaCRLs == nil {
+			crlData.RemoveRevokedCert(serialNumber)
+
+			_, err := pki.UpdateCRL(name, cert, key, crlData)
+			return err
+		}
+
+		deltaCRLData, err := pki.LoadDeltaCRLData(name)
+		if err != nil {
+			return err
+		}
+
+		deltaCRLData.RemoveRevokedCert(serialNumber)
+
+		if crlData.RevokedCert(serialNumber) != nil {
+			deltaCRLData.AddRevokedCertificate(CRLRevokedCert{
+				SerialNumber:   *serialNumber,
+				RevocationDate: time.Now().UTC(),
+				Reason:         RevocationReasonRemoveFromCRL,
+			})
+		}
+
+		_, err = pki.UpdateDeltaCRL(name, cert, key, deltaCRLData)
+		return err
+	})
+}
+
+// Assign the next CRL number of the issuer to a CRL, generate it and write
+// it along with the updated CRL state. Complete and delta CRLs share the
+// same sequence of numbers (RFC 5280 5.2.3).
+func (pki *PKI) writeNewCRL(objType ObjectType, name string, cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
+	var crl []byte
+
+	err := pki.WithTransaction(func() error {
+		state, err := pki.LoadCRLState(name)
+		if err != nil {
+			return err
+		}
+
+		// The number of the current CRL, if there is one, is also
+		// taken into account in case the state was lost.
+		number := new(big.Int).Add(maxBigInt(state.Number,
+			crlData.Number), big.NewInt(1))
+
+		crlData.Number = number
+
+		// CRLs are valid for a fixed duration starting when they are
+		// signed, whatever the reason of the update.
+		lifetime := pki.CRLLifetime(name)
+		if objType == ObjectTypeDeltaCRL {
+			lifetime = pki.DeltaCRLLifetime(name)
+		}
+
+		now := time.Now().UTC()
+
+		crlData.CreationDate = now
+		crlData.ExpirationDate = now.Add(lifetime)
+
+		// The algorithm of the current CRL is ignored so that changes
+		// of the configuration apply to the next CRL.
+		algorithm, err := pki.CRLSignatureAlgorithm(name)
+		if err != nil {
+			return err
+		}
+
+		crlData.SignatureAlgorithm = algorithm
+
+		crl, err = pki.GenerateCRL(cert, key, crlData)
+		if err != nil {
+			return fmt.Errorf("cannot generate %s: %w", objType, err)
+		}
+
+		if err := pki.writeCRL(objType, crl, name); err != nil {
+			return fmt.Errorf("cannot write %s: %w", objType, err)
+		}
+
+		state.Number = number
+
+		if err := pki.WriteCRLState(name, state); err != nil {
+			return fmt.Errorf("cannot write crl state: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return crl, nil
 }
 
 func (pki *PKI) GenerateCRL(cert *x509.Certificate, key crypto.PrivateKey, crlData *CRLData) ([]byte, error) {
-	revokedCerts := crlData.PKIXRevokedCerts()
+	revokedCerts, err := crlData.PKIXRevokedCerts()
+	if err != nil {
+		return nil, err
+	}
 
-	crl, err := cert.CreateCRL(rand.Reader, key, revokedCerts,
-		crlData.CreationDate, crlData.ExpirationDate)
+	exts, err := crlData.PKIXExtensions()
 	if err != nil {
 		return nil, err
 	}
 
-	return crl, nil
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+
+	// The authority key identifier extension is derived from the subject
+	// key identifier of the issuer certificate.
+	template := x509.RevocationList{
+		SignatureAlgorithm:  crlData.SignatureAlgorithm,
+		RevokedCertificates: revokedCerts,
+		Number:              crlData.Number,
+		ThisUpdate:          crlData.CreationDate,
+		NextUpdate:          crlData.ExpirationDate,
+		ExtraExtensions:     exts,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, &template, cert, signer)
 }
 
 func (pki *PKI) WriteCRL(crl []byte, name string) error {
+	return pki.writeCRL(ObjectTypeCRL, crl, name)
+}
+
+func (pki *PKI) writeCRL(objType ObjectType, crl []byte, name string) error {
 	block := pem.Block{Type: "X509 CRL", Bytes: crl}
 	pemData := pem.EncodeToMemory(&block)
 
-	crlPath := pki.CRLPath(name)
+	return pki.createOrReplaceObject(objType, name, pemData)
+}
+
+// The CRL state of an issuer contains information which must be kept across
+// CRL updates.
+type CRLState struct {
+	Number *big.Int `json:"number,omitempty"`
+}
+
+func (pki *PKI) LoadCRLState(name string) (*CRLState, error) {
+	data, err := pki.readObject(ObjectTypeCRLState, name)
+	if errors.Is(err, ErrObjectNotFound) {
+		return &CRLState{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read crl state: %w", err)
+	}
+
+	var state CRLState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("cannot decode crl state: %w", err)
+	}
+
+	return &state, nil
+}
+
+func (pki *PKI) WriteCRLState(name string, state *CRLState) error {
+	data, err := encodeJSON(state)
+	if err != nil {
+		return fmt.Errorf("cannot encode crl state: %w", err)
+	}
+
+	return pki.createOrReplaceObject(ObjectTypeCRLState, name, data)
+}
+
+func (pki *PKI) CRLLifetime(issuerName string) time.Duration {
+	days := pki.CACfg(issuerName).CRLLifetime
+	if days == 0 {
+		days = DefaultCRLLifetime
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// A CRL is considered to be close to expiry when less than a quarter of its
+// lifetime remains.
+func crlCloseToExpiry(thisUpdate, nextUpdate, now time.Time) bool {
+	remaining := nextUpdate.Sub(now)
+
+	return remaining < nextUpdate.Sub(thisUpdate)/4
+}
+
+func (pki *PKI) DeltaCRLLifetime(issuerName string) time.Duration {
+	hours := DefaultDeltaCRLLifetime
+
+	if deltaCRLs := pki.CACfg(issuerName).DeltaCRLs; deltaCRLs != nil &&
+		deltaCRLs.Lifetime != 0 {
+		hours = deltaCRLs.Lifetime
+	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+// UnknownSignatureAlgorithm selects the default algorithm of the key of the
+// ca.
+func (pki *PKI) CRLSignatureAlgorithm(issuerName string) (x509.SignatureAlgorithm, error) {
+	s := pki.CACfg(issuerName).CRLSignatureAlgorithm
+	if s == "" {
+		return x509.UnknownSignatureAlgorithm, nil
+	}
+
+	return parseSignatureAlgorithm(s)
+}
+
+var signatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.SHA256WithRSA,
+	x509.SHA384WithRSA,
+	x509.SHA512WithRSA,
+	x509.ECDSAWithSHA256,
+	x509.ECDSAWithSHA384,
+	x509.ECDSAWithSHA512,
+	x509.SHA256WithRSAPSS,
+	x509.SHA384WithRSAPSS,
+	x509.SHA512WithRSAPSS,
+	x509.PureEd25519,
+}
+
+func parseSignatureAlgorithm(s string) (x509.SignatureAlgorithm, error) {
+	var names []string
+
+	for _, algorithm := range signatureAlgorithms {
+		if algorithm.String() == s {
+			return algorithm, nil
+		}
+
+		names = append(names, algorithm.String())
+	}
+
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unknown signature "+
+		"algorithm %q (valid algorithms: %s)", s,
+		strings.Join(names, ", "))
+}
+
+func maxBigInt(a, b *big.Int) *big.Int {
+	switch {
+	case a == nil && b == nil:
+		return new(big.Int)
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.Cmp(b) >= 0:
+		return a
+	default:
+		return b
+	}
+}
+
+// Return the name of the ca which signed a CRL.
+func (pki *PKI) FindCRLIssuerName(data []byte) (string, error) {
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse crl: %w", err)
+	}
+
+	names, err := pki.CANames()
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		cert, err := pki.LoadCertificate(name)
+		if err != nil {
+			return "", err
+		}
+
+		if bytes.Equal(crl.RawIssuer, cert.RawSubject) &&
+			crl.CheckSignatureFrom(cert) == nil {
+			return name, nil
+		}
+	}
+
+	return "", errors.New("no issuer found")
+}
+
+// Print a CRL. If the certificate of the issuer is provided, the signature
+// of the CRL is verified.
+func PrintCRL(data []byte, issuerCert *x509.Certificate, w io.Writer) error {
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("cannot parse crl: %w", err)
+	}
+
+	var crlData CRLData
+	if err := crlData.Read(data); err != nil {
+		return err
+	}
 
-	return createOrReplaceFile(crlPath, pemData, 0644)
+	return printCRL(NewPrinter(w), crl, &crlData, issuerCert)
 }
 
-func (pki *PKI) CRLPath(name string) string {
-	return path.Join(pki.CertificatesPath(), name+".crl")
+func printCRL(p *Printer, crl *x509.RevocationList, crlData *CRLData, issuerCert *x509.Certificate) error {
+	p.Line("Data:")
+	p.WithIndent(func() {
+		printCRLData(p, crl, crlData)
+	})
+
+	p.Line("Signature:")
+	p.WithIndent(func() {
+		printCRLSignature(p, crl, issuerCert)
+	})
+
+	return p.Error()
+}
+
+func printCRLData(p *Printer, crl *x509.RevocationList, crlData *CRLData) {
+	p.Line("Issuer: %s", crl.Issuer.String())
+
+	if crl.Number != nil {
+		p.Line("CRL number: %s", crl.Number.String())
+	} else {
+		p.Line("CRL number: none")
+	}
+
+	if crlData.IsDelta() {
+		p.Line("Delta CRL of CRL number: %s", crlData.BaseNumber.String())
+	}
+
+	p.Line("Validity:")
+	p.WithIndent(func() {
+		p.Line("This update: %v", crl.ThisUpdate.Format(time.RFC3339))
+
+		nextUpdateString := crl.NextUpdate.Format(time.RFC3339)
+		if crl.NextUpdate.Before(time.Now()) {
+			nextUpdateString += " (STALE)"
+		}
+
+		p.Line("Next update: %s", nextUpdateString)
+	})
+
+	if len(crlData.FreshestCRLURIs) > 0 {
+		p.Line("Freshest CRL:")
+		p.WithIndent(func() {
+			for _, uri := range crlData.FreshestCRLURIs {
+				p.Line("%s", uri)
+			}
+		})
+	}
+
+	if !crlData.ExpiredCertsOnCRL.IsZero() {
+		p.Line("Expired certificates on CRL: %v",
+			crlData.ExpiredCertsOnCRL.Format(time.RFC3339))
+	}
+
+	if len(crlData.RevokedCerts) == 0 {
+		p.Line("Revoked certificates: none")
+		return
+	}
+
+	p.Line("Revoked certificates:")
+	p.WithIndent(func() {
+		for _, rc := range crlData.RevokedCerts {
+			p.Line("Serial number: %s",
+				serialNumberString(&rc.SerialNumber))
+			p.WithIndent(func() {
+				p.Line("Revocation date: %v",
+					rc.RevocationDate.Format(time.RFC3339))
+				p.Line("Reason: %v", rc.Reason)
+
+				if !rc.InvalidityDate.IsZero() {
+					p.Line("Invalidity date: %v",
+						rc.InvalidityDate.Format(time.RFC3339))
+				}
+			})
+		}
+	})
+}
+
+func printCRLSignature(p *Printer, crl *x509.RevocationList, issuerCert *x509.Certificate) {
+	p.Line("Algorithm: %v", crl.SignatureAlgorithm)
+
+	if issuerCert == nil {
+		p.Line("Status: not verified (unknown issuer)")
+	} else if err := crl.CheckSignatureFrom(issuerCert); err != nil {
+		p.Line("Status: INVALID (%v)", err)
+	} else {
+		p.Line("Status: valid")
+	}
+
+	p.Line("Data: %v", p.Hex(crl.Signature))
 }
@@ -0,0 +1,233 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestDeltaCRLs(t *testing.T) {
+	newTestPKI(t)
+
+	pki.Cfg.CAs["sub-ca"] = &CACfg{
+		DeltaCRLs: &DeltaCRLCfg{
+			URIs: []string{"http://crl.example.com/sub-ca-delta.crl"},
+		},
+	}
+
+	subCert, subKey := loadTestCertificate(t, "sub-ca")
+
+	// Initial complete CRL, which comes with an empty delta CRL
+	updateTestCRL(t, subCert, subKey)
+
+	crl := loadTestCRL(t, subCert, false)
+	checkTestCRLNumber(t, crl, 1, nil)
+	checkTestCRLEntries(t, crl, nil)
+
+	if !hasTestCRLExtension(crl, oidExtFreshestCRL) {
+		t.Errorf("complete crl does not have a freshest crl extension")
+	}
+
+	deltaCRL := loadTestCRL(t, subCert, true)
+	checkTestCRLNumber(t, deltaCRL, 2, big.NewInt(1))
+	checkTestCRLEntries(t, deltaCRL, nil)
+
+	// Revocations only go to the delta CRL
+	cert1, _ := createTestCertificate(t, "cert1", "sub-ca", &CertificateData{
+		Validity: 1,
+		Subject:  Subject{CommonName: "cert1"},
+	})
+
+	cert2, _ := createTestCertificate(t, "cert2", "sub-ca", &CertificateData{
+		Validity: 1,
+		Subject:  Subject{CommonName: "cert2"},
+	})
+
+	rcs := []CRLRevokedCert{
+		{
+			SerialNumber:   *cert1.SerialNumber,
+			RevocationDate: time.Now().UTC().Truncate(time.Second),
+			Reason:         RevocationReasonKeyCompromise,
+		},
+		{
+			SerialNumber:   *cert2.SerialNumber,
+			RevocationDate: time.Now().UTC().Truncate(time.Second),
+			Reason:         RevocationReasonSuperseded,
+		},
+	}
+
+	err := pki.WithTransaction(func() error {
+		return pki.AddRevokedCertificates("sub-ca", subCert, subKey, rcs)
+	})
+	if err != nil {
+		t.Fatalf("cannot revoke certificates: %v", err)
+	}
+
+	expectedEntries := map[string]RevocationReason{
+		cert1.SerialNumber.String(): RevocationReasonKeyCompromise,
+		cert2.SerialNumber.String(): RevocationReasonSuperseded,
+	}
+
+	crl = loadTestCRL(t, subCert, false)
+	checkTestCRLNumber(t, crl, 1, nil)
+	checkTestCRLEntries(t, crl, nil)
+
+	deltaCRL = loadTestCRL(t, subCert, true)
+	checkTestCRLNumber(t, deltaCRL, 3, big.NewInt(1))
+	checkTestCRLEntries(t, deltaCRL, expectedEntries)
+
+	// Updating the complete CRL merges the delta CRL and resets it
+	updateTestCRL(t, subCert, subKey)
+
+	crl = loadTestCRL(t, subCert, false)
+	checkTestCRLNumber(t, crl, 4, nil)
+	checkTestCRLEntries(t, crl, expectedEntries)
+
+	deltaCRL = loadTestCRL(t, subCert, true)
+	checkTestCRLNumber(t, deltaCRL, 5, big.NewInt(4))
+	checkTestCRLEntries(t, deltaCRL, nil)
+}
+
+func updateTestCRL(t *testing.T, cert *x509.Certificate, key crypto.PrivateKey) {
+	t.Helper()
+
+	crlData, err := pki.LoadCRLData("sub-ca")
+	if err != nil {
+		t.Fatalf("cannot load crl data: %v", err)
+	}
+
+	if _, err := pki.UpdateCRL("sub-ca", cert, key, crlData); err != nil {
+		t.Fatalf("cannot update crl: %v", err)
+	}
+}
+
+func loadTestCRL(t *testing.T, issuerCert *x509.Certificate, delta bool) *x509.RevocationList {
+	t.Helper()
+
+	load := pki.LoadCRL
+	if delta {
+		load = pki.LoadDeltaCRL
+	}
+
+	data, err := load("sub-ca")
+	if err != nil {
+		t.Fatalf("cannot load crl: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		t.Fatalf("cannot parse crl: %v", err)
+	}
+
+	if err := crl.CheckSignatureFrom(issuerCert); err != nil {
+		t.Fatalf("invalid crl signature: %v", err)
+	}
+
+	return crl
+}
+
+func checkTestCRLNumber(t *testing.T, crl *x509.RevocationList, number int64, baseNumber *big.Int) {
+	t.Helper()
+
+	if crl.Number == nil || crl.Number.Cmp(big.NewInt(number)) != 0 {
+		t.Errorf("crl has number %v; expected %d", crl.Number, number)
+	}
+
+	var crlBaseNumber *big.Int
+
+	for _, ext := range crl.Extensions {
+		if !ext.Id.Equal(oidExtDeltaCRLIndicator) {
+			continue
+		}
+
+		if !ext.Critical {
+			t.Errorf("delta crl indicator is not critical")
+		}
+
+		if _, err := asn1.Unmarshal(ext.Value, &crlBaseNumber); err != nil {
+			t.Fatalf("cannot parse delta crl indicator: %v", err)
+		}
+	}
+
+	switch {
+	case baseNumber == nil && crlBaseNumber != nil:
+		t.Errorf("complete crl has a delta crl indicator")
+	case baseNumber != nil && crlBaseNumber == nil:
+		t.Errorf("delta crl does not have a delta crl indicator")
+	case baseNumber != nil && crlBaseNumber.Cmp(baseNumber) != 0:
+		t.Errorf("delta crl has base number %v; expected %v",
+			crlBaseNumber, baseNumber)
+	}
+}
+
+// Check the serial numbers and reason codes of the entries of a CRL.
+func checkTestCRLEntries(t *testing.T, crl *x509.RevocationList, expectedEntries map[string]RevocationReason) {
+	t.Helper()
+
+	if len(crl.RevokedCertificates) != len(expectedEntries) {
+		t.Errorf("crl has %d entries; expected %d",
+			len(crl.RevokedCertificates), len(expectedEntries))
+	}
+
+	for _, rc := range crl.RevokedCertificates {
+		serialNumber := rc.SerialNumber.String()
+
+		expectedReason, found := expectedEntries[serialNumber]
+		if !found {
+			t.Errorf("unexpected crl entry for serial number %s",
+				serialNumber)
+			continue
+		}
+
+		var reason asn1.Enumerated
+		var hasReason bool
+
+		for _, ext := range rc.Extensions {
+			if !ext.Id.Equal(oidExtCRLReason) {
+				continue
+			}
+
+			if _, err := asn1.Unmarshal(ext.Value, &reason); err != nil {
+				t.Fatalf("cannot parse reason code: %v", err)
+			}
+
+			hasReason = true
+		}
+
+		if !hasReason {
+			t.Errorf("crl entry for serial number %s does not have "+
+				"a reason code", serialNumber)
+		} else if RevocationReason(reason) != expectedReason {
+			t.Errorf("crl entry for serial number %s has reason %v; "+
+				"expected %v", serialNumber,
+				RevocationReason(reason), expectedReason)
+		}
+	}
+}
+
+func hasTestCRLExtension(crl *x509.RevocationList, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range crl.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+
+	return false
+}
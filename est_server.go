@@ -0,0 +1,689 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// See RFC 7030. Requests and responses are base64-encoded DER data; issued
+// certificates are returned in degenerate CMS signed data structures.
+
+const estPathPrefix = "/.well-known/est/"
+
+// The maximum size of a request body
+const maxESTRequestSize = 64 * 1024
+
+type ESTServerCfg struct {
+	IssuerName string
+	Profile    string
+
+	// Users allowed to authenticate with http basic authentication,
+	// indexed by name
+	Users map[string]*ESTUser
+}
+
+type ESTUser struct {
+	PasswordHash []byte
+
+	// The names the user can request certificates for. Names starting
+	// with "*." match any subdomain of the rest of the name; they only
+	// apply to dns names and common names. Email addresses, ip addresses
+	// and uris must be listed as is.
+	Names []string
+}
+
+type ESTServer struct {
+	PKI *PKI
+	Cfg ESTServerCfg
+
+	issuerCert *x509.Certificate
+	issuerKey  crypto.PrivateKey
+
+	// The issuer certificate followed by the certificates required to
+	// build a chain to the root ca, root ca included.
+	caCerts []*x509.Certificate
+}
+
+// An authenticated client, either a user or the owner of a certificate of
+// the pki.
+type estClient struct {
+	UserName string
+	User     *ESTUser
+
+	CertificateName string
+	Certificate     *x509.Certificate
+}
+
+func (c *estClient) String() string {
+	if c.Certificate != nil {
+		return fmt.Sprintf("certificate %q", c.CertificateName)
+	}
+
+	return fmt.Sprintf("user %q", c.UserName)
+}
+
+// The caller must hold the pki lock.
+func NewESTServer(pki *PKI, cfg ESTServerCfg, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey) (*ESTServer, error) {
+	if err := CheckEnrollmentProfile(cfg.Profile); err != nil {
+		return nil, err
+	}
+
+	chain, err := pki.CertificateChain(cfg.IssuerName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate chain: %w", err)
+	}
+
+	caCerts := append([]*x509.Certificate{issuerCert}, chain...)
+
+	last := caCerts[len(caCerts)-1]
+	if !bytes.Equal(last.RawIssuer, last.RawSubject) {
+		rootName, err := pki.FindIssuerName(last)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find root ca: %w", err)
+		}
+
+		rootCert, err := pki.LoadCertificate(rootName)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load root ca certificate: %w",
+				err)
+		}
+
+		caCerts = append(caCerts, rootCert)
+	}
+
+	s := ESTServer{
+		PKI: pki,
+		Cfg: cfg,
+
+		issuerCert: issuerCert,
+		issuerKey:  issuerKey,
+
+		caCerts: caCerts,
+	}
+
+	return &s, nil
+}
+
+func (s *ESTServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, estPathPrefix) {
+		http.NotFound(w, req)
+		return
+	}
+
+	operation := strings.TrimPrefix(req.URL.Path, estPathPrefix)
+
+	switch operation {
+	case "cacerts":
+		if !s.checkMethod(w, req, http.MethodGet) {
+			return
+		}
+
+		s.hGetCACerts(w, req)
+
+	case "simpleenroll", "simplereenroll":
+		if !s.checkMethod(w, req, http.MethodPost) {
+			return
+		}
+
+		s.hEnroll(w, req, operation == "simplereenroll")
+
+	case "csrattrs":
+		if !s.checkMethod(w, req, http.MethodGet) {
+			return
+		}
+
+		s.hGetCSRAttrs(w, req)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *ESTServer) checkMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	return true
+}
+
+func (s *ESTServer) writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+func (s *ESTServer) writeBase64(w http.ResponseWriter, contentType string, data []byte) {
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(encodeBase64Lines(data))
+}
+
+func (s *ESTServer) writeCertificates(w http.ResponseWriter, certs []*x509.Certificate) {
+	data, err := CreateCertsOnlyCMS(certs)
+	if err != nil {
+		p.Error("est: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	s.writeBase64(w, "application/pkcs7-mime; smime-type=certs-only", data)
+}
+
+func (s *ESTServer) hGetCACerts(w http.ResponseWriter, req *http.Request) {
+	s.writeCertificates(w, s.caCerts)
+}
+
+// We do not require any specific attribute in certificate requests: the
+// content of certificates is controlled by the profile (RFC 7030 4.5.2).
+func (s *ESTServer) hGetCSRAttrs(w http.ResponseWriter, req *http.Request) {
+	if _, status, err := s.authenticate(req); err != nil {
+		s.writeAuthenticationError(w, status, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ESTServer) hEnroll(w http.ResponseWriter, req *http.Request, renewal bool) {
+	client, status, err := s.authenticate(req)
+	if err != nil {
+		s.writeAuthenticationError(w, status, err)
+		return
+	}
+
+	// Renewal requests are authenticated with the certificate being
+	// renewed (RFC 7030 4.2.2).
+	if renewal && client.Certificate == nil {
+		s.writeAuthenticationError(w, http.StatusUnauthorized,
+			errors.New("renewal requests must be authenticated with "+
+				"a client certificate"))
+		return
+	}
+
+	csr, err := readESTCertificateRequest(req)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		s.writeError(w, http.StatusBadRequest,
+			"invalid certificate request signature: %v", err)
+		return
+	}
+
+	if renewal {
+		if err := checkESTCertificateNames(csr, client.Certificate); err != nil {
+			s.writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	} else {
+		if len(estRequestNames(csr)) == 0 {
+			s.writeError(w, http.StatusBadRequest, "certificate request "+
+				"does not contain any common name or subject "+
+				"alternative name")
+			return
+		}
+
+		if err := client.CheckNames(csr); err != nil {
+			p.Info("est: rejected request from %s: %v", client, err)
+			s.writeError(w, http.StatusForbidden, "%v", err)
+			return
+		}
+	}
+
+	name := "est-" + generateRandomID()
+
+	var cert *x509.Certificate
+
+	err = s.PKI.WithLock(LockModeExclusive, func() error {
+		certData := CertificateData{
+			Validity: s.PKI.CertificateDefaults(s.Cfg.IssuerName).Validity,
+			Subject:  subjectFromPKIXName(csr.Subject),
+			SAN: SAN{
+				URIs:           csr.URIs,
+				DNSNames:       csr.DNSNames,
+				IPAddresses:    csr.IPAddresses,
+				EmailAddresses: csr.EmailAddresses,
+			},
+		}
+
+		if err := certData.ApplyProfile(s.Cfg.Profile); err != nil {
+			return err
+		}
+
+		return s.PKI.WithTransaction(func() error {
+			var err error
+			cert, err = s.PKI.SignCertificateRequest(name, csr,
+				&certData, s.Cfg.IssuerName, s.issuerCert, s.issuerKey)
+			return err
+		})
+	})
+	if err != nil {
+		p.Error("est: cannot issue certificate: %v", err)
+		s.writeError(w, http.StatusInternalServerError,
+			"cannot issue certificate")
+		return
+	}
+
+	if renewal {
+		p.Info("est: issued certificate %q for %s (renewal)", name, client)
+	} else {
+		p.Info("est: issued certificate %q for %s", name, client)
+	}
+
+	s.writeCertificates(w, []*x509.Certificate{cert})
+}
+
+func readESTCertificateRequest(req *http.Request) (*x509.CertificateRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body,
+		maxESTRequestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read body: %w", err)
+	} else if len(body) > maxESTRequestSize {
+		return nil, errors.New("request too large")
+	}
+
+	data, err := decodeBase64Lines(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 data: %w", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+
+	return csr, nil
+}
+
+// Certificates are only issued for the names the client is allowed to use:
+// clients authenticated with a certificate can only request certificates
+// for the names of this certificate, and users for the names listed in the
+// user file.
+func (c *estClient) CheckNames(csr *x509.CertificateRequest) error {
+	if c.Certificate != nil {
+		return checkESTCertificateNames(csr, c.Certificate)
+	}
+
+	check := func(nameType, name string, allowed bool) error {
+		if allowed {
+			return nil
+		}
+
+		return fmt.Errorf("user %q is not allowed to request "+
+			"certificates for %s %q", c.UserName, nameType, name)
+	}
+
+	// Clients still use the common name as a dns name
+	if name := csr.Subject.CommonName; name != "" {
+		if err := check("common name", name,
+			c.User.AllowsDNSName(name)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range csr.DNSNames {
+		if err := check("dns name", name,
+			c.User.AllowsDNSName(name)); err != nil {
+			return err
+		}
+	}
+
+	for _, address := range csr.EmailAddresses {
+		if err := check("email address", address,
+			c.User.AllowsName(address)); err != nil {
+			return err
+		}
+	}
+
+	for _, address := range csr.IPAddresses {
+		if err := check("ip address", address.String(),
+			c.User.AllowsIPAddress(address)); err != nil {
+			return err
+		}
+	}
+
+	for _, uri := range csr.URIs {
+		if err := check("uri", uri.String(),
+			c.User.AllowsName(uri.String())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return true if the user can request certificates for a dns name, either
+// listed as is or matching a wildcard pattern.
+func (u *ESTUser) AllowsDNSName(name string) bool {
+	name = strings.ToLower(name)
+
+	if validateDNSName(strings.TrimPrefix(name, "*.")) != nil {
+		return false
+	}
+
+	for _, pattern := range u.Names {
+		pattern = strings.ToLower(pattern)
+
+		if strings.HasPrefix(pattern, "*.") {
+			suffix := pattern[1:]
+			if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return true if a name, e.g. an email address or an uri, is listed as is
+// for the user. Wildcard patterns only apply to dns names.
+func (u *ESTUser) AllowsName(name string) bool {
+	for _, pattern := range u.Names {
+		if name == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *ESTUser) AllowsIPAddress(address net.IP) bool {
+	for _, pattern := range u.Names {
+		if ip := net.ParseIP(pattern); ip != nil && ip.Equal(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the common name and all subject alternative names of a
+// certificate request.
+func estRequestNames(csr *x509.CertificateRequest) []string {
+	var names []string
+
+	if csr.Subject.CommonName != "" {
+		names = append(names, csr.Subject.CommonName)
+	}
+
+	names = append(names, csr.DNSNames...)
+	names = append(names, csr.EmailAddresses...)
+
+	for _, address := range csr.IPAddresses {
+		names = append(names, address.String())
+	}
+
+	for _, uri := range csr.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// The subject and subject alternative names of a certificate request must be
+// identical to those of the certificate used to authenticate the client,
+// e.g. the certificate being renewed.
+func checkESTCertificateNames(csr *x509.CertificateRequest, cert *x509.Certificate) error {
+	if !bytes.Equal(csr.RawSubject, cert.RawSubject) {
+		return errors.New("subject does not match the subject of the " +
+			"current certificate")
+	}
+
+	csrNames := sanStrings(csr.URIs, csr.DNSNames, csr.IPAddresses,
+		csr.EmailAddresses)
+	certNames := sanStrings(cert.URIs, cert.DNSNames, cert.IPAddresses,
+		cert.EmailAddresses)
+
+	if strings.Join(csrNames, "\n") != strings.Join(certNames, "\n") {
+		return errors.New("subject alternative names do not match the " +
+			"ones of the current certificate")
+	}
+
+	return nil
+}
+
+// Return a sorted list of all subject alternative names with their type.
+func sanStrings(uris []*url.URL, dnsNames []string, ipAddresses []net.IP, emailAddresses []string) []string {
+	var names []string
+
+	for _, uri := range uris {
+		names = append(names, "uri:"+uri.String())
+	}
+
+	for _, name := range dnsNames {
+		names = append(names, "dns:"+strings.ToLower(name))
+	}
+
+	for _, address := range ipAddresses {
+		names = append(names, "ip:"+address.String())
+	}
+
+	for _, address := range emailAddresses {
+		names = append(names, "email:"+address)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Authenticate a client with either the certificate it presented during the
+// tls handshake or http basic authentication. Return the http status to use
+// in case of failure.
+func (s *ESTServer) authenticate(req *http.Request) (*estClient, int, error) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return s.authenticateCertificate(req.TLS.PeerCertificates[0])
+	}
+
+	userName, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, http.StatusUnauthorized,
+			errors.New("missing credentials")
+	}
+
+	user, found := s.Cfg.Users[userName]
+	if !found {
+		return nil, http.StatusUnauthorized,
+			fmt.Errorf("unknown user %q", userName)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash,
+		[]byte(password)); err != nil {
+		return nil, http.StatusUnauthorized,
+			fmt.Errorf("invalid password for user %q", userName)
+	}
+
+	return &estClient{UserName: userName, User: user}, 0, nil
+}
+
+// The tls handshake already verified the certificate chain; we also make
+// sure the certificate is still part of the pki and has not been revoked.
+func (s *ESTServer) authenticateCertificate(cert *x509.Certificate) (*estClient, int, error) {
+	client := estClient{Certificate: cert}
+
+	err := s.PKI.WithLock(LockModeShared, func() error {
+		issuerName, err := s.PKI.FindIssuerName(cert)
+		if err != nil {
+			return err
+		}
+
+		index, err := s.PKI.LoadIndex()
+		if err != nil {
+			return err
+		}
+
+		entry := index.EntryBySerialNumber(issuerName, cert.SerialNumber)
+		if entry == nil {
+			return errors.New("certificate not found in index")
+		}
+
+		indexCert, err := s.PKI.LoadCertificate(entry.Name)
+		if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare(indexCert.Raw, cert.Raw) != 1 {
+			return errors.New("certificate does not match the " +
+				"certificate in the index")
+		}
+
+		rc, err := s.PKI.FindRevokedCertificate(issuerName,
+			cert.SerialNumber)
+		if err != nil {
+			return err
+		} else if rc != nil {
+			return fmt.Errorf("certificate %q is revoked", entry.Name)
+		}
+
+		client.CertificateName = entry.Name
+
+		return nil
+	})
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	return &client, 0, nil
+}
+
+func (s *ESTServer) writeAuthenticationError(w http.ResponseWriter, status int, err error) {
+	p.Info("est: authentication failed: %v", err)
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="est"`)
+		s.writeError(w, status, "authentication required")
+	} else {
+		s.writeError(w, status, "access denied")
+	}
+}
+
+func encodeBase64Lines(data []byte) []byte {
+	s := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(s) > 64 {
+		buf.WriteString(s[:64])
+		buf.WriteByte('\n')
+		s = s[64:]
+	}
+
+	buf.WriteString(s)
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+func decodeBase64Lines(data []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(data)), "")
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// User files contain one "<name>:<bcrypt hash>[:<names>]" entry per line,
+// e.g. as generated by "htpasswd -B", where names is a comma-separated list
+// of the names the user can request certificates for. Users without names
+// can only request certificates for their own name. Empty lines and lines
+// starting with '#' are ignored.
+func LoadESTUsers(filePath string) (map[string]*ESTUser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", filePath, err)
+	}
+	defer file.Close()
+
+	users := make(map[string]*ESTUser)
+
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Bcrypt hashes do not contain any colon, but uris and ipv6
+		// addresses in the name list do.
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid entry on line %d of %q",
+				lineNumber, filePath)
+		}
+
+		name, hash := parts[0], parts[1]
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash on line %d "+
+				"of %q: %w", lineNumber, filePath, err)
+		}
+
+		user := ESTUser{
+			PasswordHash: []byte(hash),
+			Names:        []string{name},
+		}
+
+		if len(parts) == 3 {
+			user.Names = nil
+
+			for _, s := range strings.Split(parts[2], ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					user.Names = append(user.Names, s)
+				}
+			}
+
+			if len(user.Names) == 0 {
+				return nil, fmt.Errorf("empty name list on line %d "+
+					"of %q", lineNumber, filePath)
+			}
+		}
+
+		users[name] = &user
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	return users, nil
+}
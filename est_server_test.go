@@ -0,0 +1,554 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testESTServer struct {
+	*httptest.Server
+
+	rootCert *x509.Certificate
+	subCert  *x509.Certificate
+	subKey   crypto.PrivateKey
+}
+
+func newTestESTServer(t *testing.T) *testESTServer {
+	t.Helper()
+
+	newTestPKI(t)
+
+	rootCert, _ := loadTestCertificate(t, "root-ca")
+	subCert, subKey := loadTestCertificate(t, "sub-ca")
+
+	createTestCertificate(t, "localhost", "sub-ca", &CertificateData{
+		Validity: 1,
+		Subject:  Subject{CommonName: "localhost"},
+		SAN: SAN{
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		},
+	})
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"),
+		bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	cfg := ESTServerCfg{
+		IssuerName: "sub-ca",
+		Profile:    "client",
+		Users: map[string]*ESTUser{
+			"alice": {
+				PasswordHash: hash,
+				Names: []string{"*.example.com",
+					"alice@example.com", "192.0.2.1", "2001:db8::1",
+					"https://a.example.com/alice"},
+			},
+		},
+	}
+
+	server, err := NewESTServer(pki, cfg, subCert, subKey)
+	if err != nil {
+		t.Fatalf("cannot create est server: %v", err)
+	}
+
+	tlsCert, err := loadTLSCertificate("localhost")
+	if err != nil {
+		t.Fatalf("cannot load tls certificate: %v", err)
+	}
+
+	clientCAs, err := caCertPool()
+	if err != nil {
+		t.Fatalf("cannot load ca certificates: %v", err)
+	}
+
+	httpServer := httptest.NewUnstartedServer(server)
+	httpServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*tlsCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	}
+	httpServer.StartTLS()
+	t.Cleanup(httpServer.Close)
+
+	s := testESTServer{
+		Server: httpServer,
+
+		rootCert: rootCert,
+		subCert:  subCert,
+		subKey:   subKey,
+	}
+
+	return &s
+}
+
+// Clients authenticate with http basic authentication if UserName is set,
+// and with the client certificate if it is set.
+type testESTClient struct {
+	*http.Client
+
+	UserName string
+	Password string
+}
+
+func (s *testESTServer) NewClient(t *testing.T, clientCert *tls.Certificate) *testESTClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.rootCert)
+
+	tlsCfg := tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		tlsCfg.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	c := testESTClient{
+		Client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tlsCfg},
+		},
+	}
+
+	return &c
+}
+
+func (c *testESTClient) Send(t *testing.T, s *testESTServer, method, operation string, body []byte) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, s.URL+estPathPrefix+operation,
+		bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("cannot create request: %v", err)
+	}
+
+	if c.UserName != "" {
+		req.SetBasicAuth(c.UserName, c.Password)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/pkcs10")
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("cannot read response: %v", err)
+	}
+
+	return res.StatusCode, resBody
+}
+
+// Send an enrollment request for a new key and return the http status, and
+// in case of success the certificate issued with its private key.
+func (c *testESTClient) Enroll(t *testing.T, s *testESTServer, operation string, subject pkix.Name, dnsNames ...string) (int, *tls.Certificate) {
+	t.Helper()
+
+	template := x509.CertificateRequest{
+		Subject:  subject,
+		DNSNames: dnsNames,
+	}
+
+	return c.EnrollRequest(t, s, operation, &template)
+}
+
+func (c *testESTClient) EnrollRequest(t *testing.T, s *testESTServer, operation string, template *x509.CertificateRequest) (int, *tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate request: %v", err)
+	}
+
+	status, body := c.Send(t, s, http.MethodPost, operation,
+		encodeBase64Lines(csr))
+	if status != http.StatusOK {
+		return status, nil
+	}
+
+	certs := parseTestESTCertificates(t, body)
+	if len(certs) != 1 {
+		t.Fatalf("response contains %d certificates instead of one",
+			len(certs))
+	}
+
+	cert := certs[0]
+
+	if err := cert.CheckSignatureFrom(s.subCert); err != nil {
+		t.Errorf("certificate was not issued by the issuer: %v", err)
+	}
+
+	certNames := sanStrings(cert.URIs, cert.DNSNames, cert.IPAddresses,
+		cert.EmailAddresses)
+	csrNames := sanStrings(template.URIs, template.DNSNames,
+		template.IPAddresses, template.EmailAddresses)
+
+	if !reflect.DeepEqual(certNames, csrNames) {
+		t.Errorf("certificate subject alternative names are %v instead "+
+			"of %v", certNames, csrNames)
+	}
+
+	tlsCert := tls.Certificate{
+		Certificate: [][]byte{cert.Raw, s.subCert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+
+	return status, &tlsCert
+}
+
+func parseTestESTCertificates(t *testing.T, body []byte) []*x509.Certificate {
+	t.Helper()
+
+	data, err := decodeBase64Lines(body)
+	if err != nil {
+		t.Fatalf("invalid base64 response: %v", err)
+	}
+
+	sd, err := ParseCMSSignedData(data)
+	if err != nil {
+		t.Fatalf("invalid cms response: %v", err)
+	}
+
+	return sd.Certificates
+}
+
+func TestESTCACerts(t *testing.T) {
+	s := newTestESTServer(t)
+	c := s.NewClient(t, nil)
+
+	status, body := c.Send(t, s, http.MethodGet, "cacerts", nil)
+	if status != http.StatusOK {
+		t.Fatalf("request failed with status %d", status)
+	}
+
+	certs := parseTestESTCertificates(t, body)
+
+	expected := []*x509.Certificate{s.subCert, s.rootCert}
+	if len(certs) != len(expected) {
+		t.Fatalf("response contains %d certificates instead of %d",
+			len(certs), len(expected))
+	}
+
+	for i, cert := range certs {
+		if !cert.Equal(expected[i]) {
+			t.Errorf("certificate %d is %q instead of %q", i,
+				cert.Subject, expected[i].Subject)
+		}
+	}
+}
+
+func TestESTAuthentication(t *testing.T) {
+	s := newTestESTServer(t)
+
+	subject := pkix.Name{CommonName: "a.example.com"}
+
+	c := s.NewClient(t, nil)
+
+	status, _ := c.Enroll(t, s, "simpleenroll", subject)
+	if status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request returned status %d", status)
+	}
+
+	status, _ = c.Send(t, s, http.MethodGet, "csrattrs", nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request returned status %d", status)
+	}
+
+	c.UserName, c.Password = "alice", "invalid"
+
+	status, _ = c.Enroll(t, s, "simpleenroll", subject)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request with an invalid password returned status %d",
+			status)
+	}
+
+	c.UserName, c.Password = "bob", "password"
+
+	status, _ = c.Enroll(t, s, "simpleenroll", subject)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request from an unknown user returned status %d",
+			status)
+	}
+
+	c.UserName, c.Password = "alice", "password"
+
+	status, _ = c.Send(t, s, http.MethodGet, "csrattrs", nil)
+	if status != http.StatusNoContent {
+		t.Errorf("authenticated request returned status %d", status)
+	}
+}
+
+func TestESTEnrollment(t *testing.T) {
+	s := newTestESTServer(t)
+
+	c := s.NewClient(t, nil)
+	c.UserName, c.Password = "alice", "password"
+
+	tests := []struct {
+		CommonName string
+		DNSNames   []string
+		Status     int
+	}{
+		{"a.example.com", nil, http.StatusOK},
+		{"a.example.com", []string{"b.c.example.com"}, http.StatusOK},
+		{"", []string{"A.Example.COM"}, http.StatusOK},
+		{"", nil, http.StatusBadRequest},
+		{"example.com", nil, http.StatusForbidden},
+		{"a.example.org", nil, http.StatusForbidden},
+		{"a.example.com", []string{"a.example.org"}, http.StatusForbidden},
+		{"a.badexample.com", nil, http.StatusForbidden},
+		{"evil@x.example.com", nil, http.StatusForbidden},
+		{"https://attacker.net/x.example.com", nil, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		subject := pkix.Name{CommonName: test.CommonName}
+
+		status, cert := c.Enroll(t, s, "simpleenroll", subject,
+			test.DNSNames...)
+		if status != test.Status {
+			t.Errorf("request for %q %v returned status %d instead of %d",
+				test.CommonName, test.DNSNames, status, test.Status)
+			continue
+		}
+
+		if cert == nil {
+			continue
+		}
+
+		leaf := cert.Leaf
+
+		if leaf.Subject.CommonName != test.CommonName {
+			t.Errorf("certificate common name is %q instead of %q",
+				leaf.Subject.CommonName, test.CommonName)
+		}
+
+		index, err := pki.LoadIndex()
+		if err != nil {
+			t.Fatalf("cannot load index: %v", err)
+		}
+
+		entry := index.EntryBySerialNumber("sub-ca", leaf.SerialNumber)
+		if entry == nil {
+			t.Errorf("certificate not found in index")
+		} else if !entry.ExternalPrivateKey {
+			t.Errorf("index entry is not marked as having an external " +
+				"private key")
+		}
+	}
+
+	// Wildcard patterns only apply to dns names; other names must be
+	// listed as is.
+	sanTests := []struct {
+		EmailAddresses []string
+		IPAddresses    []string
+		URIs           []string
+		Status         int
+	}{
+		{[]string{"alice@example.com"}, nil, nil, http.StatusOK},
+		{nil, []string{"192.0.2.1", "2001:db8::1"}, nil, http.StatusOK},
+		{nil, nil, []string{"https://a.example.com/alice"}, http.StatusOK},
+		{[]string{"evil@x.example.com"}, nil, nil, http.StatusForbidden},
+		{[]string{"bob@example.com"}, nil, nil, http.StatusForbidden},
+		{nil, []string{"192.0.2.2"}, nil, http.StatusForbidden},
+		{nil, nil, []string{"https://attacker.net/x.example.com"},
+			http.StatusForbidden},
+		{nil, nil, []string{"https://b.example.com"}, http.StatusForbidden},
+	}
+
+	for _, test := range sanTests {
+		template := x509.CertificateRequest{
+			Subject:        pkix.Name{CommonName: "a.example.com"},
+			EmailAddresses: test.EmailAddresses,
+		}
+
+		for _, address := range test.IPAddresses {
+			template.IPAddresses = append(template.IPAddresses,
+				net.ParseIP(address))
+		}
+
+		for _, value := range test.URIs {
+			uri, err := url.Parse(value)
+			if err != nil {
+				t.Fatalf("cannot parse uri %q: %v", value, err)
+			}
+
+			template.URIs = append(template.URIs, uri)
+		}
+
+		status, _ := c.EnrollRequest(t, s, "simpleenroll", &template)
+		if status != test.Status {
+			t.Errorf("request for %v %v %v returned status %d instead "+
+				"of %d", test.EmailAddresses, test.IPAddresses,
+				test.URIs, status, test.Status)
+		}
+	}
+}
+
+func TestESTReenrollment(t *testing.T) {
+	s := newTestESTServer(t)
+
+	subject := pkix.Name{CommonName: "a.example.com"}
+	dnsName := "a.example.com"
+
+	userClient := s.NewClient(t, nil)
+	userClient.UserName, userClient.Password = "alice", "password"
+
+	status, cert := userClient.Enroll(t, s, "simpleenroll", subject,
+		dnsName)
+	if status != http.StatusOK {
+		t.Fatalf("enrollment failed with status %d", status)
+	}
+
+	// Renewal requires a client certificate
+	status, _ = userClient.Enroll(t, s, "simplereenroll", subject, dnsName)
+	if status != http.StatusUnauthorized {
+		t.Errorf("renewal without client certificate returned status %d",
+			status)
+	}
+
+	certClient := s.NewClient(t, cert)
+
+	status, _ = certClient.Enroll(t, s, "simplereenroll",
+		pkix.Name{CommonName: "b.example.com"}, dnsName)
+	if status != http.StatusBadRequest {
+		t.Errorf("renewal with a different subject returned status %d",
+			status)
+	}
+
+	status, _ = certClient.Enroll(t, s, "simplereenroll", subject,
+		"b.example.com")
+	if status != http.StatusBadRequest {
+		t.Errorf("renewal with different names returned status %d",
+			status)
+	}
+
+	// Clients authenticated with a certificate can only enroll for the
+	// names of this certificate.
+	status, _ = certClient.Enroll(t, s, "simpleenroll",
+		pkix.Name{CommonName: "b.example.com"})
+	if status != http.StatusForbidden {
+		t.Errorf("enrollment for other names returned status %d", status)
+	}
+
+	status, _ = certClient.Enroll(t, s, "simplereenroll", subject, dnsName)
+	if status != http.StatusOK {
+		t.Fatalf("renewal failed with status %d", status)
+	}
+
+	// Revoked certificates cannot be used anymore
+	rc := CRLRevokedCert{
+		SerialNumber:   *new(big.Int).Set(cert.Leaf.SerialNumber),
+		RevocationDate: time.Now().UTC(),
+		Reason:         RevocationReasonKeyCompromise,
+	}
+
+	err := pki.WithTransaction(func() error {
+		return pki.AddRevokedCertificates("sub-ca", s.subCert, s.subKey,
+			[]CRLRevokedCert{rc})
+	})
+	if err != nil {
+		t.Fatalf("cannot revoke certificate: %v", err)
+	}
+
+	certClient = s.NewClient(t, cert)
+
+	status, _ = certClient.Enroll(t, s, "simplereenroll", subject, dnsName)
+	if status != http.StatusForbidden {
+		t.Errorf("renewal with a revoked certificate returned status %d",
+			status)
+	}
+}
+
+func TestLoadESTUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"),
+		bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	data := "# comment\n\n" +
+		"alice:" + string(hash) + "\n" +
+		"bob:" + string(hash) + ":b.example.com, *.example.org\n" +
+		"carol:" + string(hash) + ":https://c.example.com, 2001:db8::1\n"
+
+	filePath := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(filePath, []byte(data), 0600); err != nil {
+		t.Fatalf("cannot write %q: %v", filePath, err)
+	}
+
+	users, err := LoadESTUsers(filePath)
+	if err != nil {
+		t.Fatalf("cannot load users: %v", err)
+	}
+
+	expected := map[string][]string{
+		"alice": {"alice"},
+		"bob":   {"b.example.com", "*.example.org"},
+		"carol": {"https://c.example.com", "2001:db8::1"},
+	}
+
+	if len(users) != len(expected) {
+		t.Fatalf("%d users loaded instead of %d", len(users),
+			len(expected))
+	}
+
+	for name, names := range expected {
+		user, found := users[name]
+		if !found {
+			t.Errorf("user %q not found", name)
+			continue
+		}
+
+		if !bytes.Equal(user.PasswordHash, hash) {
+			t.Errorf("invalid password hash for user %q", name)
+		}
+
+		if !reflect.DeepEqual(user.Names, names) {
+			t.Errorf("names of user %q are %v instead of %v", name,
+				user.Names, names)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// See RFC 5280 5.3.1.
+
+var oidExtCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+type RevocationReason int
+
+const (
+	RevocationReasonUnspecified          RevocationReason = 0
+	RevocationReasonKeyCompromise        RevocationReason = 1
+	RevocationReasonCACompromise         RevocationReason = 2
+	RevocationReasonAffiliationChanged   RevocationReason = 3
+	RevocationReasonSuperseded           RevocationReason = 4
+	RevocationReasonCessationOfOperation RevocationReason = 5
+	RevocationReasonCertificateHold      RevocationReason = 6
+	RevocationReasonRemoveFromCRL        RevocationReason = 8
+	RevocationReasonPrivilegeWithdrawn   RevocationReason = 9
+	RevocationReasonAACompromise         RevocationReason = 10
+)
+
+var revocationReasonNames = map[RevocationReason]string{
+	RevocationReasonUnspecified:          "unspecified",
+	RevocationReasonKeyCompromise:        "keyCompromise",
+	RevocationReasonCACompromise:         "cACompromise",
+	RevocationReasonAffiliationChanged:   "affiliationChanged",
+	RevocationReasonSuperseded:           "superseded",
+	RevocationReasonCessationOfOperation: "cessationOfOperation",
+	RevocationReasonCertificateHold:      "certificateHold",
+	RevocationReasonRemoveFromCRL:        "removeFromCRL",
+	RevocationReasonPrivilegeWithdrawn:   "privilegeWithdrawn",
+	RevocationReasonAACompromise:         "aACompromise",
+}
+
+func (r RevocationReason) String() string {
+	if name, found := revocationReasonNames[r]; found {
+		return name
+	}
+
+	return fmt.Sprintf("unknown reason %d", int(r))
+}
+
+// Parse a revocation reason which can be used when revoking a certificate.
+// removeFromCRL only makes sense in delta CRLs and aACompromise applies to
+// attribute certificates, so they are not accepted.
+func ParseRevocationReason(s string) (RevocationReason, error) {
+	var names []string
+
+	for reason, name := range revocationReasonNames {
+		if reason == RevocationReasonRemoveFromCRL ||
+			reason == RevocationReasonAACompromise {
+			continue
+		}
+
+		if name == s {
+			return reason, nil
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return 0, fmt.Errorf("invalid revocation reason %q (valid reasons: "+
+		"%s)", s, strings.Join(names, ", "))
+}
+
+// Return the revocation reason corresponding to a numeric code, e.g. one
+// received by an enrollment server, with the same restrictions as
+// ParseRevocationReason.
+func RevocationReasonFromCode(code int) (RevocationReason, error) {
+	reason := RevocationReason(code)
+
+	if _, found := revocationReasonNames[reason]; !found ||
+		reason == RevocationReasonRemoveFromCRL ||
+		reason == RevocationReasonAACompromise {
+		return 0, fmt.Errorf("invalid revocation reason %d", code)
+	}
+
+	return reason, nil
+}
+
+type ExtCRLReason struct {
+	Reason RevocationReason
+}
+
+func (e *ExtCRLReason) Encode() ([]byte, error) {
+	return asn1.Marshal(asn1.Enumerated(e.Reason))
+}
+
+func (e *ExtCRLReason) Decode(data []byte) error {
+	var value asn1.Enumerated
+
+	rest, err := asn1.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("invalid trailing data")
+	}
+
+	e.Reason = RevocationReason(value)
+
+	return nil
+}
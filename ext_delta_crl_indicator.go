@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// See RFC 5280 5.2.4.
+
+var oidExtDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+
+type ExtDeltaCRLIndicator struct {
+	BaseCRLNumber *big.Int
+}
+
+func (e *ExtDeltaCRLIndicator) Encode() ([]byte, error) {
+	return asn1.Marshal(e.BaseCRLNumber)
+}
+
+func (e *ExtDeltaCRLIndicator) Decode(data []byte) error {
+	var number *big.Int
+
+	rest, err := asn1.Unmarshal(data, &number)
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("invalid trailing data")
+	}
+
+	e.BaseCRLNumber = number
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// See RFC 5280 5.2.6. The extension uses the same syntax as the CRL
+// distribution points certificate extension (RFC 5280 4.2.1.13); we only
+// support distribution points identified by a list of uris.
+
+var oidExtFreshestCRL = asn1.ObjectIdentifier{2, 5, 29, 46}
+
+type ExtFreshestCRL struct {
+	URIs []string
+}
+
+type distributionPointName struct {
+	FullName []asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+}
+
+const generalNameTagURI = 6
+
+func (e *ExtFreshestCRL) Encode() ([]byte, error) {
+	dp := distributionPoint{}
+
+	for _, uri := range e.URIs {
+		dp.DistributionPoint.FullName = append(
+			dp.DistributionPoint.FullName, asn1.RawValue{
+				Class: asn1.ClassContextSpecific,
+				Tag:   generalNameTagURI,
+				Bytes: []byte(uri),
+			})
+	}
+
+	return asn1.Marshal([]distributionPoint{dp})
+}
+
+func (e *ExtFreshestCRL) Decode(data []byte) error {
+	var dps []distributionPoint
+
+	rest, err := asn1.Unmarshal(data, &dps)
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("invalid trailing data")
+	}
+
+	var uris []string
+
+	for _, dp := range dps {
+		for _, name := range dp.DistributionPoint.FullName {
+			if name.Class != asn1.ClassContextSpecific ||
+				name.Tag != generalNameTagURI {
+				return fmt.Errorf("unsupported general name with "+
+					"tag %d", name.Tag)
+			}
+
+			uris = append(uris, string(name.Bytes))
+		}
+	}
+
+	e.URIs = uris
+
+	return nil
+}
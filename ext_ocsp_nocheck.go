@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// See RFC 6960 4.2.2.2.1. Clients do not check the revocation status of
+// certificates containing this extension; it is used for delegated OCSP
+// responders, whose certificates must then have a short lifetime.
+
+var oidExtOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+type ExtOCSPNoCheck struct{}
+
+func (e *ExtOCSPNoCheck) Encode() ([]byte, error) {
+	return asn1.NullBytes, nil
+}
+
+func (e *ExtOCSPNoCheck) Decode(data []byte) error {
+	var value asn1.RawValue
+
+	rest, err := asn1.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("invalid trailing data")
+	}
+
+	if value.Class != asn1.ClassUniversal || value.Tag != asn1.TagNull ||
+		len(value.Bytes) > 0 {
+		return errors.New("invalid null value")
+	}
+
+	return nil
+}
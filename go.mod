@@ -1,9 +1,10 @@
 module github.com/galdor/pki
 
-go 1.18
+go 1.19
 
 require (
 	github.com/galdor/go-program v0.0.0-20211009122042-697101964bb0
+	github.com/mattn/go-sqlite3 v1.14.16
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
 
@@ -0,0 +1,263 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// The index keeps track of every certificate issued by the PKI, along with
+// the name of its issuer.
+
+type IndexEntry struct {
+	Name         string    `json:"name"`
+	SerialNumber string    `json:"serialNumber"`
+	IssuerName   string    `json:"issuerName,omitempty"`
+	Subject      string    `json:"subject"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	IsCA         bool      `json:"isCA,omitempty"`
+
+	// The SHA-256 fingerprint of the certificate. Entries created before
+	// fingerprints were stored do not have one.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Set for certificates issued from a certificate request, whose
+	// private key is not stored in the pki.
+	ExternalPrivateKey bool `json:"externalPrivateKey,omitempty"`
+}
+
+type Index struct {
+	Entries []*IndexEntry `json:"entries"`
+}
+
+func NewIndexEntry(name, issuerName string, cert *x509.Certificate) *IndexEntry {
+	entry := IndexEntry{
+		Name:         name,
+		SerialNumber: serialNumberString(cert.SerialNumber),
+		IssuerName:   issuerName,
+		Subject:      cert.Subject.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		IsCA:         cert.IsCA,
+		SHA256:       certificateFingerprint(cert),
+	}
+
+	return &entry
+}
+
+func (i *Index) AddEntry(entry *IndexEntry) {
+	i.Entries = append(i.Entries, entry)
+}
+
+func (i *Index) EntryByName(name string) *IndexEntry {
+	for _, entry := range i.Entries {
+		if entry.Name == name {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func (i *Index) EntryBySerialNumber(issuerName string, serialNumber *big.Int) *IndexEntry {
+	s := serialNumberString(serialNumber)
+
+	for _, entry := range i.Entries {
+		if entry.IssuerName == issuerName && entry.SerialNumber == s {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Serial numbers are only unique for a given issuer: several certificates
+// issued by different cas can have the same serial number.
+func (i *Index) EntriesBySerialNumber(serialNumber *big.Int) []*IndexEntry {
+	s := serialNumberString(serialNumber)
+
+	var entries []*IndexEntry
+
+	for _, entry := range i.Entries {
+		if entry.SerialNumber == s {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Return the entries of all certificates issued directly or indirectly by a
+// ca, each ca being listed before the certificates it issued.
+func (i *Index) Descendants(name string) []*IndexEntry {
+	var entries []*IndexEntry
+
+	issuerNames := []string{name}
+	visited := map[string]bool{name: true}
+
+	for len(issuerNames) > 0 {
+		issuerName := issuerNames[0]
+		issuerNames = issuerNames[1:]
+
+		for _, entry := range i.Entries {
+			if entry.IssuerName != issuerName || visited[entry.Name] {
+				continue
+			}
+
+			visited[entry.Name] = true
+			entries = append(entries, entry)
+
+			if entry.IsCA {
+				issuerNames = append(issuerNames, entry.Name)
+			}
+		}
+	}
+
+	return entries
+}
+
+func (e *IndexEntry) SerialNumberValue() (*big.Int, error) {
+	serialNumber, ok := new(big.Int).SetString(e.SerialNumber, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number %q", e.SerialNumber)
+	}
+
+	return serialNumber, nil
+}
+
+// Return the index, loading it if necessary. PKIs created before the index
+// existed do not have one: it is then rebuilt from existing certificates.
+func (pki *PKI) LoadIndex() (*Index, error) {
+	if pki.index != nil {
+		return pki.index, nil
+	}
+
+	data, err := pki.Storage.ReadObject(ObjectTypeIndex, IndexObjectName)
+	if errors.Is(err, ErrObjectNotFound) {
+		index, err := pki.BuildIndex()
+		if err != nil {
+			return nil, fmt.Errorf("cannot build index: %w", err)
+		}
+
+		pki.index = index
+		return index, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read index: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	var index Index
+	if err := d.Decode(&index); err != nil {
+		return nil, fmt.Errorf("cannot decode index: %w", err)
+	}
+
+	pki.index = &index
+
+	return &index, nil
+}
+
+func (pki *PKI) AddIndexEntry(entry *IndexEntry) error {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	if index.EntryByName(entry.Name) != nil {
+		return fmt.Errorf("duplicate index entry %q", entry.Name)
+	}
+
+	index.AddEntry(entry)
+
+	return pki.WriteIndex()
+}
+
+func (pki *PKI) WriteIndex() error {
+	data, err := encodeJSON(pki.index)
+	if err != nil {
+		return fmt.Errorf("cannot encode index: %w", err)
+	}
+
+	return pki.createOrReplaceObject(ObjectTypeIndex, IndexObjectName, data)
+}
+
+func (pki *PKI) BuildIndex() (*Index, error) {
+	p.Info("building index")
+
+	names, err := pki.Storage.ListObjects(ObjectTypeCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list certificates: %w", err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range names {
+		cert, err := pki.LoadCertificate(name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load certificate %q: %w",
+				name, err)
+		}
+
+		certs[name] = cert
+	}
+
+	var index Index
+
+	for _, name := range names {
+		cert := certs[name]
+
+		var issuerName string
+		for caName, caCert := range certs {
+			if caCert.IsCA && isIssuedBy(cert, caCert) {
+				issuerName = caName
+				break
+			}
+		}
+
+		if issuerName == "" {
+			p.Info("cannot find the issuer of certificate %q", name)
+		}
+
+		index.AddEntry(NewIndexEntry(name, issuerName, cert))
+	}
+
+	return &index, nil
+}
+
+func isIssuedBy(cert, issuerCert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, issuerCert.RawSubject) {
+		return false
+	}
+
+	return cert.CheckSignatureFrom(issuerCert) == nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+func serialNumberString(n *big.Int) string {
+	return fmt.Sprintf("%x", n)
+}
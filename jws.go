@@ -0,0 +1,289 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ACME messages are signed with JSON Web Signatures (RFC 7515) in the
+// flattened JSON serialization (RFC 8555 6.2). Accounts are identified by
+// their public key, a JSON Web Key (RFC 7517).
+
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type JWSHeader struct {
+	Algorithm string          `json:"alg"`
+	Nonce     string          `json:"nonce"`
+	URL       string          `json:"url"`
+	JWK       json.RawMessage `json:"jwk,omitempty"`
+	KeyID     string          `json:"kid,omitempty"`
+}
+
+type JWK struct {
+	KeyType string `json:"kty"`
+
+	// EC and OKP keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+var base64URL = base64.RawURLEncoding
+
+// Decode a JWS, returning its header and payload. The signature is verified
+// separately since the key is either in the header or the one of an
+// existing account.
+func ParseJWS(data []byte) (*JWS, *JWSHeader, []byte, error) {
+	var jws JWS
+	if err := json.Unmarshal(data, &jws); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid jws: %w", err)
+	}
+
+	headerData, err := base64URL.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header: %w",
+			err)
+	}
+
+	var header JWSHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header: %w",
+			err)
+	}
+
+	payload, err := base64URL.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	return &jws, &header, payload, nil
+}
+
+func (jws *JWS) Verify(algorithm string, key crypto.PublicKey) error {
+	signature, err := base64URL.DecodeString(jws.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm does not match the key")
+		}
+
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:],
+			signature)
+
+	case "ES256", "ES384", "ES512":
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm does not match the key")
+		}
+
+		var curve elliptic.Curve
+		var digest []byte
+
+		switch algorithm {
+		case "ES256":
+			curve = elliptic.P256()
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case "ES384":
+			curve = elliptic.P384()
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		case "ES512":
+			curve = elliptic.P521()
+			sum := sha512.Sum512(signingInput)
+			digest = sum[:]
+		}
+
+		if ecdsaKey.Curve != curve {
+			return errors.New("algorithm does not match the key")
+		}
+
+		// Signatures are the concatenation of r and s (RFC 7518 3.4)
+		size := (curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature size")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(ecdsaKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+
+	case "EdDSA":
+		ed25519Key, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("algorithm does not match the key")
+		}
+
+		if !ed25519.Verify(ed25519Key, signingInput, signature) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+}
+
+func ParseJWK(data []byte) (crypto.PublicKey, error) {
+	var jwk JWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid jwk: %w", err)
+	}
+
+	decode := func(name, s string) (*big.Int, error) {
+		data, err := base64URL.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid %q member", name)
+		}
+
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+
+		if n.BitLen() < 2048 {
+			return nil, errors.New("rsa keys must contain at least " +
+				"2048 bits")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+
+		x, err := base64URL.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid \"x\" member")
+		}
+
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+}
+
+// Return the thumbprint of a key (RFC 7638), i.e. the base64url-encoded
+// SHA-256 digest of the canonical JSON representation of the key: required
+// members only, in lexicographic order, without whitespace.
+func JWKThumbprint(key crypto.PublicKey) (string, error) {
+	var s string
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(k.E)).Bytes()
+		s = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			base64URL.EncodeToString(e),
+			base64URL.EncodeToString(k.N.Bytes()))
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		s = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			k.Curve.Params().Name,
+			base64URL.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			base64URL.EncodeToString(k.Y.FillBytes(make([]byte, size))))
+
+	case ed25519.PublicKey:
+		s = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`,
+			base64URL.EncodeToString(k))
+
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+
+	digest := sha256.Sum256([]byte(s))
+
+	return base64URL.EncodeToString(digest[:]), nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The PKI is protected by an advisory lock: commands which modify the PKI
+// hold it exclusively while commands which only read data hold it in shared
+// mode. The lock is released when the process exits.
+
+type LockMode int
+
+const (
+	LockModeShared LockMode = iota
+	LockModeExclusive
+)
+
+func (mode LockMode) String() string {
+	switch mode {
+	case LockModeShared:
+		return "shared"
+	case LockModeExclusive:
+		return "exclusive"
+	default:
+		return fmt.Sprintf("unknown lock mode %d", mode)
+	}
+}
+
+const DefaultLockTimeout = 10 * time.Second
+
+func (pki *PKI) Lock(mode LockMode) error {
+	p.Info("acquiring %v lock on %s", mode, pki.Storage.Location())
+
+	if err := pki.Storage.Lock(mode, pki.LockTimeout); err != nil {
+		return err
+	}
+
+	pki.lockMode = mode
+
+	return nil
+}
+
+func (pki *PKI) Unlock() error {
+	return pki.Storage.Unlock()
+}
+
+// Run a function while holding the lock. Servers release the lock acquired
+// at startup and only lock the pki when they access it, so that other
+// commands can run in the meantime. Cached data are discarded since other
+// processes may have modified the pki.
+func (pki *PKI) WithLock(mode LockMode, fn func() error) error {
+	pki.mutex.Lock()
+	defer pki.mutex.Unlock()
+
+	if err := pki.Lock(mode); err != nil {
+		return fmt.Errorf("cannot lock pki: %w", err)
+	}
+
+	defer func() {
+		if err := pki.Unlock(); err != nil {
+			p.Error("cannot unlock pki: %v", err)
+		}
+	}()
+
+	pki.index = nil
+
+	return fn()
+}
+
+// A file lock is a flock(2) lock on a dedicated file, used by storage
+// backends which live on the local filesystem.
+type FileLock struct {
+	Path string
+
+	file *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{Path: path}
+}
+
+func (l *FileLock) Lock(mode LockMode, timeout time.Duration) error {
+	if l.file != nil {
+		return errors.New("lock already acquired")
+	}
+
+	file, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", l.Path, err)
+	}
+
+	how := syscall.LOCK_SH
+	if mode == LockModeExclusive {
+		how = syscall.LOCK_EX
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			file.Close()
+			return fmt.Errorf("cannot lock %q: %w", l.Path, err)
+		}
+
+		if time.Now().After(deadline) {
+			file.Close()
+			return fmt.Errorf("timeout while waiting for lock on %q",
+				l.Path)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	l.file = file
+
+	return nil
+}
+
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return errors.New("lock not acquired")
+	}
+
+	file := l.file
+	l.file = nil
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot unlock %q: %w", l.Path, err)
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// Commands referring to a certificate accept either:
+//
+// - the name of the certificate in the pki;
+// - "serial:<hex>", the serial number of the certificate;
+// - "sha256:<hex>", the SHA-256 fingerprint of the certificate;
+// - the path of a PEM file containing the certificate, which must contain a
+//   path separator (e.g. "./example.crt").
+//
+// Hexadecimal strings may contain colons (e.g. "0a:1b:2c").
+//
+// In all cases the certificate must belong to the pki.
+
+func (pki *PKI) ResolveCertificate(ref string) (string, *x509.Certificate, error) {
+	switch {
+	case strings.HasPrefix(ref, "serial:"):
+		return pki.findCertificateBySerialNumber(
+			strings.TrimPrefix(ref, "serial:"))
+
+	case strings.HasPrefix(ref, "sha256:"):
+		fingerprint, err := parseHexReference(
+			strings.TrimPrefix(ref, "sha256:"))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid fingerprint: %w", err)
+		} else if len(fingerprint) != sha256.Size {
+			return "", nil, fmt.Errorf("invalid fingerprint: sha256 "+
+				"fingerprints must contain %d bytes", sha256.Size)
+		}
+
+		return pki.findCertificateByFingerprint(fingerprint)
+
+	case strings.Contains(ref, "/"):
+		data, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot read %q: %w", ref, err)
+		}
+
+		cert, err := decodePEMCertificate(data)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot load %q: %w", ref, err)
+		}
+
+		fingerprint := sha256.Sum256(cert.Raw)
+
+		name, _, err := pki.findCertificateByFingerprint(fingerprint[:])
+		if err != nil {
+			return "", nil, fmt.Errorf("certificate in %q: %w", ref, err)
+		}
+
+		return name, cert, nil
+
+	default:
+		cert, err := pki.LoadCertificate(ref)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return ref, cert, nil
+	}
+}
+
+// Resolve a certificate reference to a certificate name.
+func (pki *PKI) ResolveCertificateName(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "serial:"), strings.HasPrefix(ref, "sha256:"),
+		strings.Contains(ref, "/"):
+		name, _, err := pki.ResolveCertificate(ref)
+		return name, err
+
+	default:
+		return ref, nil
+	}
+}
+
+// Resolve a certificate reference to the entry of the certificate in the
+// index. Serial numbers and names are resolved using the index only, so that
+// certificates whose file is not available can still be referenced.
+func (pki *PKI) ResolveIndexEntry(ref string) (*IndexEntry, error) {
+	if strings.HasPrefix(ref, "serial:") {
+		serialNumber, err := parseSerialNumberReference(
+			strings.TrimPrefix(ref, "serial:"))
+		if err != nil {
+			return nil, err
+		}
+
+		return pki.findIndexEntryBySerialNumber(serialNumber)
+	}
+
+	name, err := pki.ResolveCertificateName(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := index.EntryByName(name)
+	if entry == nil {
+		return nil, fmt.Errorf("certificate %q not found in index", name)
+	}
+
+	return entry, nil
+}
+
+func (pki *PKI) findCertificateBySerialNumber(s string) (string, *x509.Certificate, error) {
+	serialNumber, err := parseSerialNumberReference(s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entry, err := pki.findIndexEntryBySerialNumber(serialNumber)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cert, err := pki.LoadCertificate(entry.Name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return entry.Name, cert, nil
+}
+
+func (pki *PKI) findIndexEntryBySerialNumber(serialNumber *big.Int) (*IndexEntry, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := index.EntriesBySerialNumber(serialNumber)
+
+	switch len(entries) {
+	case 0:
+		return nil, fmt.Errorf("no certificate found with serial "+
+			"number %s", serialNumberString(serialNumber))
+
+	case 1:
+		return entries[0], nil
+
+	default:
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name
+		}
+
+		return nil, fmt.Errorf("multiple certificates found with "+
+			"serial number %s: %s", serialNumberString(serialNumber),
+			strings.Join(names, ", "))
+	}
+}
+
+func (pki *PKI) findCertificateByFingerprint(fingerprint []byte) (string, *x509.Certificate, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s := hex.EncodeToString(fingerprint)
+
+	for _, entry := range index.Entries {
+		if entry.SHA256 != "" {
+			if entry.SHA256 != s {
+				continue
+			}
+
+			cert, err := pki.LoadCertificate(entry.Name)
+			if err != nil {
+				return "", nil, err
+			}
+
+			return entry.Name, cert, nil
+		}
+
+		// Older entries do not contain the fingerprint of the
+		// certificate, which has to be loaded if it is still available.
+		data, err := pki.Storage.ReadObject(ObjectTypeCertificate,
+			entry.Name)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		cert, err := decodePEMCertificate(data)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot load certificate %q: %w",
+				entry.Name, err)
+		}
+
+		if certificateFingerprint(cert) == s {
+			return entry.Name, cert, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("no certificate found with fingerprint %s",
+		s)
+}
+
+func parseHexReference(s string) ([]byte, error) {
+	s = strings.ReplaceAll(s, ":", "")
+
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string")
+	} else if len(data) == 0 {
+		return nil, fmt.Errorf("empty hex string")
+	}
+
+	return data, nil
+}
+
+func parseSerialNumberReference(s string) (*big.Int, error) {
+	data, err := parseHexReference(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid serial number: %w", err)
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
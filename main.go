@@ -15,29 +15,102 @@
 package main
 
 import (
+	"math"
+	"strconv"
+	"time"
+
 	"github.com/galdor/go-program"
 )
 
 var p *program.Program
 var pki *PKI
 
+// Commands which do not modify the pki only require a shared lock.
+var readOnlyCommands = map[string]bool{
+	"backup-pki":             true,
+	"check-configuration":    true,
+	"generate-ocsp-response": true,
+	"print-certificate":      true,
+	"print-crl":              true,
+	"serve-ocsp":             true,
+	"serve-repository":       true,
+	"verify-pki":             true,
+}
+
+// Commands which read the configuration themselves.
+var noConfigurationCommands = map[string]bool{
+	"check-configuration": true,
+}
+
+// Commands which do not operate on an existing pki.
+var standaloneCommands = map[string]bool{
+	"help":           true,
+	"initialize-pki": true,
+	"restore-pki":    true,
+}
+
 func main() {
 	p = program.NewProgram("pki", "public key infrastructure management")
 
-	p.AddOption("d", "directory", "path", ".", "the path of the pki directory")
+	p.AddOption("d", "directory", "path", ".",
+		"the path of the pki directory or database")
+	p.AddOption("", "storage", "type", "directory",
+		"the type of storage used for the pki (directory or sqlite)")
+	p.AddOption("", "lock-timeout", "seconds", "10",
+		"the maximum time to wait for the pki lock")
 
 	addCmdInitializePKI(p)
+	addCmdCreateRootCA(p)
 	addCmdCreateCertificate(p)
+	addCmdCreateSCEPChallenge(p)
 	addCmdPrintCertificate(p)
+	addCmdPrintCRL(p)
 	addCmdRevokeCertificate(p)
+	addCmdReleaseCertificate(p)
+	addCmdUpdateCRL(p)
+	addCmdGenerateOCSPResponse(p)
+	addCmdRotateOCSPSigner(p)
+	addCmdServeACME(p)
+	addCmdServeEST(p)
+	addCmdServeSCEP(p)
+	addCmdServeOCSP(p)
+	addCmdServeRepository(p)
+	addCmdBackupPKI(p)
+	addCmdRestorePKI(p)
+	addCmdCheckConfiguration(p)
+	addCmdVerifyPKI(p)
 
 	p.ParseCommandLine()
 
 	pkiPath := p.OptionValue("directory")
-	pki = NewPKI(pkiPath)
-	if p.CommandName() != "help" && p.CommandName() != "initialize-pki" {
-		if err := pki.LoadConfiguration(); err != nil {
-			p.Fatal("cannot load pki configuration: %v", err)
+	storage, err := NewStorage(p.OptionValue("storage"), pkiPath)
+	if err != nil {
+		p.Fatal("%v", err)
+	}
+
+	pki = NewPKI(storage)
+
+	lockTimeoutString := p.OptionValue("lock-timeout")
+	i64, err := strconv.ParseInt(lockTimeoutString, 10, 64)
+	if err != nil || i64 < 0 || i64 > math.MaxInt32 {
+		p.Fatal("invalid lock timeout")
+	}
+	pki.LockTimeout = time.Duration(i64) * time.Second
+
+	if !standaloneCommands[p.CommandName()] {
+		lockMode := LockModeExclusive
+		if readOnlyCommands[p.CommandName()] {
+			lockMode = LockModeShared
+		}
+
+		if err := pki.Lock(lockMode); err != nil {
+			p.Fatal("cannot lock pki: %v", err)
+		}
+
+		if !noConfigurationCommands[p.CommandName()] {
+			if err := pki.LoadConfiguration(); err != nil {
+				p.Fatal("cannot load pki configuration: %v", err)
+			}
 		}
 	}
 
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 func encodeJSON(value interface{}) ([]byte, error) {
@@ -21,40 +24,121 @@ func encodeJSON(value interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Parse either a RFC 3339 date-time or a date, the latter being interpreted
+// as midnight UTC.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+
+	return t, nil
+}
+
 func createFile(filePath string, data []byte, mode os.FileMode) error {
-	return writeFile(filePath, data, mode, os.O_EXCL)
+	return writeFile(filePath, data, mode, false)
 }
 
 func createOrReplaceFile(filePath string, data []byte, mode os.FileMode) error {
-	return writeFile(filePath, data, mode, os.O_TRUNC)
+	return writeFile(filePath, data, mode, true)
 }
 
-func writeFile(filePath string, data []byte, mode os.FileMode, flags int) error {
+// Files are never written in place: data are first written to a temporary
+// file in the same directory, then moved to their final location, so that
+// readers always see either the old content or the new one, even if the
+// process is interrupted.
+func writeFile(filePath string, data []byte, mode os.FileMode, replace bool) error {
 	dirPath := filepath.Dir(filePath)
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
 		return fmt.Errorf("cannot create directory %q: %w",
 			dirPath, err)
 	}
 
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|flags,
-		mode)
-	if os.IsExist(err) {
-		return fmt.Errorf("%q already exists", filePath)
-	} else if err != nil {
-		return fmt.Errorf("cannot open %q: %w", filePath, err)
+	tmpPath, err := writeTemporaryFile(dirPath, filepath.Base(filePath),
+		data, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if replace {
+		if err := os.Rename(tmpPath, filePath); err != nil {
+			return fmt.Errorf("cannot rename %q to %q: %w",
+				tmpPath, filePath, err)
+		}
+	} else {
+		// Linking the temporary file fails if the destination
+		// exists, which gives us the same guarantee as O_EXCL.
+		if err := os.Link(tmpPath, filePath); os.IsExist(err) {
+			return fmt.Errorf("%q already exists", filePath)
+		} else if err != nil {
+			return fmt.Errorf("cannot link %q to %q: %w",
+				tmpPath, filePath, err)
+		}
+	}
+
+	return syncDirectory(dirPath)
+}
+
+func writeTemporaryFile(dirPath, baseName string, data []byte, mode os.FileMode) (string, error) {
+	file, err := os.CreateTemp(dirPath, "."+baseName+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary file in %q: %w",
+			dirPath, err)
+	}
+
+	tmpPath := file.Name()
+
+	fail := func(err error) (string, error) {
+		file.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := file.Chmod(mode); err != nil {
+		return fail(fmt.Errorf("cannot chmod %q: %w", tmpPath, err))
 	}
 
 	if _, err := file.Write(data); err != nil {
-		return fmt.Errorf("cannot write %q: %w", filePath, err)
+		return fail(fmt.Errorf("cannot write %q: %w", tmpPath, err))
 	}
 
 	if err := file.Sync(); err != nil {
-		return fmt.Errorf("cannot sync %q: %w", filePath, err)
+		return fail(fmt.Errorf("cannot sync %q: %w", tmpPath, err))
 	}
 
 	if err := file.Close(); err != nil {
-		return fmt.Errorf("cannot close %q: %w", filePath, err)
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("cannot close %q: %w", tmpPath, err)
+	}
+
+	return tmpPath, nil
+}
+
+func syncDirectory(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", dirPath, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %q: %w", dirPath, err)
 	}
 
 	return nil
 }
+
+// Generate a random identifier suitable for object names and urls.
+func generateRandomID() string {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		panic(fmt.Sprintf("cannot generate random data: %v", err))
+	}
+
+	return hex.EncodeToString(data)
+}
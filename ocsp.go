@@ -0,0 +1,495 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// See RFC 6960. Requests can contain several certificates and carry a nonce
+// extension (RFC 8954), and responses echo this nonce in their response
+// extensions, so we encode and decode messages ourselves.
+
+var (
+	oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidExtOCSPNonce      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+	oidHashSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidHashSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidHashSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidHashSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// RFC 8954 2.1: nonces must contain between 1 and 32 octets.
+const maxOCSPNonceLength = 32
+
+type OCSPResponseStatus int
+
+const (
+	OCSPResponseStatusSuccessful       OCSPResponseStatus = 0
+	OCSPResponseStatusMalformedRequest OCSPResponseStatus = 1
+	OCSPResponseStatusInternalError    OCSPResponseStatus = 2
+	OCSPResponseStatusTryLater         OCSPResponseStatus = 3
+	OCSPResponseStatusSigRequired      OCSPResponseStatus = 5
+	OCSPResponseStatusUnauthorized     OCSPResponseStatus = 6
+)
+
+type OCSPCertStatus int
+
+const (
+	OCSPCertStatusGood OCSPCertStatus = iota
+	OCSPCertStatusRevoked
+	OCSPCertStatusUnknown
+)
+
+func (s OCSPCertStatus) String() string {
+	switch s {
+	case OCSPCertStatusGood:
+		return "good"
+	case OCSPCertStatusRevoked:
+		return "revoked"
+	case OCSPCertStatusUnknown:
+		return "unknown"
+	default:
+		return fmt.Sprintf("unknown status %d", int(s))
+	}
+}
+
+type OCSPCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest        ocspTBSRequest
+	OptionalSignature asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []ocspSingleRequest
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspSingleRequest struct {
+	ReqCert                 OCSPCertID
+	SingleRequestExtensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponse struct {
+	ResponseStatus asn1.Enumerated
+	ResponseBytes  ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           OCSPCertID
+	CertStatus       asn1.RawValue
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime   time.Time       `asn1:"generalized"`
+	RevocationReason asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type OCSPRequest struct {
+	CertIDs []OCSPCertID
+	Nonce   []byte
+}
+
+func ParseOCSPRequest(data []byte) (*OCSPRequest, error) {
+	var req ocspRequest
+
+	rest, err := asn1.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("invalid trailing data")
+	}
+
+	if len(req.TBSRequest.RequestList) == 0 {
+		return nil, errors.New("empty request list")
+	}
+
+	var r OCSPRequest
+
+	for _, singleReq := range req.TBSRequest.RequestList {
+		r.CertIDs = append(r.CertIDs, singleReq.ReqCert)
+	}
+
+	for _, ext := range req.TBSRequest.RequestExtensions {
+		if !ext.Id.Equal(oidExtOCSPNonce) {
+			continue
+		}
+
+		var nonce []byte
+		if _, err := asn1.Unmarshal(ext.Value, &nonce); err != nil {
+			return nil, fmt.Errorf("invalid nonce: %w", err)
+		}
+
+		if len(nonce) == 0 || len(nonce) > maxOCSPNonceLength {
+			return nil, fmt.Errorf("invalid nonce: nonces must contain "+
+				"between 1 and %d bytes", maxOCSPNonceLength)
+		}
+
+		r.Nonce = nonce
+	}
+
+	return &r, nil
+}
+
+// Return the certificate identifier of a certificate issued by a ca, using
+// a specific hash algorithm.
+func NewOCSPCertID(issuerCert *x509.Certificate, serialNumber *big.Int, hash crypto.Hash) (*OCSPCertID, error) {
+	var oid asn1.ObjectIdentifier
+
+	switch hash {
+	case crypto.SHA1:
+		oid = oidHashSHA1
+	case crypto.SHA256:
+		oid = oidHashSHA256
+	case crypto.SHA384:
+		oid = oidHashSHA384
+	case crypto.SHA512:
+		oid = oidHashSHA512
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+
+	keyData, err := publicKeyData(issuerCert)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(issuerCert.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(keyData)
+	keyHash := h.Sum(nil)
+
+	id := OCSPCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oid,
+			Parameters: asn1.NullRawValue,
+		},
+		IssuerNameHash: nameHash,
+		IssuerKeyHash:  keyHash,
+		SerialNumber:   serialNumber,
+	}
+
+	return &id, nil
+}
+
+func (id *OCSPCertID) Hash() (crypto.Hash, error) {
+	switch oid := id.HashAlgorithm.Algorithm; {
+	case oid.Equal(oidHashSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidHashSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidHashSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidHashSHA512):
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %v", oid)
+	}
+}
+
+// Return true if a certificate identifier refers to a certificate issued by
+// a ca.
+func (id *OCSPCertID) MatchesIssuer(issuerCert *x509.Certificate) bool {
+	hash, err := id.Hash()
+	if err != nil {
+		return false
+	}
+
+	issuerID, err := NewOCSPCertID(issuerCert, id.SerialNumber, hash)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(id.IssuerNameHash, issuerID.IssuerNameHash) &&
+		bytes.Equal(id.IssuerKeyHash, issuerID.IssuerKeyHash)
+}
+
+// The content of the subject public key bit string, as used for key hashes.
+func publicKeyData(cert *x509.Certificate) ([]byte, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	_, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key: %w", err)
+	}
+
+	return publicKeyInfo.PublicKey.RightAlign(), nil
+}
+
+type OCSPSingleResponse struct {
+	CertID           OCSPCertID
+	Status           OCSPCertStatus
+	RevocationDate   time.Time
+	RevocationReason RevocationReason
+	ThisUpdate       time.Time
+	NextUpdate       time.Time
+}
+
+// An OCSP signer is either the ca itself or a delegated responder whose
+// certificate was issued by the ca for this purpose.
+type OCSPSigner struct {
+	IssuerName      string
+	IssuerCert      *x509.Certificate
+	CertificateName string
+	Certificate     *x509.Certificate
+	Key             crypto.Signer
+}
+
+func (s *OCSPSigner) IsDelegated() bool {
+	return s.Certificate != s.IssuerCert
+}
+
+func CreateOCSPResponse(signer *OCSPSigner, responses []OCSPSingleResponse, nonce []byte) ([]byte, error) {
+	keyData, err := publicKeyData(signer.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	// Responders are identified by the hash of their key (RFC 6960
+	// 4.2.1)
+	keyHash := sha1.Sum(keyData)
+
+	keyHashData, err := asn1.Marshal(keyHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	responseData := ocspResponseData{
+		ResponderID: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        2,
+			IsCompound: true,
+			Bytes:      keyHashData,
+		},
+		ProducedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	for _, r := range responses {
+		singleResponse, err := r.encode()
+		if err != nil {
+			return nil, err
+		}
+
+		responseData.Responses = append(responseData.Responses,
+			*singleResponse)
+	}
+
+	if nonce != nil {
+		value, err := asn1.Marshal(nonce)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode nonce: %w", err)
+		}
+
+		responseData.ResponseExtensions = []pkix.Extension{{
+			Id:    oidExtOCSPNonce,
+			Value: value,
+		}}
+	}
+
+	tbsData, err := asn1.Marshal(responseData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode response data: %w", err)
+	}
+
+	signatureAlgorithm, signature, err := signOCSPData(signer.Key, tbsData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign response: %w", err)
+	}
+
+	basicResponse := ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbsData},
+		SignatureAlgorithm: signatureAlgorithm,
+		Signature: asn1.BitString{
+			Bytes:     signature,
+			BitLength: len(signature) * 8,
+		},
+	}
+
+	// Clients need the certificate of a delegated responder to verify
+	// the response (RFC 6960 4.2.2.2).
+	if signer.IsDelegated() {
+		basicResponse.Certs = []asn1.RawValue{
+			{FullBytes: signer.Certificate.Raw},
+		}
+	}
+
+	basicResponseData, err := asn1.Marshal(basicResponse)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode basic response: %w", err)
+	}
+
+	return asn1.Marshal(ocspResponse{
+		ResponseStatus: asn1.Enumerated(OCSPResponseStatusSuccessful),
+		ResponseBytes: ocspResponseBytes{
+			ResponseType: oidOCSPBasicResponse,
+			Response:     basicResponseData,
+		},
+	})
+}
+
+func (r *OCSPSingleResponse) encode() (*ocspSingleResponse, error) {
+	var status asn1.RawValue
+
+	switch r.Status {
+	case OCSPCertStatusGood:
+		status = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+
+	case OCSPCertStatusRevoked:
+		info := ocspRevokedInfo{
+			RevocationTime: r.RevocationDate.UTC(),
+		}
+
+		// As for CRL entries, the reason is absent when unspecified.
+		if r.RevocationReason != RevocationReasonUnspecified {
+			info.RevocationReason = asn1.Enumerated(r.RevocationReason)
+		}
+
+		data, err := asn1.Marshal(info)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode revoked info: %w", err)
+		}
+
+		// The status uses implicit tagging: we replace the sequence tag
+		// of the revoked info structure.
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(data, &seq); err != nil {
+			return nil, fmt.Errorf("cannot decode revoked info: %w", err)
+		}
+
+		status = asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        1,
+			IsCompound: true,
+			Bytes:      seq.Bytes,
+		}
+
+	case OCSPCertStatusUnknown:
+		status = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}
+
+	default:
+		return nil, fmt.Errorf("invalid certificate status %v", r.Status)
+	}
+
+	response := ocspSingleResponse{
+		CertID:     r.CertID,
+		CertStatus: status,
+		ThisUpdate: r.ThisUpdate.UTC(),
+		NextUpdate: r.NextUpdate.UTC(),
+	}
+
+	return &response, nil
+}
+
+func signOCSPData(key crypto.Signer, data []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	var algorithm pkix.AlgorithmIdentifier
+
+	publicKey, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return algorithm, nil, fmt.Errorf("unsupported key type %T",
+			key.Public())
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+
+	switch publicKey.Curve {
+	case elliptic.P256():
+		hash, algorithm.Algorithm = crypto.SHA256, oidSignatureECDSAWithSHA256
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case elliptic.P384():
+		hash, algorithm.Algorithm = crypto.SHA384, oidSignatureECDSAWithSHA384
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		hash, algorithm.Algorithm = crypto.SHA512, oidSignatureECDSAWithSHA512
+		sum := sha512.Sum512(data)
+		digest = sum[:]
+	}
+
+	signature, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return algorithm, nil, err
+	}
+
+	return algorithm, signature, nil
+}
+
+func OCSPErrorResponse(status OCSPResponseStatus) []byte {
+	data, err := asn1.Marshal(ocspResponse{
+		ResponseStatus: asn1.Enumerated(status),
+	})
+	if err != nil {
+		panic(fmt.Sprintf("cannot encode ocsp error response: %v", err))
+	}
+
+	return data
+}
@@ -0,0 +1,372 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default number of hours during which an OCSP response is valid.
+const DefaultOCSPResponseValidity = 24
+
+// Requests are small; anything larger is not a valid OCSP request.
+const maxOCSPRequestSize = 64 * 1024
+
+func (pki *PKI) OCSPResponseValidity(issuerName string) time.Duration {
+	validity := DefaultOCSPResponseValidity
+
+	if cfg := pki.CACfg(issuerName).OCSP; cfg != nil && cfg.Validity > 0 {
+		validity = cfg.Validity
+	}
+
+	return time.Duration(validity) * time.Hour
+}
+
+// The revocation status of the certificates issued by a ca at a specific
+// point in time. Certificates which are not in the index were not issued by
+// the pki and have an unknown status.
+type RevocationStatus struct {
+	IssuerName string
+	Date       time.Time
+
+	serialNumbers map[string]bool
+	crlData       *CRLData
+}
+
+func (pki *PKI) LoadRevocationStatus(issuerName string) (*RevocationStatus, error) {
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumbers := make(map[string]bool)
+
+	for _, entry := range index.Entries {
+		if entry.IssuerName == issuerName {
+			serialNumbers[entry.SerialNumber] = true
+		}
+	}
+
+	crlData, err := pki.LoadCRLData(issuerName)
+	if err != nil {
+		return nil, err
+	}
+
+	deltaCRLData, err := pki.LoadDeltaCRLData(issuerName)
+	if err != nil {
+		return nil, err
+	}
+
+	crlData.MergeRevokedCerts(deltaCRLData)
+
+	status := RevocationStatus{
+		IssuerName: issuerName,
+		Date:       time.Now().UTC().Truncate(time.Second),
+
+		serialNumbers: serialNumbers,
+		crlData:       crlData,
+	}
+
+	return &status, nil
+}
+
+// Return the status of a certificate. Certificates on hold are reported as
+// revoked with the certificateHold reason (RFC 6960 2.2).
+func (s *RevocationStatus) CertificateStatus(serialNumber *big.Int) (OCSPCertStatus, *CRLRevokedCert) {
+	if !s.serialNumbers[serialNumberString(serialNumber)] {
+		return OCSPCertStatusUnknown, nil
+	}
+
+	if rc := s.crlData.RevokedCert(serialNumber); rc != nil {
+		return OCSPCertStatusRevoked, rc
+	}
+
+	return OCSPCertStatusGood, nil
+}
+
+// Build the response for a set of certificates issued by the same ca.
+func CreateOCSPStatusResponse(signer *OCSPSigner, status *RevocationStatus, validity time.Duration, certIDs []OCSPCertID, nonce []byte) ([]byte, error) {
+	responses := make([]OCSPSingleResponse, len(certIDs))
+
+	for i, certID := range certIDs {
+		certStatus, rc := status.CertificateStatus(certID.SerialNumber)
+
+		response := OCSPSingleResponse{
+			CertID:     certID,
+			Status:     certStatus,
+			ThisUpdate: status.Date,
+			NextUpdate: status.Date.Add(validity),
+		}
+
+		if rc != nil {
+			response.RevocationDate = rc.RevocationDate
+			response.RevocationReason = rc.Reason
+		}
+
+		responses[i] = response
+	}
+
+	return CreateOCSPResponse(signer, responses, nonce)
+}
+
+// Generate the response for a single certificate of the pki, e.g. to be
+// stapled by a server. There is no request, so no nonce; the certificate is
+// identified with SHA-1 hashes, which is what most clients use to look for
+// the response matching a certificate.
+func (pki *PKI) GenerateOCSPResponse(entry *IndexEntry, signer *OCSPSigner, status *RevocationStatus) ([]byte, error) {
+	serialNumber, err := entry.SerialNumberValue()
+	if err != nil {
+		return nil, err
+	}
+
+	certID, err := NewOCSPCertID(signer.IssuerCert, serialNumber,
+		crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := pki.OCSPResponseValidity(entry.IssuerName)
+
+	return CreateOCSPStatusResponse(signer, status, validity,
+		[]OCSPCertID{*certID}, nil)
+}
+
+// An OCSP responder answering requests for all the cas of the pki over HTTP
+// (RFC 6960 Appendix A). Revocation data are loaded in memory and reloaded
+// with Refresh.
+type OCSPResponder struct {
+	PKI *PKI
+
+	mutex      sync.Mutex
+	signers    []*OCSPSigner
+	statuses   map[string]*RevocationStatus
+	validities map[string]time.Duration
+}
+
+func NewOCSPResponder(pki *PKI, signers []*OCSPSigner) *OCSPResponder {
+	r := OCSPResponder{
+		PKI: pki,
+
+		signers: signers,
+	}
+
+	return &r
+}
+
+// Reload the configuration and revocation data for all cas. Delegated
+// responder certificates which have been rotated since the last refresh are
+// replaced by the new ones. The caller is responsible for locking the pki.
+func (r *OCSPResponder) Refresh() error {
+	if err := r.PKI.LoadConfiguration(); err != nil {
+		return fmt.Errorf("cannot load configuration: %w", err)
+	}
+
+	// Another process may have issued or revoked certificates since the
+	// index was loaded.
+	r.PKI.index = nil
+
+	r.mutex.Lock()
+	signers := append([]*OCSPSigner(nil), r.signers...)
+	r.mutex.Unlock()
+
+	statuses := make(map[string]*RevocationStatus)
+	validities := make(map[string]time.Duration)
+
+	for i, signer := range signers {
+		name := signer.IssuerName
+
+		certName := r.PKI.OCSPSigningCertificateName(name)
+		if certName != signer.CertificateName {
+			// There is nobody to type a password here
+			newSigner, err := r.PKI.LoadOCSPSigner(name,
+				noPrivateKeyPassword)
+			if err != nil {
+				p.Error("cannot load ocsp signer %q for %q: %v",
+					certName, name, err)
+			} else {
+				p.Info("signing responses for %q with %q", name,
+					certName)
+				signers[i] = newSigner
+			}
+		}
+
+		if cert := signers[i].Certificate; signers[i].IsDelegated() &&
+			time.Now().After(cert.NotAfter) {
+			p.Error("ocsp signing certificate %q for %q expired on %s",
+				signers[i].CertificateName, name,
+				cert.NotAfter.Format(time.RFC3339))
+		}
+
+		status, err := r.PKI.LoadRevocationStatus(name)
+		if err != nil {
+			return fmt.Errorf("cannot load revocation status of %q: %w",
+				name, err)
+		}
+
+		statuses[name] = status
+		validities[name] = r.PKI.OCSPResponseValidity(name)
+	}
+
+	r.mutex.Lock()
+	r.signers = signers
+	r.statuses = statuses
+	r.validities = validities
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// Return a DER-encoded OCSP response for a DER-encoded request, along with
+// the next update date if the response was successful.
+func (r *OCSPResponder) Respond(data []byte) ([]byte, time.Time) {
+	var nextUpdate time.Time
+
+	req, err := ParseOCSPRequest(data)
+	if err != nil {
+		p.Error("invalid ocsp request: %v", err)
+		return OCSPErrorResponse(OCSPResponseStatusMalformedRequest),
+			nextUpdate
+	}
+
+	r.mutex.Lock()
+	signers := r.signers
+	statuses := r.statuses
+	validities := r.validities
+	r.mutex.Unlock()
+
+	// A response is signed by a single responder, so all certificates
+	// must have been issued by the same ca.
+	var signer *OCSPSigner
+
+	for _, certID := range req.CertIDs {
+		s := findOCSPSigner(signers, &certID)
+		if s == nil || (signer != nil && s != signer) {
+			return OCSPErrorResponse(OCSPResponseStatusUnauthorized),
+				nextUpdate
+		}
+
+		signer = s
+	}
+
+	status := statuses[signer.IssuerName]
+	validity := validities[signer.IssuerName]
+
+	if status == nil {
+		return OCSPErrorResponse(OCSPResponseStatusTryLater), nextUpdate
+	}
+
+	response, err := CreateOCSPStatusResponse(signer, status, validity,
+		req.CertIDs, req.Nonce)
+	if err != nil {
+		p.Error("cannot create ocsp response: %v", err)
+		return OCSPErrorResponse(OCSPResponseStatusInternalError),
+			nextUpdate
+	}
+
+	if req.Nonce == nil {
+		nextUpdate = status.Date.Add(validity)
+	}
+
+	return response, nextUpdate
+}
+
+func findOCSPSigner(signers []*OCSPSigner, certID *OCSPCertID) *OCSPSigner {
+	for _, signer := range signers {
+		if certID.MatchesIssuer(signer.IssuerCert) {
+			return signer
+		}
+	}
+
+	return nil
+}
+
+func (r *OCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		// The request is encoded in base64 then url-encoded and
+		// appended to the url of the responder. Since the encoded
+		// request can contain "/", we use the whole path.
+		data, err = decodeOCSPGETRequest(req.URL.EscapedPath())
+
+	case http.MethodPost:
+		data, err = ioutil.ReadAll(io.LimitReader(req.Body,
+			maxOCSPRequestSize+1))
+		if err == nil && len(data) > maxOCSPRequestSize {
+			err = errors.New("request too large")
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response []byte
+	var nextUpdate time.Time
+
+	if err != nil {
+		p.Error("invalid ocsp request: %v", err)
+		response = OCSPErrorResponse(OCSPResponseStatusMalformedRequest)
+	} else {
+		response, nextUpdate = r.Respond(data)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/ocsp-response")
+
+	// Responses to GET requests can be cached until the next update
+	// (RFC 5019 6.2); responses containing a nonce cannot.
+	if req.Method == http.MethodGet && !nextUpdate.IsZero() {
+		now := time.Now()
+
+		if maxAge := int(nextUpdate.Sub(now).Seconds()); maxAge > 0 {
+			header.Set("Cache-Control", fmt.Sprintf("max-age=%d, "+
+				"public, no-transform, must-revalidate", maxAge))
+			header.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+			header.Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+func decodeOCSPGETRequest(path string) ([]byte, error) {
+	s, err := url.PathUnescape(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 request: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,430 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testOCSPResponder struct {
+	*httptest.Server
+
+	subCert     *x509.Certificate
+	signerCert  *x509.Certificate
+	goodCert    *x509.Certificate
+	revokedCert *x509.Certificate
+	unknownCert *x509.Certificate
+}
+
+// Create a responder for "sub-ca", which has issued a valid certificate, a
+// revoked certificate, and a certificate which is not in the index. If
+// delegated is set, responses are signed by a delegated responder.
+func newTestOCSPResponder(t *testing.T, delegated bool) *testOCSPResponder {
+	t.Helper()
+
+	newTestPKI(t)
+
+	subCert, subKey := loadTestCertificate(t, "sub-ca")
+
+	goodCert, _ := createTestCertificate(t, "good", "sub-ca",
+		&CertificateData{
+			Validity: 1,
+			Subject:  Subject{CommonName: "good"},
+		})
+
+	revokedCert, _ := createTestCertificate(t, "revoked", "sub-ca",
+		&CertificateData{
+			Validity: 1,
+			Subject:  Subject{CommonName: "revoked"},
+		})
+
+	rc := CRLRevokedCert{
+		SerialNumber:   *revokedCert.SerialNumber,
+		RevocationDate: time.Now().UTC().Truncate(time.Second),
+		Reason:         RevocationReasonKeyCompromise,
+	}
+
+	err := pki.WithTransaction(func() error {
+		return pki.AddRevokedCertificates("sub-ca", subCert, subKey,
+			[]CRLRevokedCert{rc})
+	})
+	if err != nil {
+		t.Fatalf("cannot revoke certificate: %v", err)
+	}
+
+	unknownCert := createTestUnindexedCertificate(t, subCert, subKey)
+
+	if delegated {
+		if _, err := pki.RotateOCSPSigner("sub-ca", subCert,
+			subKey); err != nil {
+			t.Fatalf("cannot rotate ocsp signer: %v", err)
+		}
+	}
+
+	signer, err := pki.LoadOCSPSigner("sub-ca", noPrivateKeyPassword)
+	if err != nil {
+		t.Fatalf("cannot load ocsp signer: %v", err)
+	}
+
+	responder := NewOCSPResponder(pki, []*OCSPSigner{signer})
+	if err := responder.Refresh(); err != nil {
+		t.Fatalf("cannot refresh ocsp responder: %v", err)
+	}
+
+	s := testOCSPResponder{
+		Server: httptest.NewServer(responder),
+
+		subCert:     subCert,
+		signerCert:  signer.Certificate,
+		goodCert:    goodCert,
+		revokedCert: revokedCert,
+		unknownCert: unknownCert,
+	}
+
+	t.Cleanup(s.Close)
+
+	return &s
+}
+
+// Create a certificate signed by a ca but not recorded in the index of the
+// pki, as if the key of the ca had been used by someone else.
+func createTestUnindexedCertificate(t *testing.T, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey) *x509.Certificate {
+	t.Helper()
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "unknown"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, &template,
+		issuerCert, PublicKey(issuerKey), issuerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+
+	return cert
+}
+
+// x/crypto/ocsp only creates requests for a single certificate without any
+// extension, so we merge its requests ourselves.
+type testOCSPRequest struct {
+	TBSRequest testOCSPTBSRequest
+}
+
+type testOCSPTBSRequest struct {
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+func newTestOCSPRequest(t *testing.T, issuerCert *x509.Certificate, certs []*x509.Certificate, nonce []byte) []byte {
+	t.Helper()
+
+	var req testOCSPRequest
+
+	for _, cert := range certs {
+		data, err := ocsp.CreateRequest(cert, issuerCert, nil)
+		if err != nil {
+			t.Fatalf("cannot create ocsp request: %v", err)
+		}
+
+		var certReq testOCSPRequest
+		if _, err := asn1.Unmarshal(data, &certReq); err != nil {
+			t.Fatalf("cannot parse ocsp request: %v", err)
+		}
+
+		req.TBSRequest.RequestList = append(req.TBSRequest.RequestList,
+			certReq.TBSRequest.RequestList...)
+	}
+
+	if nonce != nil {
+		value, err := asn1.Marshal(nonce)
+		if err != nil {
+			t.Fatalf("cannot encode nonce: %v", err)
+		}
+
+		req.TBSRequest.RequestExtensions = []pkix.Extension{{
+			Id:    oidExtOCSPNonce,
+			Value: value,
+		}}
+	}
+
+	data, err := asn1.Marshal(req)
+	if err != nil {
+		t.Fatalf("cannot encode ocsp request: %v", err)
+	}
+
+	return data
+}
+
+func (s *testOCSPResponder) Post(t *testing.T, req []byte) []byte {
+	t.Helper()
+
+	res, err := http.Post(s.URL, "application/ocsp-request",
+		bytes.NewReader(req))
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	return readTestOCSPResponse(t, res)
+}
+
+func (s *testOCSPResponder) Get(t *testing.T, req []byte) ([]byte, http.Header) {
+	t.Helper()
+
+	path := url.PathEscape(base64.StdEncoding.EncodeToString(req))
+
+	res, err := http.Get(s.URL + "/" + path)
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	return readTestOCSPResponse(t, res), res.Header
+}
+
+func readTestOCSPResponse(t *testing.T, res *http.Response) []byte {
+	t.Helper()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("request failed with status %d", res.StatusCode)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType !=
+		"application/ocsp-response" {
+		t.Errorf("response has content type %q", contentType)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("cannot read response: %v", err)
+	}
+
+	return data
+}
+
+// Parse the response for a certificate and check that it was signed by the
+// expected responder.
+func (s *testOCSPResponder) ParseResponse(t *testing.T, data []byte, cert *x509.Certificate) *ocsp.Response {
+	t.Helper()
+
+	res, err := ocsp.ParseResponseForCert(data, cert, s.subCert)
+	if err != nil {
+		t.Fatalf("cannot parse ocsp response: %v", err)
+	}
+
+	if s.signerCert.Equal(s.subCert) {
+		if res.Certificate != nil {
+			t.Errorf("response signed by the ca contains a certificate")
+		}
+	} else {
+		if res.Certificate == nil {
+			t.Fatalf("response signed by a delegated responder does " +
+				"not contain its certificate")
+		}
+
+		if !res.Certificate.Equal(s.signerCert) {
+			t.Errorf("response contains certificate %q; expected %q",
+				res.Certificate.Subject, s.signerCert.Subject)
+		}
+	}
+
+	if err := res.CheckSignatureFrom(s.signerCert); err != nil {
+		t.Errorf("invalid response signature: %v", err)
+	}
+
+	if !res.NextUpdate.After(res.ThisUpdate) {
+		t.Errorf("next update %v is not after this update %v",
+			res.NextUpdate, res.ThisUpdate)
+	}
+
+	return res
+}
+
+// x/crypto/ocsp does not expose response extensions.
+type testOCSPResponseData struct {
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []asn1.RawValue
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+func testOCSPResponseNonce(t *testing.T, res *ocsp.Response) []byte {
+	t.Helper()
+
+	var responseData testOCSPResponseData
+	if _, err := asn1.Unmarshal(res.TBSResponseData,
+		&responseData); err != nil {
+		t.Fatalf("cannot parse response data: %v", err)
+	}
+
+	for _, ext := range responseData.ResponseExtensions {
+		if !ext.Id.Equal(oidExtOCSPNonce) {
+			continue
+		}
+
+		var nonce []byte
+		if _, err := asn1.Unmarshal(ext.Value, &nonce); err != nil {
+			t.Fatalf("cannot parse nonce: %v", err)
+		}
+
+		return nonce
+	}
+
+	return nil
+}
+
+func checkTestOCSPStatus(t *testing.T, res *ocsp.Response, status int) {
+	t.Helper()
+
+	if res.Status != status {
+		t.Errorf("certificate %s has status %d; expected %d",
+			serialNumberString(res.SerialNumber), res.Status, status)
+	}
+}
+
+func testOCSPResponses(t *testing.T, delegated bool) {
+	s := newTestOCSPResponder(t, delegated)
+
+	certs := []*x509.Certificate{s.goodCert, s.revokedCert, s.unknownCert}
+
+	// POST request for several certificates, with a nonce
+	nonce := []byte("0123456789abcdef")
+
+	data := s.Post(t, newTestOCSPRequest(t, s.subCert, certs, nonce))
+
+	res := s.ParseResponse(t, data, s.goodCert)
+	checkTestOCSPStatus(t, res, ocsp.Good)
+
+	if resNonce := testOCSPResponseNonce(t, res); !bytes.Equal(resNonce,
+		nonce) {
+		t.Errorf("response has nonce %q; expected %q", resNonce, nonce)
+	}
+
+	res = s.ParseResponse(t, data, s.revokedCert)
+	checkTestOCSPStatus(t, res, ocsp.Revoked)
+
+	if res.RevocationReason != ocsp.KeyCompromise {
+		t.Errorf("certificate revoked with reason %d; expected %d",
+			res.RevocationReason, ocsp.KeyCompromise)
+	}
+
+	if res.RevokedAt.IsZero() {
+		t.Errorf("missing revocation date")
+	}
+
+	res = s.ParseResponse(t, data, s.unknownCert)
+	checkTestOCSPStatus(t, res, ocsp.Unknown)
+
+	// GET request without nonce, which can be cached
+	req := newTestOCSPRequest(t, s.subCert, certs[:1], nil)
+
+	data, header := s.Get(t, req)
+
+	res = s.ParseResponse(t, data, s.goodCert)
+	checkTestOCSPStatus(t, res, ocsp.Good)
+
+	if resNonce := testOCSPResponseNonce(t, res); resNonce != nil {
+		t.Errorf("response to a request without nonce has nonce %q",
+			resNonce)
+	}
+
+	if header.Get("Cache-Control") == "" {
+		t.Errorf("missing Cache-Control header field")
+	}
+
+	// Certificates issued by another ca
+	rootCert, _ := loadTestCertificate(t, "root-ca")
+
+	data = s.Post(t, newTestOCSPRequest(t, rootCert,
+		[]*x509.Certificate{s.subCert}, nil))
+
+	if _, err := ocsp.ParseResponse(data, rootCert); err == nil {
+		t.Errorf("request for an unknown ca succeeded")
+	} else if resErr, ok := err.(ocsp.ResponseError); !ok ||
+		resErr.Status != ocsp.Unauthorized {
+		t.Errorf("request for an unknown ca failed with %v; expected "+
+			"unauthorized", err)
+	}
+
+	// Pre-generated responses (generate-ocsp-response)
+	index, err := pki.LoadIndex()
+	if err != nil {
+		t.Fatalf("cannot load index: %v", err)
+	}
+
+	signer, err := pki.LoadOCSPSigner("sub-ca", noPrivateKeyPassword)
+	if err != nil {
+		t.Fatalf("cannot load ocsp signer: %v", err)
+	}
+
+	status, err := pki.LoadRevocationStatus("sub-ca")
+	if err != nil {
+		t.Fatalf("cannot load revocation status: %v", err)
+	}
+
+	for name, expectedStatus := range map[string]int{
+		"good":    ocsp.Good,
+		"revoked": ocsp.Revoked,
+	} {
+		data, err := pki.GenerateOCSPResponse(index.EntryByName(name),
+			signer, status)
+		if err != nil {
+			t.Fatalf("cannot generate ocsp response for %q: %v",
+				name, err)
+		}
+
+		cert, _ := loadTestCertificate(t, name)
+
+		res := s.ParseResponse(t, data, cert)
+		checkTestOCSPStatus(t, res, expectedStatus)
+
+		if res.IssuerHash != crypto.SHA1 {
+			t.Errorf("response for %q uses hash %v; expected SHA-1",
+				name, res.IssuerHash)
+		}
+	}
+}
+
+func TestOCSPResponder(t *testing.T) {
+	testOCSPResponses(t, false)
+}
+
+func TestOCSPResponderDelegatedSigner(t *testing.T) {
+	testOCSPResponses(t, true)
+}
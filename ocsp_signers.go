@@ -0,0 +1,218 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Responses can be signed by a delegated responder instead of the ca itself,
+// so that the key of the ca does not have to be available to an online
+// responder. Delegated responder certificates contain the OCSP no check
+// extension, so they have a short lifetime and are regularly replaced by new
+// ones.
+
+// The default number of days during which a delegated responder
+// certificate is valid.
+const DefaultOCSPSigningCertificateValidity = 14
+
+func (pki *PKI) OCSPSigningCertificateValidity(issuerName string) int {
+	if cfg := pki.CACfg(issuerName).OCSP; cfg != nil &&
+		cfg.SigningCertificateValidity > 0 {
+		return cfg.SigningCertificateValidity
+	}
+
+	return DefaultOCSPSigningCertificateValidity
+}
+
+// Return the name of the certificate used to sign responses for a ca, i.e.
+// either the delegated responder certificate or the ca certificate itself.
+func (pki *PKI) OCSPSigningCertificateName(issuerName string) string {
+	if cfg := pki.CACfg(issuerName).OCSP; cfg != nil &&
+		cfg.SigningCertificate != "" {
+		return cfg.SigningCertificate
+	}
+
+	return issuerName
+}
+
+// Load the signer used for responses about certificates issued by a ca. The
+// private key is either the one of the ca or the one of its delegated
+// responder, so the password function receives the name of the key.
+func (pki *PKI) LoadOCSPSigner(issuerName string, readPassword func(string) ([]byte, error)) (*OCSPSigner, error) {
+	issuerCert, err := pki.LoadCertificate(issuerName)
+	if err != nil {
+		return nil, err
+	}
+
+	keyName := pki.OCSPSigningCertificateName(issuerName)
+
+	signer := OCSPSigner{
+		IssuerName:      issuerName,
+		IssuerCert:      issuerCert,
+		CertificateName: keyName,
+		Certificate:     issuerCert,
+	}
+
+	if keyName != issuerName {
+		cert, err := pki.LoadCertificate(keyName)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkOCSPSigningCertificate(cert, issuerCert,
+			time.Now()); err != nil {
+			return nil, fmt.Errorf("invalid ocsp signing certificate "+
+				"%q: %w", keyName, err)
+		}
+
+		signer.Certificate = cert
+	}
+
+	key, err := pki.LoadPrivateKey(keyName, func() ([]byte, error) {
+		return readPassword(keyName)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load private key: %w", err)
+	}
+
+	cryptoSigner, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	signer.Key = cryptoSigner
+
+	return &signer, nil
+}
+
+// Delegated responders must have been issued by the ca they answer for and
+// must have the OCSPSigning extended key usage (RFC 6960 4.2.2.2).
+func checkOCSPSigningCertificate(cert, issuerCert *x509.Certificate, now time.Time) error {
+	if err := checkIssuer(cert, issuerCert); err != nil {
+		return err
+	}
+
+	found := false
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return errors.New("missing OCSPSigning extended key usage")
+	}
+
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s",
+			cert.NotBefore.Format(time.RFC3339))
+	} else if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired on %s",
+			cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Return true if the delegated responder certificate of a ca must be
+// replaced, i.e. if there is none or if less than a quarter of its lifetime
+// remains.
+func (pki *PKI) OCSPSignerNeedsRotation(issuerName string, now time.Time) (bool, error) {
+	name := pki.OCSPSigningCertificateName(issuerName)
+	if name == issuerName {
+		return true, nil
+	}
+
+	cert, err := pki.LoadCertificate(name)
+	if err != nil {
+		return false, err
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+
+	return cert.NotAfter.Sub(now) < lifetime/4, nil
+}
+
+// Create a new delegated responder certificate for a ca and select it in the
+// configuration. The previous certificate is left untouched: it expires on
+// its own, and responses it signed remain valid until then.
+//
+// Private keys of delegated responders are not encrypted so that responders
+// can load new ones without any interaction.
+func (pki *PKI) RotateOCSPSigner(issuerName string, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey) (string, error) {
+	now := time.Now().UTC()
+
+	name := fmt.Sprintf("%s-ocsp-signer-%s", issuerName,
+		now.Format("20060102T150405Z"))
+
+	subject := subjectFromPKIXName(issuerCert.Subject)
+	subject.CommonName = strings.TrimSpace(subject.CommonName +
+		" OCSP signer")
+
+	certData := CertificateData{
+		Validity:     pki.OCSPSigningCertificateValidity(issuerName),
+		Subject:      subject,
+		IsOCSPSigner: true,
+	}
+
+	err := pki.WithTransaction(func() error {
+		key, err := pki.CreatePrivateKey(name, nil)
+		if err != nil {
+			return fmt.Errorf("cannot create private key: %w", err)
+		}
+
+		_, err = pki.CreateCertificate(name, &certData, issuerName,
+			issuerCert, issuerKey, PublicKey(key))
+		if err != nil {
+			return fmt.Errorf("cannot create certificate: %w", err)
+		}
+
+		if pki.Cfg.CAs == nil {
+			pki.Cfg.CAs = make(map[string]*CACfg)
+		}
+
+		caCfg := pki.Cfg.CAs[issuerName]
+		if caCfg == nil {
+			caCfg = &CACfg{}
+			pki.Cfg.CAs[issuerName] = caCfg
+		}
+
+		if caCfg.OCSP == nil {
+			caCfg.OCSP = &OCSPCfg{}
+		}
+
+		caCfg.OCSP.SigningCertificate = name
+
+		return pki.WriteConfiguration()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Password function used when private keys must be loaded without any
+// interaction.
+func noPrivateKeyPassword(name string) ([]byte, error) {
+	return nil, fmt.Errorf("private key %q is encrypted", name)
+}
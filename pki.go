@@ -15,132 +15,174 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
+	"sync"
 	"time"
 )
 
+// The name of the root ca created by default when the pki is initialized.
 const (
 	RootCAName = "root-ca"
 )
 
-type PKICfg struct {
-	Certificates CertificateData `json:"certificates"`
-}
+type PKI struct {
+	Storage     Storage
+	Cfg         *PKICfg
+	LockTimeout time.Duration
 
-func DefaultPKICfg() *PKICfg {
-	cfg := PKICfg{
-		Certificates: CertificateData{
-			Validity: 365,
-			Subject:  Subject{CommonName: "localhost"},
-		},
-	}
+	lockMode LockMode
+	index    *Index
 
-	return &cfg
-}
+	inTransaction bool
+	writes        []StorageWrite
 
-type PKI struct {
-	Path string
-	Cfg  *PKICfg
+	// Used by servers, which access the pki from several goroutines
+	mutex sync.Mutex
 }
 
-func NewPKI(path string) *PKI {
+func NewPKI(storage Storage) *PKI {
 	pki := PKI{
-		Path: path,
+		Storage:     storage,
+		LockTimeout: DefaultLockTimeout,
 	}
 
 	return &pki
 }
 
-func (pki *PKI) LoadConfiguration() error {
-	cfgPath := pki.CfgPath()
+func (pki *PKI) Initialize(rootCAName string, certData *CertificateData, privateKeyPassword []byte) error {
+	p.Info("initializing pki in %s", pki.Storage.Location())
 
-	p.Info("loading configuration file at %q", cfgPath)
+	if err := pki.Storage.Initialize(); err != nil {
+		return fmt.Errorf("cannot initialize storage: %w", err)
+	}
 
-	data, err := ioutil.ReadFile(cfgPath)
-	if err != nil {
-		return fmt.Errorf("cannot read %q: %w", cfgPath, err)
+	if err := pki.Lock(LockModeExclusive); err != nil {
+		return fmt.Errorf("cannot lock pki: %w", err)
 	}
 
-	var cfg PKICfg
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return fmt.Errorf("cannot decode configuration: %w", err)
+	// Make sure it is empty
+	if empty, err := pki.Storage.IsEmpty(); err != nil {
+		return err
+	} else if !empty {
+		return fmt.Errorf("%s is not empty", pki.Storage.Location())
 	}
 
-	pki.Cfg = &cfg
+	// Every file is staged and only written once everything has been
+	// generated, so that a failure does not leave a partial pki behind.
+	return pki.WithTransaction(func() error {
+		p.Info("creating default configuration")
 
-	return nil
-}
+		pki.Cfg = DefaultPKICfg()
+
+		if err := pki.createRootCA(rootCAName, certData,
+			privateKeyPassword); err != nil {
+			return err
+		}
 
-func (pki *PKI) CfgPath() string {
-	return path.Join(pki.Path, "cfg.json")
+		data, err := encodeJSON(pki.Cfg)
+		if err != nil {
+			return fmt.Errorf("cannot encode configuration: %w", err)
+		}
+
+		err = pki.createObject(ObjectTypeConfiguration, CfgObjectName,
+			data)
+		if err != nil {
+			return fmt.Errorf("cannot write configuration: %w", err)
+		}
+
+		return nil
+	})
 }
 
-func (pki *PKI) Initialize(certData *CertificateData, privateKeyPassword []byte) error {
-	p.Info("initializing pki in %q", pki.Path)
+func (pki *PKI) Restore(writes []StorageWrite) error {
+	p.Info("restoring pki in %s", pki.Storage.Location())
 
-	// Create the top directory if it does not exists
-	if err := os.MkdirAll(pki.Path, 0755); err != nil {
+	if err := pki.Storage.Initialize(); err != nil {
+		return fmt.Errorf("cannot initialize storage: %w", err)
+	}
 
-		return fmt.Errorf("cannot create %q: %w", pki.Path, err)
+	if err := pki.Lock(LockModeExclusive); err != nil {
+		return fmt.Errorf("cannot lock pki: %w", err)
 	}
 
-	// Make sure it is empty
-	if fileInfo, err := ioutil.ReadDir(pki.Path); err != nil {
-		return fmt.Errorf("cannot list files in %q: %w",
-			pki.Path, err)
-	} else if len(fileInfo) > 0 {
-		return fmt.Errorf("%q is not empty", pki.Path)
+	if empty, err := pki.Storage.IsEmpty(); err != nil {
+		return err
+	} else if !empty {
+		return fmt.Errorf("%s is not empty", pki.Storage.Location())
 	}
 
-	// Create the default configuration file
-	cfg := DefaultPKICfg()
+	return pki.Storage.WriteObjects(writes)
+}
 
-	cfgData, err := encodeJSON(cfg)
-	if err != nil {
-		return fmt.Errorf("cannot encode configuration: %w", err)
+// Run a function in a transaction: all objects written by pki methods while
+// it runs are staged and only written, atomically, when it returns
+// successfully.
+//
+// Nested calls join the transaction in progress.
+func (pki *PKI) WithTransaction(fn func() error) error {
+	if pki.inTransaction {
+		return fn()
 	}
 
-	cfgPath := pki.CfgPath()
+	pki.inTransaction = true
+	pki.writes = nil
 
-	p.Info("creating default configuration file at %q", cfgPath)
+	defer func() {
+		pki.inTransaction = false
+		pki.writes = nil
+	}()
 
-	if err := ioutil.WriteFile(cfgPath, cfgData, 0644); err != nil {
-		return fmt.Errorf("cannot write %q: %w", cfgPath, err)
+	if err := fn(); err != nil {
+		pki.index = nil
+		return err
 	}
 
-	pki.Cfg = cfg
-
-	// Create the root CA private key
-	key, err := pki.CreatePrivateKey(RootCAName, privateKeyPassword)
-	if err != nil {
-		return fmt.Errorf("cannot create root ca private key: %w", err)
+	if err := pki.Storage.WriteObjects(pki.writes); err != nil {
+		pki.index = nil
+		return err
 	}
 
-	// Create the root CA certificate
-	cert, err := pki.CreateCertificate(RootCAName, certData, nil, key,
-		PublicKey(key))
-	if err != nil {
-		return fmt.Errorf("cannot create root ca certificate: %w", err)
+	return nil
+}
+
+// Read an object, taking into account objects written in the current
+// transaction if there is one.
+func (pki *PKI) readObject(objType ObjectType, name string) ([]byte, error) {
+	if pki.inTransaction {
+		for i := len(pki.writes) - 1; i >= 0; i-- {
+			w := pki.writes[i]
+
+			if w.Type == objType && w.Name == name {
+				return w.Data, nil
+			}
+		}
 	}
 
-	// Create the root CA CRL
-	creationDate := time.Now().UTC()
-	crlValidity := time.Duration(certData.Validity)
-	crlExpirationDate := creationDate.Add(crlValidity * 24 * time.Hour)
+	return pki.Storage.ReadObject(objType, name)
+}
 
-	crlData := CRLData{
-		CreationDate:   creationDate,
-		ExpirationDate: crlExpirationDate,
-	}
+func (pki *PKI) createObject(objType ObjectType, name string, data []byte) error {
+	return pki.writeObject(StorageWrite{
+		Type: objType,
+		Name: name,
+		Data: data,
+	})
+}
 
-	_, err = pki.CreateCRL(RootCAName, cert, key, &crlData)
-	if err != nil {
-		return fmt.Errorf("cannot create root ca crl: %w", err)
+func (pki *PKI) createOrReplaceObject(objType ObjectType, name string, data []byte) error {
+	return pki.writeObject(StorageWrite{
+		Type:    objType,
+		Name:    name,
+		Data:    data,
+		Replace: true,
+	})
+}
+
+func (pki *PKI) writeObject(w StorageWrite) error {
+	if pki.inTransaction {
+		pki.writes = append(pki.writes, w)
+		return nil
 	}
 
-	return nil
+	return pki.Storage.WriteObjects([]StorageWrite{w})
 }
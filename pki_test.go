@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"testing"
+)
+
+// Create a pki stored in memory, containing a root ca, "root-ca", and an
+// intermediate ca, "sub-ca", and make it the pki used by the program.
+func newTestPKI(t *testing.T) *PKI {
+	t.Helper()
+
+	pki = NewPKI(NewMemoryStorage())
+
+	rootData := CertificateData{
+		Validity: 10,
+		IsCA:     true,
+		Subject:  Subject{CommonName: "Test Root CA"},
+	}
+
+	if err := pki.Initialize("root-ca", &rootData, nil); err != nil {
+		t.Fatalf("cannot initialize pki: %v", err)
+	}
+
+	if err := pki.Unlock(); err != nil {
+		t.Fatalf("cannot unlock pki: %v", err)
+	}
+
+	createTestCertificate(t, "sub-ca", "root-ca", &CertificateData{
+		Validity: 5,
+		IsCA:     true,
+		Subject:  Subject{CommonName: "Test Sub CA"},
+	})
+
+	return pki
+}
+
+// Create a certificate and its private key, which is not encrypted.
+func createTestCertificate(t *testing.T, name, issuerName string, data *CertificateData) (*x509.Certificate, crypto.PrivateKey) {
+	t.Helper()
+
+	issuerCert, issuerKey := loadTestCertificate(t, issuerName)
+
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+
+	err := pki.WithTransaction(func() error {
+		var err error
+
+		key, err = pki.CreatePrivateKey(name, nil)
+		if err != nil {
+			return err
+		}
+
+		cert, err = pki.CreateCertificate(name, data, issuerName,
+			issuerCert, issuerKey, PublicKey(key))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("cannot create certificate %q: %v", name, err)
+	}
+
+	return cert, key
+}
+
+func loadTestCertificate(t *testing.T, name string) (*x509.Certificate, crypto.PrivateKey) {
+	t.Helper()
+
+	cert, err := pki.LoadCertificate(name)
+	if err != nil {
+		t.Fatalf("cannot load certificate %q: %v", name, err)
+	}
+
+	key, err := pki.LoadPrivateKey(name, nil)
+	if err != nil {
+		t.Fatalf("cannot load private key %q: %v", name, err)
+	}
+
+	return cert, key
+}
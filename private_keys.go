@@ -25,22 +25,31 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"path"
 )
 
 type PrivateKeyPasswordReader func() ([]byte, error)
 
+func IsEncryptedPEMPrivateKey(data []byte) (bool, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, errors.New("no pem block found")
+	}
+
+	return x509.IsEncryptedPEMBlock(block), nil
+}
+
 func (pki *PKI) LoadPrivateKey(name string, passwordReader PrivateKeyPasswordReader) (crypto.PrivateKey, error) {
 	p.Info("loading private key %q", name)
 
-	keyPath := pki.PrivateKeyPath(name)
-
-	data, err := ioutil.ReadFile(keyPath)
+	data, err := pki.Storage.ReadObject(ObjectTypePrivateKey, name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read %q: %w", keyPath, err)
+		return nil, err
 	}
 
+	return decodePEMPrivateKey(data, passwordReader)
+}
+
+func decodePEMPrivateKey(data []byte, passwordReader PrivateKeyPasswordReader) (crypto.PrivateKey, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("no pem block found")
@@ -72,12 +81,17 @@ func (pki *PKI) LoadPrivateKey(name string, passwordReader PrivateKeyPasswordRea
 		return nil, fmt.Errorf("cannot parse key: %w", err)
 	}
 
-	ecdsaKey, ok := keyData.(*ecdsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("key is not an ecdsa key")
+	// RSA keys are only used for scep registration authority
+	// certificates, since scep clients cannot encrypt data with other
+	// keys.
+	switch key := keyData.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", keyData)
 	}
-
-	return ecdsaKey, nil
 }
 
 func (pki *PKI) CreatePrivateKey(name string, password []byte) (crypto.PrivateKey, error) {
@@ -121,17 +135,7 @@ func (pki *PKI) WritePrivateKey(key crypto.PrivateKey, name string, password []b
 
 	pemData := pem.EncodeToMemory(block)
 
-	keyPath := pki.PrivateKeyPath(name)
-
-	return createFile(keyPath, pemData, 0600)
-}
-
-func (pki *PKI) PrivateKeysPath() string {
-	return path.Join(pki.Path, "private-keys")
-}
-
-func (pki *PKI) PrivateKeyPath(name string) string {
-	return path.Join(pki.PrivateKeysPath(), name+".key")
+	return pki.createObject(ObjectTypePrivateKey, name, pemData)
 }
 
 func PublicKey(privateKey crypto.PrivateKey) crypto.PublicKey {
@@ -0,0 +1,241 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The repository contains the files which must be publicly available for
+// clients to validate certificates: the certificate and the CRLs of each ca,
+// referenced by the AIA and CRL distribution point extensions. Each file is
+// available both in DER and PEM format:
+//
+// crls/<ca>.crl               The complete CRL (DER).
+// crls/<ca>.crl.pem           The complete CRL (PEM).
+// delta-crls/<ca>.crl         The delta CRL if there is one (DER).
+// delta-crls/<ca>.crl.pem     The delta CRL if there is one (PEM).
+// certificates/<ca>.crt       The ca certificate (DER).
+// certificates/<ca>.crt.pem   The ca certificate (PEM).
+
+// The default number of seconds during which clients can cache files.
+const DefaultRepositoryMaxAge = 3600
+
+type RepositoryFile struct {
+	Path             string
+	Data             []byte
+	ContentType      string
+	ModificationDate time.Time
+	ExpirationDate   time.Time // optional
+}
+
+type Repository struct {
+	Files map[string]*RepositoryFile
+}
+
+func (r *Repository) addFile(file *RepositoryFile) {
+	r.Files[file.Path] = file
+}
+
+// Add a file in both DER and PEM format.
+func (r *Repository) addDERFile(filePath, contentType, pemType string, data []byte, modificationDate, expirationDate time.Time) {
+	r.addFile(&RepositoryFile{
+		Path:             filePath,
+		Data:             data,
+		ContentType:      contentType,
+		ModificationDate: modificationDate,
+		ExpirationDate:   expirationDate,
+	})
+
+	block := pem.Block{Type: pemType, Bytes: data}
+
+	r.addFile(&RepositoryFile{
+		Path:             filePath + ".pem",
+		Data:             pem.EncodeToMemory(&block),
+		ContentType:      "application/x-pem-file",
+		ModificationDate: modificationDate,
+		ExpirationDate:   expirationDate,
+	})
+}
+
+func (r *Repository) Paths() []string {
+	paths := make([]string, 0, len(r.Files))
+	for filePath := range r.Files {
+		paths = append(paths, filePath)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (pki *PKI) BuildRepository() (*Repository, error) {
+	names, err := pki.CANames()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list cas: %w", err)
+	}
+
+	r := Repository{
+		Files: make(map[string]*RepositoryFile),
+	}
+
+	for _, name := range names {
+		cert, err := pki.LoadCertificate(name)
+		if err != nil {
+			return nil, err
+		}
+
+		r.addDERFile(path.Join("certificates", name+".crt"),
+			"application/pkix-cert", "CERTIFICATE", cert.Raw,
+			cert.NotBefore, time.Time{})
+
+		crlTypes := []struct {
+			objType ObjectType
+			dirPath string
+		}{
+			{ObjectTypeCRL, "crls"},
+			{ObjectTypeDeltaCRL, "delta-crls"},
+		}
+
+		for _, crlType := range crlTypes {
+			data, err := pki.loadCRL(crlType.objType, name)
+			if errors.Is(err, ErrObjectNotFound) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("cannot load %s %q: %w",
+					crlType.objType, name, err)
+			}
+
+			var crlData CRLData
+			if err := crlData.Read(data); err != nil {
+				return nil, fmt.Errorf("cannot read %s %q: %w",
+					crlType.objType, name, err)
+			}
+
+			r.addDERFile(path.Join(crlType.dirPath, name+".crl"),
+				"application/pkix-crl", "X509 CRL", data,
+				crlData.CreationDate, crlData.ExpirationDate)
+		}
+	}
+
+	return &r, nil
+}
+
+// Write the files of the repository to a directory, e.g. to publish them
+// with a regular web server. Existing files are replaced.
+func (r *Repository) Export(dirPath string) error {
+	for _, filePath := range r.Paths() {
+		file := r.Files[filePath]
+
+		fullPath := filepath.Join(dirPath, filepath.FromSlash(filePath))
+
+		if err := createOrReplaceFile(fullPath, file.Data, 0644); err != nil {
+			return fmt.Errorf("cannot write %q: %w", fullPath, err)
+		}
+	}
+
+	return nil
+}
+
+// A HTTP server for the files of the repository. Files are loaded in memory
+// and reloaded with Refresh.
+type RepositoryServer struct {
+	PKI    *PKI
+	MaxAge time.Duration
+
+	mutex      sync.Mutex
+	repository *Repository
+}
+
+func NewRepositoryServer(pki *PKI) *RepositoryServer {
+	s := RepositoryServer{
+		PKI:    pki,
+		MaxAge: DefaultRepositoryMaxAge * time.Second,
+	}
+
+	return &s
+}
+
+// Reload the repository. The caller is responsible for locking the pki.
+func (s *RepositoryServer) Refresh() error {
+	// New cas may have been created since the index was loaded
+	s.PKI.index = nil
+
+	repository, err := s.PKI.BuildRepository()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.repository = repository
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *RepositoryServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mutex.Lock()
+	repository := s.repository
+	s.mutex.Unlock()
+
+	filePath := strings.TrimPrefix(path.Clean(req.URL.Path), "/")
+
+	file, found := repository.Files[filePath]
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	// CRLs must not be cached after their next update date
+	maxAge := s.MaxAge
+	if !file.ExpirationDate.IsZero() {
+		if d := time.Until(file.ExpirationDate); d < maxAge {
+			maxAge = d
+		}
+	}
+
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	hash := sha256.Sum256(file.Data)
+
+	header := w.Header()
+	header.Set("Content-Type", file.ContentType)
+	header.Set("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d",
+		int(maxAge.Seconds())))
+
+	http.ServeContent(w, req, "", file.ModificationDate,
+		bytes.NewReader(file.Data))
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Check that a certificate can be revoked by the issuer recorded in its
+// index entry: the certificate must have been signed by the issuer, and
+// must not already be revoked. The only exception is a certificate on hold,
+// which can be revoked permanently.
+func (pki *PKI) CheckRevocation(entry *IndexEntry, serialNumber *big.Int, reason RevocationReason) error {
+	if entry.IssuerName == entry.Name {
+		return fmt.Errorf("certificate %q is a root ca and cannot be "+
+			"revoked", entry.Name)
+	}
+
+	issuerCert, err := pki.LoadCertificate(entry.IssuerName)
+	if err != nil {
+		return fmt.Errorf("cannot load issuer certificate: %w", err)
+	}
+
+	// Certificates can be revoked even if their file is not available
+	// anymore, in which case we have to trust the index.
+	cert, err := pki.LoadCertificate(entry.Name)
+	if errors.Is(err, ErrObjectNotFound) {
+		p.Info("certificate %q not found, cannot verify its issuer",
+			entry.Name)
+	} else if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	} else {
+		if cert.SerialNumber.Cmp(serialNumber) != 0 {
+			return fmt.Errorf("serial number of certificate %q does "+
+				"not match the index", entry.Name)
+		}
+
+		if err := checkIssuer(cert, issuerCert); err != nil {
+			return fmt.Errorf("certificate %q was not issued by %q: %w",
+				entry.Name, entry.IssuerName, err)
+		}
+	}
+
+	rc, err := pki.FindRevokedCertificate(entry.IssuerName, serialNumber)
+	if err != nil {
+		return err
+	}
+
+	if rc != nil && (rc.Reason != RevocationReasonCertificateHold ||
+		reason == RevocationReasonCertificateHold) {
+		return fmt.Errorf("certificate %q is already revoked (reason: %s)",
+			entry.Name, rc.Reason)
+	}
+
+	return nil
+}
+
+// Return the name of the ca which signed a certificate.
+func (pki *PKI) FindIssuerName(cert *x509.Certificate) (string, error) {
+	names, err := pki.CANames()
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		caCert, err := pki.LoadCertificate(name)
+		if err != nil {
+			return "", err
+		}
+
+		if isIssuedBy(cert, caCert) {
+			return name, nil
+		}
+	}
+
+	return "", errors.New("no issuer found")
+}
+
+func checkIssuer(cert, issuerCert *x509.Certificate) error {
+	if !bytes.Equal(cert.RawIssuer, issuerCert.RawSubject) {
+		return errors.New("issuer name does not match the subject of " +
+			"the issuer certificate")
+	}
+
+	if len(cert.AuthorityKeyId) > 0 && len(issuerCert.SubjectKeyId) > 0 &&
+		!bytes.Equal(cert.AuthorityKeyId, issuerCert.SubjectKeyId) {
+		return errors.New("authority key identifier does not match " +
+			"the subject key identifier of the issuer certificate")
+	}
+
+	if err := cert.CheckSignatureFrom(issuerCert); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return nil
+}
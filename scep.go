@@ -0,0 +1,287 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SCEP clients encrypt requests for the certificate returned by the server,
+// which must therefore have a RSA key. Since cas use ecdsa keys, requests are
+// handled by a registration authority (RA) certificate issued by the ca,
+// whose key is not encrypted so that the server can run without any
+// interaction.
+
+// The default and maximum number of hours during which a challenge password
+// can be used.
+const (
+	DefaultSCEPChallengeValidity = 24
+	MaxSCEPChallengeValidity     = 24 * 365
+)
+
+const scepRAKeySize = 2048
+
+type SCEPCfg struct {
+	// The name of the ca issuing certificates, usually an intermediate
+	// ca.
+	Issuer string `json:"issuer"`
+
+	// The profile of issued certificates (default: "server").
+	Profile string `json:"profile,omitempty"`
+
+	// The name of the registration authority certificate. If not set,
+	// serve-scep creates one.
+	RACertificate string `json:"raCertificate,omitempty"`
+
+	// The number of hours during which challenge passwords created by
+	// create-scep-challenge can be used (default:
+	// DefaultSCEPChallengeValidity).
+	ChallengeValidity int `json:"challengeValidity,omitempty"`
+}
+
+func (cfg *SCEPCfg) Validate() error {
+	if cfg.Issuer == "" {
+		return errors.New("missing issuer")
+	}
+
+	if cfg.Profile != "" {
+		if err := CheckEnrollmentProfile(cfg.Profile); err != nil {
+			return fmt.Errorf("profile: %w", err)
+		}
+	}
+
+	if cfg.ChallengeValidity < 0 ||
+		cfg.ChallengeValidity > MaxSCEPChallengeValidity {
+		return fmt.Errorf("challengeValidity: validity must be between "+
+			"0 and %d hours", MaxSCEPChallengeValidity)
+	}
+
+	return nil
+}
+
+func (cfg *SCEPCfg) ProfileName() string {
+	if cfg.Profile == "" {
+		return "server"
+	}
+
+	return cfg.Profile
+}
+
+func (pki *PKI) SCEPCfg() (*SCEPCfg, error) {
+	if pki.Cfg.SCEP == nil {
+		return nil, errors.New("scep is not configured")
+	}
+
+	return pki.Cfg.SCEP, nil
+}
+
+// Challenges
+
+// Challenge passwords are only stored as hashes, which are used as object
+// names. Used challenges are kept with the name of the certificate they were
+// used for.
+type SCEPChallenge struct {
+	CreationDate    time.Time  `json:"creationDate"`
+	ExpirationDate  time.Time  `json:"expirationDate"`
+	UseDate         *time.Time `json:"useDate,omitempty"`
+	CertificateName string     `json:"certificateName,omitempty"`
+}
+
+var ErrInvalidSCEPChallenge = errors.New("invalid challenge password")
+
+func scepChallengeObjectName(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+// Create a one-time challenge password and return it.
+func (pki *PKI) CreateSCEPChallenge(validity time.Duration) (string, *SCEPChallenge, error) {
+	password := generateRandomID()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	challenge := SCEPChallenge{
+		CreationDate:   now,
+		ExpirationDate: now.Add(validity),
+	}
+
+	data, err := encodeJSON(challenge)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot encode challenge: %w", err)
+	}
+
+	err = pki.createObject(ObjectTypeSCEPChallenge,
+		scepChallengeObjectName(password), data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return password, &challenge, nil
+}
+
+// Mark a challenge password as used for a certificate. Return an error
+// wrapping ErrInvalidSCEPChallenge if the password is unknown, expired or
+// already used.
+func (pki *PKI) UseSCEPChallenge(password, certName string) error {
+	name := scepChallengeObjectName(password)
+
+	data, err := pki.readObject(ObjectTypeSCEPChallenge, name)
+	if errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("%w: unknown password", ErrInvalidSCEPChallenge)
+	} else if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	var challenge SCEPChallenge
+	if err := d.Decode(&challenge); err != nil {
+		return fmt.Errorf("cannot decode challenge %q: %w", name, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	if challenge.UseDate != nil {
+		return fmt.Errorf("%w: password already used for certificate %q",
+			ErrInvalidSCEPChallenge, challenge.CertificateName)
+	}
+
+	if now.After(challenge.ExpirationDate) {
+		return fmt.Errorf("%w: password expired on %s",
+			ErrInvalidSCEPChallenge,
+			challenge.ExpirationDate.Format(time.RFC3339))
+	}
+
+	challenge.UseDate = &now
+	challenge.CertificateName = certName
+
+	data, err = encodeJSON(challenge)
+	if err != nil {
+		return fmt.Errorf("cannot encode challenge: %w", err)
+	}
+
+	return pki.createOrReplaceObject(ObjectTypeSCEPChallenge, name, data)
+}
+
+// Registration authority
+
+// Load the registration authority certificate and key, returning nil if
+// there is none or if it cannot be used anymore.
+func (pki *PKI) LoadSCEPRA(cfg *SCEPCfg, issuerCert *x509.Certificate) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if cfg.RACertificate == "" {
+		return nil, nil, nil
+	}
+
+	cert, err := pki.LoadCertificate(cfg.RACertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkIssuer(cert, issuerCert); err != nil {
+		p.Info("scep ra certificate %q was not issued by %q: %v",
+			cfg.RACertificate, cfg.Issuer, err)
+		return nil, nil, nil
+	}
+
+	// Replace certificates before they expire so that clients always
+	// receive a certificate they can use.
+	now := time.Now()
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if cert.NotAfter.Sub(now) < lifetime/4 {
+		p.Info("scep ra certificate %q expires on %s", cfg.RACertificate,
+			cert.NotAfter.Format(time.RFC3339))
+		return nil, nil, nil
+	}
+
+	key, err := pki.LoadPrivateKey(cfg.RACertificate,
+		func() ([]byte, error) {
+			return noPrivateKeyPassword(cfg.RACertificate)
+		})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("private key %q is not a rsa key",
+			cfg.RACertificate)
+	}
+
+	return cert, rsaKey, nil
+}
+
+// Create a new registration authority certificate and select it in the
+// configuration.
+func (pki *PKI) CreateSCEPRA(cfg *SCEPCfg, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
+	issuerName := cfg.Issuer
+
+	now := time.Now().UTC()
+
+	name := fmt.Sprintf("%s-scep-ra-%s", issuerName,
+		now.Format("20060102T150405Z"))
+
+	subject := subjectFromPKIXName(issuerCert.Subject)
+	subject.CommonName = strings.TrimSpace(subject.CommonName +
+		" SCEP RA")
+
+	// The default key usage (digital signature and key encipherment) is
+	// the one required for RA certificates (RFC 8894 3.1).
+	certData := CertificateData{
+		Validity: pki.CertificateDefaults(issuerName).Validity,
+		Subject:  subject,
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, scepRAKeySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate private key: %w", err)
+	}
+
+	var cert *x509.Certificate
+
+	err = pki.WithTransaction(func() error {
+		p.Info("creating private key %q", name)
+
+		if err := pki.WritePrivateKey(key, name, nil); err != nil {
+			return fmt.Errorf("cannot write private key: %w", err)
+		}
+
+		cert, err = pki.CreateCertificate(name, &certData, issuerName,
+			issuerCert, issuerKey, &key.PublicKey)
+		if err != nil {
+			return fmt.Errorf("cannot create certificate: %w", err)
+		}
+
+		cfg.RACertificate = name
+
+		return pki.WriteConfiguration()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
@@ -0,0 +1,579 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// See RFC 8894. Only the PKCSReq message type is supported: requests are
+// either accepted or rejected immediately, so clients never have to poll.
+
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidAttributeChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+const (
+	scepMessageTypeCertRep = "3"
+	scepMessageTypePKCSReq = "19"
+
+	scepPKIStatusSuccess = "0"
+	scepPKIStatusFailure = "2"
+)
+
+type SCEPFailInfo string
+
+const (
+	SCEPFailInfoBadAlg          SCEPFailInfo = "0"
+	SCEPFailInfoBadMessageCheck SCEPFailInfo = "1"
+	SCEPFailInfoBadRequest      SCEPFailInfo = "2"
+	SCEPFailInfoBadTime         SCEPFailInfo = "3"
+	SCEPFailInfoBadCertID       SCEPFailInfo = "4"
+)
+
+var SCEPCapabilities = []string{
+	"AES",
+	"POSTPKIOperation",
+	"SCEPStandard",
+	"SHA-256",
+	"SHA-512",
+}
+
+// The maximum size of a request
+const maxSCEPRequestSize = 64 * 1024
+
+const scepNonceSize = 16
+
+type SCEPServer struct {
+	PKI *PKI
+
+	IssuerName string
+	Profile    string
+
+	issuerCert *x509.Certificate
+	issuerKey  crypto.PrivateKey
+
+	raCert *x509.Certificate
+	raKey  *rsa.PrivateKey
+
+	// The certificates returned by GetCACert: the ra certificate, the
+	// issuer and the certificates required to build a chain to the root
+	// ca.
+	caCerts []*x509.Certificate
+}
+
+type scepRequest struct {
+	MessageType   string
+	TransactionID string
+	SenderNonce   []byte
+	SignerCert    *x509.Certificate
+	DigestAlg     crypto.Hash
+	EncryptionAlg asn1.ObjectIdentifier
+	EnvelopedData []byte
+}
+
+// An error reported to the client in a CertRep message
+type scepFailure struct {
+	FailInfo SCEPFailInfo
+	Err      error
+}
+
+func (f *scepFailure) Error() string {
+	return f.Err.Error()
+}
+
+func scepFail(failInfo SCEPFailInfo, format string, args ...interface{}) *scepFailure {
+	return &scepFailure{
+		FailInfo: failInfo,
+		Err:      fmt.Errorf(format, args...),
+	}
+}
+
+// The caller must hold the pki lock.
+func NewSCEPServer(pki *PKI, cfg *SCEPCfg, issuerCert *x509.Certificate, issuerKey crypto.PrivateKey, raCert *x509.Certificate, raKey *rsa.PrivateKey) (*SCEPServer, error) {
+	if err := CheckEnrollmentProfile(cfg.ProfileName()); err != nil {
+		return nil, err
+	}
+
+	chain, err := pki.CertificateChain(cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate chain: %w", err)
+	}
+
+	caCerts := append([]*x509.Certificate{raCert, issuerCert}, chain...)
+
+	last := caCerts[len(caCerts)-1]
+	if !bytes.Equal(last.RawIssuer, last.RawSubject) {
+		rootName, err := pki.FindIssuerName(last)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find root ca: %w", err)
+		}
+
+		rootCert, err := pki.LoadCertificate(rootName)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load root ca certificate: %w",
+				err)
+		}
+
+		caCerts = append(caCerts, rootCert)
+	}
+
+	s := SCEPServer{
+		PKI: pki,
+
+		IssuerName: cfg.Issuer,
+		Profile:    cfg.ProfileName(),
+
+		issuerCert: issuerCert,
+		issuerKey:  issuerKey,
+
+		raCert: raCert,
+		raKey:  raKey,
+
+		caCerts: caCerts,
+	}
+
+	return &s, nil
+}
+
+func (s *SCEPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	operation := query.Get("operation")
+
+	switch operation {
+	case "GetCACaps":
+		if !s.checkMethod(w, req, http.MethodGet) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, strings.Join(SCEPCapabilities, "\n")+"\n")
+
+	case "GetCACert":
+		if !s.checkMethod(w, req, http.MethodGet) {
+			return
+		}
+
+		s.hGetCACert(w, req)
+
+	case "PKIOperation":
+		s.hPKIOperation(w, req)
+
+	case "":
+		s.writeError(w, http.StatusBadRequest, "missing operation")
+
+	default:
+		s.writeError(w, http.StatusBadRequest, "unsupported operation %q",
+			operation)
+	}
+}
+
+func (s *SCEPServer) checkMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	return true
+}
+
+func (s *SCEPServer) writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+func (s *SCEPServer) hGetCACert(w http.ResponseWriter, req *http.Request) {
+	data, err := CreateCertsOnlyCMS(s.caCerts)
+	if err != nil {
+		p.Error("scep: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *SCEPServer) hPKIOperation(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+
+	switch req.Method {
+	case http.MethodGet:
+		// Clients do not always escape base64 data, in which case
+		// '+' characters are decoded as spaces.
+		message := strings.ReplaceAll(req.URL.Query().Get("message"),
+			" ", "+")
+
+		messageData, err := base64.StdEncoding.DecodeString(message)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest,
+				"invalid message encoding: %v", err)
+			return
+		}
+
+		data = messageData
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body,
+			maxSCEPRequestSize+1))
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest,
+				"cannot read body: %v", err)
+			return
+		} else if len(body) > maxSCEPRequestSize {
+			s.writeError(w, http.StatusRequestEntityTooLarge,
+				"request too large")
+			return
+		}
+
+		data = body
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if len(data) > maxSCEPRequestSize {
+		s.writeError(w, http.StatusRequestEntityTooLarge,
+			"request too large")
+		return
+	}
+
+	// Requests whose signature cannot be verified cannot be answered
+	// with a CertRep message since we do not know who sent them.
+	scepReq, err := parseSCEPRequest(data)
+	if err != nil {
+		p.Info("scep: invalid request: %v", err)
+		s.writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+
+	var certRep []byte
+
+	cert, failure := s.processRequest(scepReq)
+	if failure != nil {
+		p.Info("scep: rejected request %q: %v", scepReq.TransactionID,
+			failure)
+
+		certRep, err = s.createFailureResponse(scepReq, failure.FailInfo)
+	} else {
+		certRep, err = s.createSuccessResponse(scepReq, cert)
+	}
+
+	if err != nil {
+		p.Error("scep: cannot create response: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pki-message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(certRep)
+}
+
+func parseSCEPRequest(data []byte) (*scepRequest, error) {
+	sd, err := ParseCMSSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sd.Verify(); err != nil {
+		return nil, err
+	}
+
+	req := scepRequest{
+		SignerCert:    sd.SignerCertificate,
+		DigestAlg:     sd.DigestAlgorithm,
+		EnvelopedData: sd.Content,
+	}
+
+	attrs := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+		name  string
+	}{
+		{oidSCEPMessageType, &req.MessageType, "message type"},
+		{oidSCEPTransactionID, &req.TransactionID, "transaction id"},
+		{oidSCEPSenderNonce, &req.SenderNonce, "sender nonce"},
+	}
+
+	for _, attr := range attrs {
+		data := sd.SignedAttribute(attr.oid)
+		if data == nil {
+			return nil, fmt.Errorf("missing %s attribute", attr.name)
+		}
+
+		if _, err := asn1.Unmarshal(data, attr.value); err != nil {
+			return nil, fmt.Errorf("invalid %s attribute: %w", attr.name,
+				err)
+		}
+	}
+
+	if req.TransactionID == "" {
+		return nil, errors.New("empty transaction id")
+	}
+
+	if len(req.SenderNonce) != scepNonceSize {
+		return nil, fmt.Errorf("invalid sender nonce size %d",
+			len(req.SenderNonce))
+	}
+
+	return &req, nil
+}
+
+func (s *SCEPServer) processRequest(req *scepRequest) (*x509.Certificate, *scepFailure) {
+	if req.MessageType != scepMessageTypePKCSReq {
+		return nil, scepFail(SCEPFailInfoBadRequest,
+			"unsupported message type %q", req.MessageType)
+	}
+
+	// Responses are encrypted for the key of the signer certificate
+	if _, ok := req.SignerCert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, scepFail(SCEPFailInfoBadAlg,
+			"unsupported signer public key type %T",
+			req.SignerCert.PublicKey)
+	}
+
+	ed, err := ParseCMSEnvelopedData(req.EnvelopedData)
+	if err != nil {
+		return nil, scepFail(SCEPFailInfoBadMessageCheck, "%v", err)
+	}
+
+	req.EncryptionAlg = ed.ContentEncryptionAlgorithm
+
+	// Every failure which depends on the decrypted content is reported
+	// with the same failure information: otherwise anyone could submit a
+	// captured request signed with their own certificate and use the
+	// response as a padding oracle to decrypt it.
+	name := "scep-" + generateRandomID()
+
+	cert, err := s.processCertificateRequest(req, ed, name)
+	if err != nil {
+		return nil, scepFail(SCEPFailInfoBadRequest, "%v", err)
+	}
+
+	p.Info("scep: issued certificate %q (transaction %q)", name,
+		req.TransactionID)
+
+	return cert, nil
+}
+
+func (s *SCEPServer) processCertificateRequest(req *scepRequest, ed *CMSEnvelopedData, name string) (*x509.Certificate, error) {
+	csrData, err := ed.Decrypt(s.raCert, s.raKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt request: %w", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request "+
+			"signature: %w", err)
+	}
+
+	// Requests are signed with a self-signed certificate for the key
+	// being certified (RFC 8894 3.3.1).
+	csrKey, ok := csr.PublicKey.(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !csrKey.Equal(req.SignerCert.PublicKey) {
+		return nil, errors.New("certificate request and signer " +
+			"certificate keys do not match")
+	}
+
+	password, err := csrChallengePassword(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := s.issueCertificate(name, csr, password)
+	if errors.Is(err, ErrInvalidSCEPChallenge) {
+		return nil, err
+	} else if err != nil {
+		p.Error("scep: cannot issue certificate: %v", err)
+		return nil, errors.New("cannot issue certificate")
+	}
+
+	return cert, nil
+}
+
+func (s *SCEPServer) issueCertificate(name string, csr *x509.CertificateRequest, password string) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+
+	err := s.PKI.WithLock(LockModeExclusive, func() error {
+		certData := CertificateData{
+			Validity: s.PKI.CertificateDefaults(s.IssuerName).Validity,
+			Subject:  subjectFromPKIXName(csr.Subject),
+			SAN: SAN{
+				URIs:           csr.URIs,
+				DNSNames:       csr.DNSNames,
+				IPAddresses:    csr.IPAddresses,
+				EmailAddresses: csr.EmailAddresses,
+			},
+		}
+
+		if err := certData.ApplyProfile(s.Profile); err != nil {
+			return err
+		}
+
+		// The challenge is consumed in the same transaction as the
+		// creation of the certificate so that it cannot be used twice.
+		return s.PKI.WithTransaction(func() error {
+			if err := s.PKI.UseSCEPChallenge(password, name); err != nil {
+				return err
+			}
+
+			var err error
+			cert, err = s.PKI.SignCertificateRequest(name, csr,
+				&certData, s.IssuerName, s.issuerCert, s.issuerKey)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// The challenge password is a PKCS#9 attribute of the certificate request,
+// which the x509 package does not decode.
+func csrChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes asn1.RawValue `asn1:"tag:0"`
+	}
+
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest,
+		&tbs); err != nil {
+		return "", fmt.Errorf("invalid certificate request: %w", err)
+	}
+
+	data := tbs.RawAttributes.Bytes
+
+	for len(data) > 0 {
+		var attr cmsAttribute
+
+		rest, err := asn1.Unmarshal(data, &attr)
+		if err != nil {
+			return "", fmt.Errorf("invalid certificate request "+
+				"attribute: %w", err)
+		}
+
+		data = rest
+
+		if !attr.Type.Equal(oidAttributeChallengePassword) {
+			continue
+		}
+
+		var password string
+		if _, err := asn1.Unmarshal(attr.Values.Bytes,
+			&password); err != nil {
+			return "", fmt.Errorf("invalid challenge password: %w", err)
+		}
+
+		return password, nil
+	}
+
+	return "", errors.New("missing challenge password")
+}
+
+func (s *SCEPServer) createSuccessResponse(req *scepRequest, cert *x509.Certificate) ([]byte, error) {
+	certsData, err := CreateCertsOnlyCMS([]*x509.Certificate{cert})
+	if err != nil {
+		return nil, err
+	}
+
+	envelopedData, err := CreateCMSEnvelopedData(certsData,
+		req.SignerCert, req.EncryptionAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createCertRep(req, scepPKIStatusSuccess, "", envelopedData)
+}
+
+func (s *SCEPServer) createFailureResponse(req *scepRequest, failInfo SCEPFailInfo) ([]byte, error) {
+	return s.createCertRep(req, scepPKIStatusFailure, failInfo, nil)
+}
+
+func (s *SCEPServer) createCertRep(req *scepRequest, status string, failInfo SCEPFailInfo, content []byte) ([]byte, error) {
+	senderNonce := make([]byte, scepNonceSize)
+	if _, err := rand.Read(senderNonce); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidSCEPMessageType, scepMessageTypeCertRep},
+		{oidSCEPPKIStatus, status},
+		{oidSCEPTransactionID, req.TransactionID},
+		{oidSCEPSenderNonce, senderNonce},
+		{oidSCEPRecipientNonce, req.SenderNonce},
+	}
+
+	if failInfo != "" {
+		values = append(values, struct {
+			oid   asn1.ObjectIdentifier
+			value interface{}
+		}{oidSCEPFailInfo, string(failInfo)})
+	}
+
+	attrs := make([]CMSAttribute, len(values))
+
+	for i, v := range values {
+		attr, err := NewCMSAttribute(v.oid, v.value)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[i] = attr
+	}
+
+	return CreateCMSSignedData(content, []*x509.Certificate{s.raCert},
+		s.raCert, s.raKey, req.DigestAlg, attrs)
+}
@@ -0,0 +1,581 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSCEPServer struct {
+	*httptest.Server
+
+	subCert *x509.Certificate
+	raCert  *x509.Certificate
+	raKey   *rsa.PrivateKey
+}
+
+func newTestSCEPServer(t *testing.T) *testSCEPServer {
+	t.Helper()
+
+	newTestPKI(t)
+
+	subCert, subKey := loadTestCertificate(t, "sub-ca")
+
+	cfg := SCEPCfg{Issuer: "sub-ca"}
+	pki.Cfg.SCEP = &cfg
+
+	raCert, raKey, err := pki.CreateSCEPRA(&cfg, subCert, subKey)
+	if err != nil {
+		t.Fatalf("cannot create ra: %v", err)
+	}
+
+	server, err := NewSCEPServer(pki, &cfg, subCert, subKey, raCert, raKey)
+	if err != nil {
+		t.Fatalf("cannot create scep server: %v", err)
+	}
+
+	s := testSCEPServer{
+		Server: httptest.NewServer(server),
+
+		subCert: subCert,
+		raCert:  raCert,
+		raKey:   raKey,
+	}
+
+	t.Cleanup(s.Close)
+
+	return &s
+}
+
+func (s *testSCEPServer) CreateChallenge(t *testing.T, validity time.Duration) string {
+	t.Helper()
+
+	password, _, err := pki.CreateSCEPChallenge(validity)
+	if err != nil {
+		t.Fatalf("cannot create challenge: %v", err)
+	}
+
+	return password
+}
+
+// Clients sign requests with a self-signed certificate for the key they
+// request a certificate for, and receive responses encrypted for it.
+type testSCEPClient struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestSCEPClient(t *testing.T) *testSCEPClient {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	c := testSCEPClient{
+		key:  key,
+		cert: createTestSelfSignedCertificate(t, key, "client"),
+	}
+
+	return &c
+}
+
+// The x509 package cannot encode the challenge password attribute, so
+// certificate requests are built manually (RFC 2986 4).
+type testCSRInfo struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []cmsAttribute `asn1:"tag:0"`
+}
+
+type testCSR struct {
+	Info               asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+func (c *testSCEPClient) NewCSR(t *testing.T, commonName, password string) []byte {
+	t.Helper()
+
+	subject, err := asn1.Marshal(pkix.Name{
+		CommonName: commonName,
+	}.ToRDNSequence())
+	if err != nil {
+		t.Fatalf("cannot encode subject: %v", err)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&c.key.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot encode public key: %v", err)
+	}
+
+	passwordData, err := asn1.MarshalWithParams(password, "utf8")
+	if err != nil {
+		t.Fatalf("cannot encode challenge password: %v", err)
+	}
+
+	info := testCSRInfo{
+		Subject:   asn1.RawValue{FullBytes: subject},
+		PublicKey: asn1.RawValue{FullBytes: publicKey},
+		Attributes: []cmsAttribute{{
+			Type: oidAttributeChallengePassword,
+			Values: asn1.RawValue{
+				Class:      asn1.ClassUniversal,
+				Tag:        asn1.TagSet,
+				IsCompound: true,
+				Bytes:      passwordData,
+			},
+		}},
+	}
+
+	infoData, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("cannot encode certificate request info: %v", err)
+	}
+
+	digest := sha256.Sum256(infoData)
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256,
+		digest[:])
+	if err != nil {
+		t.Fatalf("cannot sign certificate request: %v", err)
+	}
+
+	data, err := asn1.Marshal(testCSR{
+		Info: asn1.RawValue{FullBytes: infoData},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidSignatureRSAWithSHA256,
+			Parameters: asn1.NullRawValue,
+		},
+		Signature: asn1.BitString{
+			Bytes:     signature,
+			BitLength: len(signature) * 8,
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot encode certificate request: %v", err)
+	}
+
+	return data
+}
+
+// Encrypt content for the ra of the server.
+func (c *testSCEPClient) Encrypt(t *testing.T, s *testSCEPServer, content []byte) []byte {
+	t.Helper()
+
+	data, err := CreateCMSEnvelopedData(content, s.raCert,
+		oidCipherAES256CBC)
+	if err != nil {
+		t.Fatalf("cannot create enveloped data: %v", err)
+	}
+
+	return data
+}
+
+type testSCEPResponse struct {
+	Status      string
+	FailInfo    SCEPFailInfo
+	Certificate *x509.Certificate
+}
+
+// Send a PKCSReq message containing enveloped data and return the content
+// of the CertRep response.
+func (c *testSCEPClient) Send(t *testing.T, s *testSCEPServer, method string, envelopedData []byte) *testSCEPResponse {
+	t.Helper()
+
+	transactionID := generateRandomID()
+
+	senderNonce := make([]byte, scepNonceSize)
+	if _, err := rand.Read(senderNonce); err != nil {
+		t.Fatalf("cannot generate nonce: %v", err)
+	}
+
+	attrs := []CMSAttribute{
+		newTestCMSAttribute(t, oidSCEPMessageType, scepMessageTypePKCSReq),
+		newTestCMSAttribute(t, oidSCEPTransactionID, transactionID),
+		newTestCMSAttribute(t, oidSCEPSenderNonce, senderNonce),
+	}
+
+	message, err := CreateCMSSignedData(envelopedData,
+		[]*x509.Certificate{c.cert}, c.cert, c.key, crypto.SHA256, attrs)
+	if err != nil {
+		t.Fatalf("cannot create signed data: %v", err)
+	}
+
+	var res *http.Response
+
+	switch method {
+	case http.MethodGet:
+		query := url.Values{}
+		query.Set("operation", "PKIOperation")
+		query.Set("message", base64.StdEncoding.EncodeToString(message))
+
+		res, err = http.Get(s.URL + "?" + query.Encode())
+
+	case http.MethodPost:
+		res, err = http.Post(s.URL+"?operation=PKIOperation",
+			"application/x-pki-message", bytes.NewReader(message))
+	}
+
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("cannot read response: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("request failed with status %d: %s", res.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+
+	// CertRep message
+	sd, err := ParseCMSSignedData(body)
+	if err != nil {
+		t.Fatalf("cannot parse response: %v", err)
+	}
+
+	if err := sd.Verify(); err != nil {
+		t.Fatalf("cannot verify response: %v", err)
+	}
+
+	if !sd.SignerCertificate.Equal(s.raCert) {
+		t.Errorf("response was not signed by the ra")
+	}
+
+	attrValue := func(oid asn1.ObjectIdentifier, value interface{}) {
+		data := sd.SignedAttribute(oid)
+		if data == nil {
+			t.Fatalf("missing attribute %v", oid)
+		}
+
+		if _, err := asn1.Unmarshal(data, value); err != nil {
+			t.Fatalf("invalid attribute %v: %v", oid, err)
+		}
+	}
+
+	var messageType, resTransactionID string
+	var recipientNonce []byte
+
+	var scepRes testSCEPResponse
+
+	attrValue(oidSCEPMessageType, &messageType)
+	attrValue(oidSCEPTransactionID, &resTransactionID)
+	attrValue(oidSCEPRecipientNonce, &recipientNonce)
+	attrValue(oidSCEPPKIStatus, &scepRes.Status)
+
+	if messageType != scepMessageTypeCertRep {
+		t.Errorf("response has message type %q", messageType)
+	}
+
+	if resTransactionID != transactionID {
+		t.Errorf("response has transaction id %q instead of %q",
+			resTransactionID, transactionID)
+	}
+
+	if !bytes.Equal(recipientNonce, senderNonce) {
+		t.Errorf("response recipient nonce does not match the sender " +
+			"nonce of the request")
+	}
+
+	switch scepRes.Status {
+	case scepPKIStatusSuccess:
+		ed, err := ParseCMSEnvelopedData(sd.Content)
+		if err != nil {
+			t.Fatalf("cannot parse enveloped data: %v", err)
+		}
+
+		certsData, err := ed.Decrypt(c.cert, c.key)
+		if err != nil {
+			t.Fatalf("cannot decrypt response: %v", err)
+		}
+
+		certsSD, err := ParseCMSSignedData(certsData)
+		if err != nil {
+			t.Fatalf("cannot parse certificates: %v", err)
+		}
+
+		if len(certsSD.Certificates) != 1 {
+			t.Fatalf("response contains %d certificates instead of one",
+				len(certsSD.Certificates))
+		}
+
+		scepRes.Certificate = certsSD.Certificates[0]
+
+	case scepPKIStatusFailure:
+		var failInfo string
+		attrValue(oidSCEPFailInfo, &failInfo)
+
+		scepRes.FailInfo = SCEPFailInfo(failInfo)
+
+	default:
+		t.Fatalf("response has status %q", scepRes.Status)
+	}
+
+	return &scepRes
+}
+
+func (c *testSCEPClient) Enroll(t *testing.T, s *testSCEPServer, commonName, password string) *testSCEPResponse {
+	t.Helper()
+
+	csr := c.NewCSR(t, commonName, password)
+
+	return c.Send(t, s, http.MethodPost, c.Encrypt(t, s, csr))
+}
+
+func TestSCEPGetCACert(t *testing.T) {
+	s := newTestSCEPServer(t)
+
+	res, err := http.Get(s.URL + "?operation=GetCACert")
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("cannot read response: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("request failed with status %d", res.StatusCode)
+	}
+
+	sd, err := ParseCMSSignedData(body)
+	if err != nil {
+		t.Fatalf("cannot parse response: %v", err)
+	}
+
+	rootCert, _ := loadTestCertificate(t, "root-ca")
+
+	expectedCerts := []*x509.Certificate{s.raCert, s.subCert, rootCert}
+
+	if len(sd.Certificates) != len(expectedCerts) {
+		t.Fatalf("response contains %d certificates instead of %d",
+			len(sd.Certificates), len(expectedCerts))
+	}
+
+	for i, cert := range sd.Certificates {
+		if !cert.Equal(expectedCerts[i]) {
+			t.Errorf("certificate %d is %q instead of %q", i,
+				cert.Subject, expectedCerts[i].Subject)
+		}
+	}
+}
+
+func TestSCEPEnrollment(t *testing.T) {
+	s := newTestSCEPServer(t)
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		c := newTestSCEPClient(t)
+
+		password := s.CreateChallenge(t, time.Hour)
+		csr := c.NewCSR(t, "device."+strings.ToLower(method), password)
+
+		res := c.Send(t, s, method, c.Encrypt(t, s, csr))
+		if res.Status != scepPKIStatusSuccess {
+			t.Fatalf("%s request failed with failure info %q", method,
+				res.FailInfo)
+		}
+
+		cert := res.Certificate
+
+		if err := cert.CheckSignatureFrom(s.subCert); err != nil {
+			t.Errorf("certificate was not issued by the issuer: %v", err)
+		}
+
+		if !c.key.PublicKey.Equal(cert.PublicKey) {
+			t.Errorf("certificate does not contain the public key of " +
+				"the request")
+		}
+
+		expectedCN := "device." + strings.ToLower(method)
+		if cert.Subject.CommonName != expectedCN {
+			t.Errorf("certificate common name is %q instead of %q",
+				cert.Subject.CommonName, expectedCN)
+		}
+
+		index, err := pki.LoadIndex()
+		if err != nil {
+			t.Fatalf("cannot load index: %v", err)
+		}
+
+		entry := index.EntryBySerialNumber("sub-ca", cert.SerialNumber)
+		if entry == nil {
+			t.Errorf("certificate not found in index")
+		} else if !entry.ExternalPrivateKey {
+			t.Errorf("index entry is not marked as having an external " +
+				"private key")
+		}
+	}
+}
+
+func TestSCEPChallenges(t *testing.T) {
+	s := newTestSCEPServer(t)
+
+	c := newTestSCEPClient(t)
+
+	// Challenges can only be used once
+	password := s.CreateChallenge(t, time.Hour)
+
+	if res := c.Enroll(t, s, "device", password); res.Status !=
+		scepPKIStatusSuccess {
+		t.Fatalf("request failed with failure info %q", res.FailInfo)
+	}
+
+	tests := []struct {
+		Name     string
+		Password string
+	}{
+		{"reused", password},
+		{"expired", s.CreateChallenge(t, -time.Hour)},
+		{"unknown", generateRandomID()},
+		{"empty", ""},
+	}
+
+	for _, test := range tests {
+		res := c.Enroll(t, s, "device", test.Password)
+		if res.Status != scepPKIStatusFailure {
+			t.Errorf("request with %s challenge succeeded", test.Name)
+		} else if res.FailInfo != SCEPFailInfoBadRequest {
+			t.Errorf("request with %s challenge failed with failure "+
+				"info %q instead of %q", test.Name, res.FailInfo,
+				SCEPFailInfoBadRequest)
+		}
+	}
+
+	// A failed request does not consume the challenge
+	password = s.CreateChallenge(t, time.Hour)
+
+	res := c.Send(t, s, http.MethodPost, c.Encrypt(t, s, []byte("foo")))
+	if res.Status != scepPKIStatusFailure {
+		t.Fatalf("invalid request succeeded")
+	}
+
+	if res := c.Enroll(t, s, "device", password); res.Status !=
+		scepPKIStatusSuccess {
+		t.Errorf("request failed with failure info %q", res.FailInfo)
+	}
+}
+
+// Responses must not reveal whether the padding of the encrypted content of
+// a request is valid, otherwise they can be used as a padding oracle.
+func TestSCEPDecryptionFailures(t *testing.T) {
+	s := newTestSCEPServer(t)
+
+	c := newTestSCEPClient(t)
+
+	password := s.CreateChallenge(t, time.Hour)
+	csr := c.NewCSR(t, "device", password)
+
+	// Invalid padding: flipping a bit of the last byte of the penultimate
+	// ciphertext block flips the same bit of the padding length, which
+	// becomes larger than the block size.
+	ed, err := ParseCMSEnvelopedData(c.Encrypt(t, s, csr))
+	if err != nil {
+		t.Fatalf("cannot parse enveloped data: %v", err)
+	}
+
+	eci := &ed.envelopedData.EncryptedContentInfo
+
+	ciphertext := append([]byte(nil), eci.EncryptedContent.Bytes...)
+	ciphertext[len(ciphertext)-17] ^= 0x20
+
+	eci.EncryptedContent = asn1.RawValue{
+		Class: asn1.ClassContextSpecific,
+		Tag:   0,
+		Bytes: ciphertext,
+	}
+
+	badPadding, err := marshalCMSContentInfo(oidCMSEnvelopedData,
+		ed.envelopedData)
+	if err != nil {
+		t.Fatalf("cannot encode enveloped data: %v", err)
+	}
+
+	if _, err := ed.Decrypt(s.raCert, s.raKey); err == nil {
+		t.Fatalf("modified enveloped data can be decrypted")
+	} else if !strings.Contains(err.Error(), "padding") {
+		t.Fatalf("modified enveloped data cannot be decrypted: %v", err)
+	}
+
+	// Valid padding, invalid certificate request
+	badCSR := c.Encrypt(t, s, csr[:len(csr)-1])
+
+	badPaddingRes := c.Send(t, s, http.MethodPost, badPadding)
+	badCSRRes := c.Send(t, s, http.MethodPost, badCSR)
+
+	if badPaddingRes.Status != scepPKIStatusFailure ||
+		badCSRRes.Status != scepPKIStatusFailure {
+		t.Fatalf("invalid requests succeeded")
+	}
+
+	if badPaddingRes.FailInfo != badCSRRes.FailInfo {
+		t.Errorf("invalid padding failure info %q differs from invalid "+
+			"certificate request failure info %q",
+			badPaddingRes.FailInfo, badCSRRes.FailInfo)
+	}
+
+	// The challenge was not consumed
+	if res := c.Enroll(t, s, "device", password); res.Status !=
+		scepPKIStatusSuccess {
+		t.Errorf("request failed with failure info %q", res.FailInfo)
+	}
+}
+
+func TestSCEPCfgValidate(t *testing.T) {
+	tests := []struct {
+		Cfg   SCEPCfg
+		Valid bool
+	}{
+		{SCEPCfg{Issuer: "sub-ca"}, true},
+		{SCEPCfg{Issuer: "sub-ca", Profile: "client"}, true},
+		{SCEPCfg{Issuer: "sub-ca", ChallengeValidity: 48}, true},
+		{SCEPCfg{}, false},
+		{SCEPCfg{Issuer: "sub-ca", Profile: "ocsp-signer"}, false},
+		{SCEPCfg{Issuer: "sub-ca", ChallengeValidity: -1}, false},
+		{SCEPCfg{Issuer: "sub-ca",
+			ChallengeValidity: MaxSCEPChallengeValidity + 1}, false},
+	}
+
+	for _, test := range tests {
+		err := test.Cfg.Validate()
+		if test.Valid && err != nil {
+			t.Errorf("configuration %+v is invalid: %v", test.Cfg, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("configuration %+v is valid", test.Cfg)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// All PKI data are stored as objects identified by a type and a name. A
+// storage backend is responsible for persisting them and for making sure
+// that a set of writes is applied atomically.
+
+type ObjectType string
+
+const (
+	ObjectTypeConfiguration ObjectType = "configuration"
+	ObjectTypeCfgBackup     ObjectType = "configuration-backup"
+	ObjectTypePrivateKey    ObjectType = "private-key"
+	ObjectTypeCertificate   ObjectType = "certificate"
+	ObjectTypeCRL           ObjectType = "crl"
+	ObjectTypeCRLState      ObjectType = "crl-state"
+	ObjectTypeDeltaCRL      ObjectType = "delta-crl"
+	ObjectTypeIndex         ObjectType = "index"
+	ObjectTypeACMEAccount   ObjectType = "acme-account"
+	ObjectTypeSCEPChallenge ObjectType = "scep-challenge"
+)
+
+var ObjectTypes = []ObjectType{
+	ObjectTypeConfiguration,
+	ObjectTypeCfgBackup,
+	ObjectTypePrivateKey,
+	ObjectTypeCertificate,
+	ObjectTypeCRL,
+	ObjectTypeCRLState,
+	ObjectTypeDeltaCRL,
+	ObjectTypeIndex,
+	ObjectTypeACMEAccount,
+	ObjectTypeSCEPChallenge,
+}
+
+const (
+	CfgObjectName   = "cfg"
+	IndexObjectName = "index"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type StorageWrite struct {
+	Type    ObjectType
+	Name    string
+	Data    []byte
+	Replace bool
+}
+
+type Storage interface {
+	// A human readable description of where data are stored.
+	Location() string
+
+	// Create the underlying storage if it does not exist yet.
+	Initialize() error
+	IsEmpty() (bool, error)
+
+	Lock(LockMode, time.Duration) error
+	Unlock() error
+
+	// Return an error wrapping ErrObjectNotFound if the object does not
+	// exist.
+	ReadObject(ObjectType, string) ([]byte, error)
+	ListObjects(ObjectType) ([]string, error)
+
+	// Apply a set of writes atomically: either all objects are written or
+	// none is. Writes which do not replace existing objects fail if the
+	// object already exists.
+	WriteObjects([]StorageWrite) error
+}
+
+// Storage backends which store data in files can report the permissions of
+// the file containing an object.
+type ObjectModeReader interface {
+	ObjectMode(ObjectType, string) (os.FileMode, error)
+}
+
+func NewStorage(storageType, path string) (Storage, error) {
+	switch storageType {
+	case "directory":
+		return NewDirectoryStorage(path), nil
+	case "sqlite":
+		return NewSQLiteStorage(path), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", storageType)
+	}
+}
+
+func objectNotFound(objType ObjectType, name string) error {
+	return fmt.Errorf("%s %q: %w", objType, name, ErrObjectNotFound)
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The directory storage is the historical layout of a PKI:
+//
+//     cfg.json
+//     cfg-backups/<name>.json
+//     index.json
+//     private-keys/<name>.key
+//     certificates/<name>.crt
+//     certificates/<name>.crl
+//     crl-states/<name>.json
+//     delta-crls/<name>.crl
+//     acme-accounts/<name>.json
+//     scep-challenges/<name>.json
+
+type DirectoryStorage struct {
+	Path string
+
+	lock *FileLock
+}
+
+func NewDirectoryStorage(path string) *DirectoryStorage {
+	s := DirectoryStorage{
+		Path: path,
+	}
+
+	s.lock = NewFileLock(s.LockPath())
+
+	return &s
+}
+
+func (s *DirectoryStorage) Location() string {
+	return fmt.Sprintf("%q", s.Path)
+}
+
+func (s *DirectoryStorage) Initialize() error {
+	if err := os.MkdirAll(s.Path, 0755); err != nil {
+		return fmt.Errorf("cannot create %q: %w", s.Path, err)
+	}
+
+	return nil
+}
+
+func (s *DirectoryStorage) IsEmpty() (bool, error) {
+	fileInfo, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return false, fmt.Errorf("cannot list files in %q: %w",
+			s.Path, err)
+	}
+
+	for _, fi := range fileInfo {
+		if fi.Name() != path.Base(s.LockPath()) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *DirectoryStorage) Lock(mode LockMode, timeout time.Duration) error {
+	return s.lock.Lock(mode, timeout)
+}
+
+func (s *DirectoryStorage) Unlock() error {
+	return s.lock.Unlock()
+}
+
+func (s *DirectoryStorage) ReadObject(objType ObjectType, name string) ([]byte, error) {
+	filePath, err := s.ObjectPath(objType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, objectNotFound(objType, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	return data, nil
+}
+
+func (s *DirectoryStorage) ListObjects(objType ObjectType) ([]string, error) {
+	var dirPath, ext string
+
+	switch objType {
+	case ObjectTypeConfiguration:
+		return s.listSingletonObject(objType, CfgObjectName)
+	case ObjectTypeIndex:
+		return s.listSingletonObject(objType, IndexObjectName)
+	case ObjectTypeCfgBackup:
+		dirPath, ext = s.CfgBackupsPath(), ".json"
+	case ObjectTypePrivateKey:
+		dirPath, ext = s.PrivateKeysPath(), ".key"
+	case ObjectTypeCertificate:
+		dirPath, ext = s.CertificatesPath(), ".crt"
+	case ObjectTypeCRL:
+		dirPath, ext = s.CertificatesPath(), ".crl"
+	case ObjectTypeCRLState:
+		dirPath, ext = s.CRLStatesPath(), ".json"
+	case ObjectTypeDeltaCRL:
+		dirPath, ext = s.DeltaCRLsPath(), ".crl"
+	case ObjectTypeACMEAccount:
+		dirPath, ext = s.ACMEAccountsPath(), ".json"
+	case ObjectTypeSCEPChallenge:
+		dirPath, ext = s.SCEPChallengesPath(), ".json"
+	default:
+		return nil, fmt.Errorf("cannot list objects of type %q", objType)
+	}
+
+	fileInfo, err := ioutil.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list files in %q: %w",
+			dirPath, err)
+	}
+
+	var names []string
+
+	for _, fi := range fileInfo {
+		fileName := fi.Name()
+
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fileName, ".") {
+			continue
+		}
+
+		if strings.HasSuffix(fileName, ext) {
+			names = append(names, strings.TrimSuffix(fileName, ext))
+		}
+	}
+
+	return names, nil
+}
+
+func (s *DirectoryStorage) listSingletonObject(objType ObjectType, name string) ([]string, error) {
+	filePath, err := s.ObjectPath(objType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot stat %q: %w", filePath, err)
+	}
+
+	return []string{name}, nil
+}
+
+func (s *DirectoryStorage) WriteObjects(writes []StorageWrite) error {
+	tx := NewTransaction()
+
+	for _, w := range writes {
+		filePath, err := s.ObjectPath(w.Type, w.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := os.FileMode(0644)
+		if w.Type == ObjectTypePrivateKey {
+			mode = 0600
+		}
+
+		if w.Replace {
+			tx.CreateOrReplaceFile(filePath, w.Data, mode)
+		} else {
+			tx.CreateFile(filePath, w.Data, mode)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *DirectoryStorage) ObjectMode(objType ObjectType, name string) (os.FileMode, error) {
+	filePath, err := s.ObjectPath(objType, name)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot stat %q: %w", filePath, err)
+	}
+
+	return info.Mode().Perm(), nil
+}
+
+func (s *DirectoryStorage) ObjectPath(objType ObjectType, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\x00") ||
+		strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid %s name %q", objType, name)
+	}
+
+	switch objType {
+	case ObjectTypeConfiguration:
+		if name != CfgObjectName {
+			return "", fmt.Errorf("invalid %s name %q", objType, name)
+		}
+		return path.Join(s.Path, name+".json"), nil
+	case ObjectTypeCfgBackup:
+		return path.Join(s.CfgBackupsPath(), name+".json"), nil
+	case ObjectTypeIndex:
+		if name != IndexObjectName {
+			return "", fmt.Errorf("invalid %s name %q", objType, name)
+		}
+		return path.Join(s.Path, name+".json"), nil
+	case ObjectTypePrivateKey:
+		return s.PrivateKeyPath(name), nil
+	case ObjectTypeCertificate:
+		return s.CertificatePath(name), nil
+	case ObjectTypeCRL:
+		return s.CRLPath(name), nil
+	case ObjectTypeCRLState:
+		return path.Join(s.CRLStatesPath(), name+".json"), nil
+	case ObjectTypeDeltaCRL:
+		return s.DeltaCRLPath(name), nil
+	case ObjectTypeACMEAccount:
+		return path.Join(s.ACMEAccountsPath(), name+".json"), nil
+	case ObjectTypeSCEPChallenge:
+		return path.Join(s.SCEPChallengesPath(), name+".json"), nil
+	default:
+		return "", fmt.Errorf("unknown object type %q", objType)
+	}
+}
+
+func (s *DirectoryStorage) LockPath() string {
+	return path.Join(s.Path, ".lock")
+}
+
+func (s *DirectoryStorage) CfgBackupsPath() string {
+	return path.Join(s.Path, "cfg-backups")
+}
+
+func (s *DirectoryStorage) PrivateKeysPath() string {
+	return path.Join(s.Path, "private-keys")
+}
+
+func (s *DirectoryStorage) PrivateKeyPath(name string) string {
+	return path.Join(s.PrivateKeysPath(), name+".key")
+}
+
+func (s *DirectoryStorage) CertificatesPath() string {
+	return path.Join(s.Path, "certificates")
+}
+
+func (s *DirectoryStorage) CertificatePath(name string) string {
+	return path.Join(s.CertificatesPath(), name+".crt")
+}
+
+func (s *DirectoryStorage) CRLPath(name string) string {
+	return path.Join(s.CertificatesPath(), name+".crl")
+}
+
+func (s *DirectoryStorage) CRLStatesPath() string {
+	return path.Join(s.Path, "crl-states")
+}
+
+func (s *DirectoryStorage) DeltaCRLsPath() string {
+	return path.Join(s.Path, "delta-crls")
+}
+
+func (s *DirectoryStorage) DeltaCRLPath(name string) string {
+	return path.Join(s.DeltaCRLsPath(), name+".crl")
+}
+
+func (s *DirectoryStorage) ACMEAccountsPath() string {
+	return path.Join(s.Path, "acme-accounts")
+}
+
+func (s *DirectoryStorage) SCEPChallengesPath() string {
+	return path.Join(s.Path, "scep-challenges")
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The memory storage keeps all objects in memory; it is mostly useful for
+// tests.
+
+type MemoryStorage struct {
+	objects map[ObjectType]map[string][]byte
+	mutex   sync.Mutex
+
+	lock     sync.RWMutex
+	lockMode *LockMode
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	s := MemoryStorage{
+		objects: make(map[ObjectType]map[string][]byte),
+	}
+
+	return &s
+}
+
+func (s *MemoryStorage) Location() string {
+	return "memory"
+}
+
+func (s *MemoryStorage) Initialize() error {
+	return nil
+}
+
+func (s *MemoryStorage) IsEmpty() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, objects := range s.objects {
+		if len(objects) > 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *MemoryStorage) Lock(mode LockMode, timeout time.Duration) error {
+	tryLock := s.lock.TryRLock
+	if mode == LockModeExclusive {
+		tryLock = s.lock.TryLock
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for !tryLock() {
+		if time.Now().After(deadline) {
+			return errors.New("timeout while waiting for lock")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mutex.Lock()
+	s.lockMode = &mode
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *MemoryStorage) Unlock() error {
+	s.mutex.Lock()
+	mode := s.lockMode
+	s.lockMode = nil
+	s.mutex.Unlock()
+
+	if mode == nil {
+		return errors.New("lock not acquired")
+	}
+
+	if *mode == LockModeExclusive {
+		s.lock.Unlock()
+	} else {
+		s.lock.RUnlock()
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) ReadObject(objType ObjectType, name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, found := s.objects[objType][name]
+	if !found {
+		return nil, objectNotFound(objType, name)
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStorage) ListObjects(objType ObjectType) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var names []string
+	for name := range s.objects[objType] {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *MemoryStorage) WriteObjects(writes []StorageWrite) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Check everything first so that nothing is written on error
+	created := make(map[ObjectType]map[string]bool)
+
+	for _, w := range writes {
+		_, found := s.objects[w.Type][w.Name]
+		if (found || created[w.Type][w.Name]) && !w.Replace {
+			return fmt.Errorf("%s %q already exists", w.Type, w.Name)
+		}
+
+		if created[w.Type] == nil {
+			created[w.Type] = make(map[string]bool)
+		}
+		created[w.Type][w.Name] = true
+	}
+
+	for _, w := range writes {
+		objects, found := s.objects[w.Type]
+		if !found {
+			objects = make(map[string][]byte)
+			s.objects[w.Type] = objects
+		}
+
+		objects[w.Name] = append([]byte(nil), w.Data...)
+	}
+
+	return nil
+}
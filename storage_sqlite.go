@@ -0,0 +1,235 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The SQLite storage keeps the entire PKI in a single database file, which
+// makes it easy to embed in a service. Writes are applied in a single SQL
+// transaction.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+  type TEXT NOT NULL,
+  name TEXT NOT NULL,
+  data BLOB NOT NULL,
+  PRIMARY KEY (type, name)
+);
+`
+
+type SQLiteStorage struct {
+	Path string
+
+	db   *sql.DB
+	lock *FileLock
+}
+
+func NewSQLiteStorage(path string) *SQLiteStorage {
+	s := SQLiteStorage{
+		Path: path,
+	}
+
+	s.lock = NewFileLock(path + ".lock")
+
+	return &s
+}
+
+func (s *SQLiteStorage) Location() string {
+	return fmt.Sprintf("sqlite database %q", s.Path)
+}
+
+func (s *SQLiteStorage) Initialize() error {
+	// The database contains private keys: make sure it is not readable by
+	// other users.
+	file, err := os.OpenFile(s.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", s.Path, err)
+	}
+	file.Close()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("cannot create database schema: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) IsEmpty() (bool, error) {
+	if err := s.open(); err != nil {
+		return false, err
+	}
+
+	var count int
+
+	row := s.db.QueryRow(`SELECT COUNT(*) FROM objects`)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("cannot count objects: %w", err)
+	}
+
+	return count == 0, nil
+}
+
+func (s *SQLiteStorage) Lock(mode LockMode, timeout time.Duration) error {
+	return s.lock.Lock(mode, timeout)
+}
+
+func (s *SQLiteStorage) Unlock() error {
+	return s.lock.Unlock()
+}
+
+func (s *SQLiteStorage) ReadObject(objType ObjectType, name string) ([]byte, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+
+	row := s.db.QueryRow(`SELECT data FROM objects
+                                WHERE type = ? AND name = ?`,
+		string(objType), name)
+	if err := row.Scan(&data); errors.Is(err, sql.ErrNoRows) {
+		return nil, objectNotFound(objType, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %s %q: %w", objType, name, err)
+	}
+
+	return data, nil
+}
+
+func (s *SQLiteStorage) ListObjects(objType ObjectType) ([]string, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT name FROM objects
+                                   WHERE type = ? ORDER BY name`,
+		string(objType))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list objects: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("cannot read row: %w", err)
+		}
+
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot list objects: %w", err)
+	}
+
+	return names, nil
+}
+
+func (s *SQLiteStorage) WriteObjects(writes []StorageWrite) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %w", err)
+	}
+
+	for _, w := range writes {
+		query := `INSERT INTO objects (type, name, data) VALUES (?, ?, ?)`
+		if w.Replace {
+			query += ` ON CONFLICT (type, name) DO UPDATE
+                                     SET data = excluded.data`
+		}
+
+		_, err := tx.Exec(query, string(w.Type), w.Name, w.Data)
+		if err != nil {
+			tx.Rollback()
+
+			if isSQLiteConstraintError(err) {
+				return fmt.Errorf("%s %q already exists",
+					w.Type, w.Name)
+			}
+
+			return fmt.Errorf("cannot write %s %q: %w",
+				w.Type, w.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// All objects are stored in the database file.
+func (s *SQLiteStorage) ObjectMode(objType ObjectType, name string) (os.FileMode, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return 0, fmt.Errorf("cannot stat %q: %w", s.Path, err)
+	}
+
+	return info.Mode().Perm(), nil
+}
+
+func (s *SQLiteStorage) open() error {
+	if s.db != nil {
+		return nil
+	}
+
+	// We do not let the driver create the database file: only
+	// Initialize does.
+	if _, err := os.Stat(s.Path); err != nil {
+		return fmt.Errorf("cannot stat %q: %w", s.Path, err)
+	}
+
+	query := url.Values{}
+	query.Set("_foreign_keys", "1")
+	query.Set("_journal_mode", "WAL")
+	query.Set("_synchronous", "FULL")
+	query.Set("_busy_timeout", "10000")
+
+	uri := "file:" + s.Path + "?" + query.Encode()
+
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return fmt.Errorf("cannot open database %q: %w", s.Path, err)
+	}
+
+	s.db = db
+
+	return nil
+}
+
+func isSQLiteConstraintError(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
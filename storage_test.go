@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Every storage backend must satisfy the same contract, which is checked
+// against all of them.
+
+var testStorageBackends = []struct {
+	Name       string
+	NewStorage func(t *testing.T) Storage
+}{
+	{
+		Name: "memory",
+		NewStorage: func(t *testing.T) Storage {
+			return NewMemoryStorage()
+		},
+	},
+	{
+		Name: "directory",
+		NewStorage: func(t *testing.T) Storage {
+			return NewDirectoryStorage(filepath.Join(t.TempDir(), "pki"))
+		},
+	},
+	{
+		Name: "sqlite",
+		NewStorage: func(t *testing.T) Storage {
+			return NewSQLiteStorage(filepath.Join(t.TempDir(), "pki.db"))
+		},
+	},
+}
+
+func TestStorage(t *testing.T) {
+	for _, backend := range testStorageBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			s := backend.NewStorage(t)
+
+			if err := s.Initialize(); err != nil {
+				t.Fatalf("cannot initialize storage: %v", err)
+			}
+
+			testStorageObjects(t, s)
+			testStorageAtomicWrites(t, s)
+			testStorageLock(t, s)
+		})
+	}
+}
+
+func testStorageObjects(t *testing.T, s Storage) {
+	assertStorageEmpty(t, s, true)
+
+	_, err := s.ReadObject(ObjectTypeCertificate, "a")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("reading a missing object returned %v instead of "+
+			"ErrObjectNotFound", err)
+	}
+
+	names, err := s.ListObjects(ObjectTypeCertificate)
+	if err != nil {
+		t.Fatalf("cannot list objects: %v", err)
+	} else if len(names) > 0 {
+		t.Errorf("empty storage contains objects %v", names)
+	}
+
+	writeTestObjects(t, s, []StorageWrite{
+		{Type: ObjectTypeCertificate, Name: "b", Data: []byte("b")},
+		{Type: ObjectTypeCertificate, Name: "a", Data: []byte("a")},
+		{Type: ObjectTypePrivateKey, Name: "a", Data: []byte("key")},
+	})
+
+	assertStorageEmpty(t, s, false)
+
+	assertObjectData(t, s, ObjectTypeCertificate, "a", "a")
+	assertObjectData(t, s, ObjectTypeCertificate, "b", "b")
+	assertObjectData(t, s, ObjectTypePrivateKey, "a", "key")
+
+	assertObjectNames(t, s, ObjectTypeCertificate, []string{"a", "b"})
+	assertObjectNames(t, s, ObjectTypePrivateKey, []string{"a"})
+
+	writeTestObjects(t, s, []StorageWrite{
+		{Type: ObjectTypeCertificate, Name: "a", Data: []byte("a2"),
+			Replace: true},
+	})
+
+	assertObjectData(t, s, ObjectTypeCertificate, "a", "a2")
+}
+
+func testStorageAtomicWrites(t *testing.T, s Storage) {
+	// Creating an object which already exists must fail, and no other
+	// write of the set must be applied.
+	err := s.WriteObjects([]StorageWrite{
+		{Type: ObjectTypeCertificate, Name: "c", Data: []byte("c")},
+		{Type: ObjectTypeCertificate, Name: "b", Data: []byte("b2")},
+	})
+	if err == nil {
+		t.Fatalf("creating an existing object did not fail")
+	}
+
+	_, err = s.ReadObject(ObjectTypeCertificate, "c")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("object written by a failed write set: %v", err)
+	}
+
+	assertObjectData(t, s, ObjectTypeCertificate, "b", "b")
+
+	// The same object cannot be created twice in the same set
+	err = s.WriteObjects([]StorageWrite{
+		{Type: ObjectTypeCertificate, Name: "d", Data: []byte("d")},
+		{Type: ObjectTypeCertificate, Name: "d", Data: []byte("d2")},
+	})
+	if err == nil {
+		t.Fatalf("creating an object twice did not fail")
+	}
+
+	_, err = s.ReadObject(ObjectTypeCertificate, "d")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("object written by a failed write set: %v", err)
+	}
+}
+
+func testStorageLock(t *testing.T, s Storage) {
+	for _, mode := range []LockMode{LockModeShared, LockModeExclusive} {
+		if err := s.Lock(mode, time.Second); err != nil {
+			t.Fatalf("cannot lock storage: %v", err)
+		}
+
+		if err := s.Unlock(); err != nil {
+			t.Fatalf("cannot unlock storage: %v", err)
+		}
+	}
+}
+
+func writeTestObjects(t *testing.T, s Storage, writes []StorageWrite) {
+	t.Helper()
+
+	if err := s.WriteObjects(writes); err != nil {
+		t.Fatalf("cannot write objects: %v", err)
+	}
+}
+
+func assertStorageEmpty(t *testing.T, s Storage, expected bool) {
+	t.Helper()
+
+	empty, err := s.IsEmpty()
+	if err != nil {
+		t.Fatalf("cannot check storage: %v", err)
+	} else if empty != expected {
+		t.Errorf("storage emptiness is %v instead of %v", empty, expected)
+	}
+}
+
+func assertObjectData(t *testing.T, s Storage, objType ObjectType, name, expected string) {
+	t.Helper()
+
+	data, err := s.ReadObject(objType, name)
+	if err != nil {
+		t.Fatalf("cannot read %s %q: %v", objType, name, err)
+	} else if string(data) != expected {
+		t.Errorf("%s %q contains %q instead of %q", objType, name, data,
+			expected)
+	}
+}
+
+func assertObjectNames(t *testing.T, s Storage, objType ObjectType, expected []string) {
+	t.Helper()
+
+	names, err := s.ListObjects(objType)
+	if err != nil {
+		t.Fatalf("cannot list %s objects: %v", objType, err)
+	} else if !reflect.DeepEqual(names, expected) {
+		t.Errorf("%s objects are %v instead of %v", objType, names,
+			expected)
+	}
+}
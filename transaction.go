@@ -0,0 +1,276 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A transaction stages a set of file writes and applies them together: if
+// any of them fails, files which were already written are removed or
+// restored to their previous content, and directories created for them are
+// deleted.
+
+type Transaction struct {
+	files []*transactionFile
+
+	createdDirs []string
+	committed   bool
+}
+
+type transactionFile struct {
+	path    string
+	data    []byte
+	mode    os.FileMode
+	replace bool
+
+	tmpPath    string
+	backupPath string
+	existed    bool
+	written    bool
+}
+
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+func (tx *Transaction) CreateFile(filePath string, data []byte, mode os.FileMode) {
+	tx.addFile(filePath, data, mode, false)
+}
+
+func (tx *Transaction) CreateOrReplaceFile(filePath string, data []byte, mode os.FileMode) {
+	tx.addFile(filePath, data, mode, true)
+}
+
+func (tx *Transaction) addFile(filePath string, data []byte, mode os.FileMode, replace bool) {
+	file := transactionFile{
+		path:    filePath,
+		data:    data,
+		mode:    mode,
+		replace: replace,
+	}
+
+	tx.files = append(tx.files, &file)
+}
+
+func (tx *Transaction) Commit() error {
+	if tx.committed {
+		return errors.New("transaction already committed")
+	}
+	tx.committed = true
+
+	if err := tx.commit(); err != nil {
+		if err2 := tx.rollback(); err2 != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, err2)
+		}
+
+		return err
+	}
+
+	tx.cleanup()
+
+	return nil
+}
+
+func (tx *Transaction) commit() error {
+	// Write all data to temporary files first so that most errors (full
+	// disk, invalid permissions...) happen before any existing file is
+	// touched.
+	for _, file := range tx.files {
+		dirPath := filepath.Dir(file.path)
+
+		createdDirs, err := createDirectories(dirPath)
+		tx.createdDirs = append(tx.createdDirs, createdDirs...)
+		if err != nil {
+			return err
+		}
+
+		tmpPath, err := writeTemporaryFile(dirPath,
+			filepath.Base(file.path), file.data, file.mode)
+		if err != nil {
+			return err
+		}
+
+		file.tmpPath = tmpPath
+	}
+
+	for _, file := range tx.files {
+		if err := file.commit(); err != nil {
+			return err
+		}
+	}
+
+	dirPaths := make(map[string]struct{})
+	for _, file := range tx.files {
+		dirPaths[filepath.Dir(file.path)] = struct{}{}
+	}
+
+	for dirPath := range dirPaths {
+		if err := syncDirectory(dirPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (file *transactionFile) commit() error {
+	if !file.replace {
+		if err := os.Link(file.tmpPath, file.path); os.IsExist(err) {
+			return fmt.Errorf("%q already exists", file.path)
+		} else if err != nil {
+			return fmt.Errorf("cannot link %q to %q: %w",
+				file.tmpPath, file.path, err)
+		}
+
+		file.written = true
+
+		return nil
+	}
+
+	// Keep a link to the current file, if there is one, so that it can be
+	// restored on rollback.
+	backupPath, err := temporaryFilePath(filepath.Dir(file.path),
+		"."+filepath.Base(file.path)+".backup-*")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Link(file.path, backupPath); err == nil {
+		file.backupPath = backupPath
+		file.existed = true
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot link %q to %q: %w",
+			file.path, backupPath, err)
+	}
+
+	if err := os.Rename(file.tmpPath, file.path); err != nil {
+		return fmt.Errorf("cannot rename %q to %q: %w",
+			file.tmpPath, file.path, err)
+	}
+
+	file.written = true
+
+	return nil
+}
+
+func (tx *Transaction) rollback() error {
+	var firstErr error
+
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for i := len(tx.files) - 1; i >= 0; i-- {
+		file := tx.files[i]
+
+		if file.written {
+			if file.existed {
+				err := os.Rename(file.backupPath, file.path)
+				if err != nil {
+					setErr(fmt.Errorf("cannot restore %q: %w",
+						file.path, err))
+				}
+			} else {
+				err := os.Remove(file.path)
+				if err != nil && !os.IsNotExist(err) {
+					setErr(fmt.Errorf("cannot remove %q: %w",
+						file.path, err))
+				}
+			}
+		}
+	}
+
+	tx.cleanup()
+
+	for i := len(tx.createdDirs) - 1; i >= 0; i-- {
+		dirPath := tx.createdDirs[i]
+
+		if err := os.Remove(dirPath); err != nil && !os.IsNotExist(err) {
+			setErr(fmt.Errorf("cannot remove %q: %w", dirPath, err))
+		}
+	}
+
+	return firstErr
+}
+
+func (tx *Transaction) cleanup() {
+	for _, file := range tx.files {
+		if file.tmpPath != "" {
+			os.Remove(file.tmpPath)
+		}
+
+		if file.backupPath != "" {
+			os.Remove(file.backupPath)
+		}
+	}
+}
+
+// Create a directory and its missing parents, returning the list of
+// directories which were created, parents first.
+func createDirectories(dirPath string) ([]string, error) {
+	var missingDirs []string
+
+	for dir := filepath.Clean(dirPath); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot stat %q: %w", dir, err)
+		}
+
+		missingDirs = append(missingDirs, dir)
+
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	var createdDirs []string
+
+	for i := len(missingDirs) - 1; i >= 0; i-- {
+		dir := missingDirs[i]
+
+		if err := os.Mkdir(dir, 0755); os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return createdDirs, fmt.Errorf("cannot create "+
+				"directory %q: %w", dir, err)
+		}
+
+		createdDirs = append(createdDirs, dir)
+	}
+
+	return createdDirs, nil
+}
+
+func temporaryFilePath(dirPath, pattern string) (string, error) {
+	file, err := os.CreateTemp(dirPath, pattern)
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary file in %q: %w",
+			dirPath, err)
+	}
+
+	filePath := file.Name()
+
+	file.Close()
+	os.Remove(filePath)
+
+	return filePath, nil
+}
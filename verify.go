@@ -0,0 +1,361 @@
+// Copyright (c) 2020 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type VerificationSeverity string
+
+const (
+	VerificationError   VerificationSeverity = "error"
+	VerificationWarning VerificationSeverity = "warning"
+)
+
+type VerificationProblem struct {
+	Severity   VerificationSeverity
+	ObjectType ObjectType
+	Name       string
+	Message    string
+}
+
+func (vp VerificationProblem) String() string {
+	return fmt.Sprintf("%s: %s %q: %s",
+		vp.Severity, vp.ObjectType, vp.Name, vp.Message)
+}
+
+type VerificationReport struct {
+	Problems []VerificationProblem
+}
+
+func (r *VerificationReport) add(severity VerificationSeverity, objType ObjectType, name string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, VerificationProblem{
+		Severity:   severity,
+		ObjectType: objType,
+		Name:       name,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *VerificationReport) NbErrors() int {
+	n := 0
+
+	for _, vp := range r.Problems {
+		if vp.Severity == VerificationError {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Check the consistency of the entire pki. Problems with the content of the
+// pki are reported; an error is only returned if the verification itself
+// could not be performed.
+func (pki *PKI) Verify() (*VerificationReport, error) {
+	var r VerificationReport
+
+	index, err := pki.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	certNames, err := pki.Storage.ListObjects(ObjectTypeCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list certificates: %w", err)
+	}
+
+	keyNames, err := pki.Storage.ListObjects(ObjectTypePrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list private keys: %w", err)
+	}
+
+	crlNames, err := pki.Storage.ListObjects(ObjectTypeCRL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list crls: %w", err)
+	}
+
+	deltaCRLNames, err := pki.Storage.ListObjects(ObjectTypeDeltaCRL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list delta crls: %w", err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range certNames {
+		cert, err := pki.LoadCertificate(name)
+		if err != nil {
+			r.add(VerificationError, ObjectTypeCertificate, name,
+				"cannot load certificate: %v", err)
+			continue
+		}
+
+		certs[name] = cert
+	}
+
+	keys := make(map[string]bool)
+	for _, name := range keyNames {
+		keys[name] = true
+	}
+
+	// Index
+	indexedNames := make(map[string]bool)
+
+	for _, entry := range index.Entries {
+		indexedNames[entry.Name] = true
+
+		if !hasString(certNames, entry.Name) {
+			r.add(VerificationError, ObjectTypeCertificate,
+				entry.Name, "missing certificate referenced by "+
+					"the index")
+		}
+	}
+
+	// Certificates
+	for _, name := range certNames {
+		cert, found := certs[name]
+		if !found {
+			continue
+		}
+
+		entry := index.EntryByName(name)
+		if entry == nil {
+			r.add(VerificationError, ObjectTypeCertificate, name,
+				"orphaned certificate not referenced by the index")
+		} else {
+			pki.verifyCertificate(&r, name, cert, entry, certs)
+		}
+
+		if keys[name] {
+			pki.verifyPrivateKey(&r, name, cert)
+		} else if entry == nil || !entry.ExternalPrivateKey {
+			r.add(VerificationWarning, ObjectTypeCertificate, name,
+				"no private key")
+		}
+
+		if cert.IsCA {
+			if !hasString(crlNames, name) {
+				r.add(VerificationError, ObjectTypeCRL, name,
+					"missing crl for ca certificate")
+			} else {
+				pki.verifyCRL(&r, ObjectTypeCRL, name, cert)
+			}
+
+			if pki.CACfg(name).DeltaCRLs == nil {
+				if hasString(deltaCRLNames, name) {
+					r.add(VerificationWarning, ObjectTypeDeltaCRL,
+						name, "delta crls are not enabled for "+
+							"the ca")
+				}
+			} else if !hasString(deltaCRLNames, name) {
+				r.add(VerificationError, ObjectTypeDeltaCRL, name,
+					"missing delta crl for ca certificate")
+			} else {
+				pki.verifyCRL(&r, ObjectTypeDeltaCRL, name, cert)
+			}
+		}
+	}
+
+	// Private keys
+	for _, name := range keyNames {
+		if !hasString(certNames, name) {
+			r.add(VerificationError, ObjectTypePrivateKey, name,
+				"orphaned private key without certificate")
+		}
+
+		if modeReader, ok := pki.Storage.(ObjectModeReader); ok {
+			mode, err := modeReader.ObjectMode(ObjectTypePrivateKey,
+				name)
+			if err != nil {
+				r.add(VerificationError, ObjectTypePrivateKey, name,
+					"%v", err)
+			} else if mode&0077 != 0 {
+				r.add(VerificationError, ObjectTypePrivateKey, name,
+					"permissions %#o are too open", mode)
+			}
+		}
+	}
+
+	// CRLs
+	for _, name := range crlNames {
+		if cert, found := certs[name]; !found || !cert.IsCA {
+			r.add(VerificationError, ObjectTypeCRL, name,
+				"orphaned crl without ca certificate")
+		}
+	}
+
+	for _, name := range deltaCRLNames {
+		if cert, found := certs[name]; !found || !cert.IsCA {
+			r.add(VerificationError, ObjectTypeDeltaCRL, name,
+				"orphaned delta crl without ca certificate")
+		}
+	}
+
+	sort.SliceStable(r.Problems, func(i, j int) bool {
+		pi, pj := r.Problems[i], r.Problems[j]
+
+		if pi.ObjectType != pj.ObjectType {
+			return pi.ObjectType < pj.ObjectType
+		}
+
+		return pi.Name < pj.Name
+	})
+
+	return &r, nil
+}
+
+func (pki *PKI) verifyCertificate(r *VerificationReport, name string, cert *x509.Certificate, entry *IndexEntry, certs map[string]*x509.Certificate) {
+	if entry.SerialNumber != serialNumberString(cert.SerialNumber) {
+		r.add(VerificationError, ObjectTypeCertificate, name,
+			"serial number %s does not match the index (%s)",
+			serialNumberString(cert.SerialNumber), entry.SerialNumber)
+	}
+
+	if entry.IssuerName == "" {
+		r.add(VerificationError, ObjectTypeCertificate, name,
+			"unknown issuer")
+		return
+	}
+
+	issuerCert, found := certs[entry.IssuerName]
+	if !found {
+		r.add(VerificationError, ObjectTypeCertificate, name,
+			"missing issuer certificate %q", entry.IssuerName)
+		return
+	}
+
+	if !isIssuedBy(cert, issuerCert) {
+		r.add(VerificationError, ObjectTypeCertificate, name,
+			"not signed by issuer certificate %q", entry.IssuerName)
+	}
+}
+
+func (pki *PKI) verifyPrivateKey(r *VerificationReport, name string, cert *x509.Certificate) {
+	data, err := pki.Storage.ReadObject(ObjectTypePrivateKey, name)
+	if err != nil {
+		r.add(VerificationError, ObjectTypePrivateKey, name, "%v", err)
+		return
+	}
+
+	// We do not prompt for passwords: encrypted private keys cannot be
+	// checked.
+	if encrypted, err := IsEncryptedPEMPrivateKey(data); err != nil {
+		r.add(VerificationError, ObjectTypePrivateKey, name,
+			"invalid private key: %v", err)
+		return
+	} else if encrypted {
+		return
+	}
+
+	key, err := decodePEMPrivateKey(data, func() ([]byte, error) {
+		return nil, errors.New("private key is encrypted")
+	})
+	if err != nil {
+		r.add(VerificationError, ObjectTypePrivateKey, name,
+			"invalid private key: %v", err)
+		return
+	}
+
+	publicKey, ok := PublicKey(key).(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		r.add(VerificationError, ObjectTypePrivateKey, name,
+			"private key does not match the certificate")
+	}
+}
+
+func (pki *PKI) verifyCRL(r *VerificationReport, objType ObjectType, name string, cert *x509.Certificate) {
+	data, err := pki.loadCRL(objType, name)
+	if err != nil {
+		r.add(VerificationError, objType, name, "%v", err)
+		return
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		r.add(VerificationError, objType, name,
+			"cannot parse crl: %v", err)
+		return
+	}
+
+	if err := crl.CheckSignatureFrom(cert); err != nil {
+		r.add(VerificationError, objType, name,
+			"invalid signature: %v", err)
+	}
+
+	if crl.Number == nil {
+		r.add(VerificationWarning, objType, name,
+			"missing crl number")
+	}
+
+	if objType == ObjectTypeDeltaCRL {
+		pki.verifyDeltaCRL(r, name, data)
+	}
+
+	now := time.Now()
+	nextUpdate := crl.NextUpdate
+
+	if nextUpdate.Before(now) {
+		r.add(VerificationError, objType, name,
+			"stale crl (next update: %s)",
+			nextUpdate.Format(time.RFC3339))
+	} else if crlCloseToExpiry(crl.ThisUpdate, nextUpdate, now) {
+		r.add(VerificationWarning, objType, name,
+			"crl close to expiry (next update: %s)",
+			nextUpdate.Format(time.RFC3339))
+	}
+}
+
+func (pki *PKI) verifyDeltaCRL(r *VerificationReport, name string, data []byte) {
+	var deltaCRLData CRLData
+	if err := deltaCRLData.Read(data); err != nil {
+		r.add(VerificationError, ObjectTypeDeltaCRL, name, "%v", err)
+		return
+	}
+
+	if !deltaCRLData.IsDelta() {
+		r.add(VerificationError, ObjectTypeDeltaCRL, name,
+			"missing delta crl indicator")
+		return
+	}
+
+	crlData, err := pki.LoadCRLData(name)
+	if err != nil {
+		r.add(VerificationError, ObjectTypeDeltaCRL, name, "%v", err)
+		return
+	}
+
+	if crlData.Number == nil ||
+		crlData.Number.Cmp(deltaCRLData.BaseNumber) != 0 {
+		r.add(VerificationWarning, ObjectTypeDeltaCRL, name,
+			"delta crl is not based on the current complete crl")
+	}
+}
+
+func hasString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+
+	return false
+}